@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/joho/godotenv"
+	"github.com/pauslik/chirpy/internal/auth"
+	"github.com/pauslik/chirpy/internal/database"
+)
+
+// Subcommands, "chirpy" without arguments starts the server
+func runCommand(args []string) int {
+	switch args[0] {
+	case "hash-bench":
+		return hashBenchCommand(args[1:])
+	case "rotate-jwt-key":
+		return rotateJWTKeyCommand(args[1:])
+	case "create-admin":
+		return createAdminCommand(args[1:])
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command: %s\n", args[0])
+		fmt.Fprintln(os.Stderr, "Commands:")
+		fmt.Fprintln(os.Stderr, "  hash-bench        suggest argon2id parameters for this host")
+		fmt.Fprintln(os.Stderr, "  rotate-jwt-key    add a new JWT signing key and prune old ones")
+		fmt.Fprintln(os.Stderr, "  create-admin      make the first admin account")
+		return 2
+	}
+}
+
+func hashBenchCommand(args []string) int {
+	fs := flag.NewFlagSet("hash-bench", flag.ContinueOnError)
+	target := fs.Duration("target", 250*time.Millisecond, "how long one hash may take")
+	maxMemory := fs.Uint("max-memory", 256*1024, "upper bound for memory in KiB")
+	parallelism := fs.Uint("parallelism", uint(min(runtime.NumCPU(), 4)), "threads per hash")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	fmt.Printf("Benchmarking argon2id, target %s per hash...\n", *target)
+	params, took := auth.SuggestHashParams(*target, uint32(*maxMemory), uint8(*parallelism))
+
+	fmt.Printf("One hash took %s with these settings:\n\n", took.Round(time.Millisecond))
+	fmt.Printf("ARGON2_MEMORY_KIB=%d\n", params.Memory)
+	fmt.Printf("ARGON2_ITERATIONS=%d\n", params.Iterations)
+	fmt.Printf("ARGON2_PARALLELISM=%d\n", params.Parallelism)
+	return 0
+}
+
+func rotateJWTKeyCommand(args []string) int {
+	godotenv.Load()
+	fs := flag.NewFlagSet("rotate-jwt-key", flag.ContinueOnError)
+	dir := fs.String("dir", os.Getenv("JWT_KEYS_DIR"), "key directory, defaults to JWT_KEYS_DIR")
+	alg := fs.String("alg", auth.AlgEdDSA, "RS256 or EdDSA")
+	keep := fs.Int("keep", 3, "how many keys to keep, including the new one")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *dir == "" {
+		fmt.Fprintln(os.Stderr, "No key directory, set JWT_KEYS_DIR or pass -dir")
+		return 2
+	}
+	if *keep < 2 {
+		fmt.Fprintln(os.Stderr, "Keep at least 2 keys, tokens signed by the previous key are still live")
+		return 2
+	}
+
+	kid, err := auth.GenerateSigningKey(*dir, *alg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not generate key: %v\n", err)
+		return 1
+	}
+	fmt.Printf("Added %s key %s, it signs tokens from %s on\n", *alg, kid, time.Now().Add(auth.KeyActivationDelay).Format(time.RFC3339))
+
+	removed, err := auth.PruneSigningKeys(*dir, *keep)
+	for _, old := range removed {
+		fmt.Printf("Removed key %s\n", old)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not prune old keys: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// Promotes an existing user to admin, or creates the account with a password
+// read from stdin. Only works while there is no admin, later ones are made
+// through PUT /admin/users/{userID}/role.
+func createAdminCommand(args []string) int {
+	godotenv.Load()
+	fs := flag.NewFlagSet("create-admin", flag.ContinueOnError)
+	email := fs.String("email", "", "email of the admin account")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *email == "" {
+		fmt.Fprintln(os.Stderr, "Pass the account with -email")
+		return 2
+	}
+
+	db, err := sql.Open("postgres", os.Getenv("DB_URL"))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not open a connection to database: %v\n", err)
+		return 1
+	}
+	defer db.Close()
+	q := database.New(db)
+	ctx := context.Background()
+
+	admins, err := q.CountAdmins(ctx)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not count admins: %v\n", err)
+		return 1
+	}
+	if admins > 0 {
+		fmt.Fprintln(os.Stderr, "There already is an admin, use PUT /admin/users/{userID}/role")
+		return 1
+	}
+
+	dbUser, err := q.GetUser(ctx, *email)
+	if errors.Is(err, sql.ErrNoRows) {
+		dbUser, err = createAdminUser(ctx, q, *email)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not create user: %v\n", err)
+			return 1
+		}
+	} else if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not get user: %v\n", err)
+		return 1
+	}
+
+	_, err = q.SetUserRole(ctx, database.SetUserRoleParams{ID: dbUser.ID, Role: auth.RoleAdmin})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not set role: %v\n", err)
+		return 1
+	}
+	fmt.Printf("%s (%s) is now an admin\n", dbUser.Email, dbUser.ID)
+	return 0
+}
+
+func createAdminUser(ctx context.Context, q *database.Queries, email string) (database.User, error) {
+	err := loadHashParams()
+	if err != nil {
+		return database.User{}, err
+	}
+
+	fmt.Fprintf(os.Stderr, "No user %s, enter a password to create it: ", email)
+	password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && password == "" {
+		return database.User{}, fmt.Errorf("reading password: %w", err)
+	}
+	password = strings.TrimRight(password, "\r\n")
+
+	policy := auth.DefaultPasswordPolicy()
+	policy.MinLength, err = envInt("PASSWORD_MIN_LENGTH", policy.MinLength)
+	if err != nil {
+		return database.User{}, err
+	}
+	err = policy.Check(password)
+	if err != nil {
+		return database.User{}, err
+	}
+
+	hash, err := auth.HashPassword(password)
+	if err != nil {
+		return database.User{}, err
+	}
+	return q.CreateUser(ctx, database.CreateUserParams{Email: email, HashedPassword: hash})
+}
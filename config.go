@@ -0,0 +1,225 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pauslik/chirpy/internal/auth"
+	"github.com/pauslik/chirpy/internal/oidc"
+)
+
+// Integer environment variable, fallback is used when it's unset
+func envInt(name string, fallback int) (int, error) {
+	val := os.Getenv(name)
+	if val == "" {
+		return fallback, nil
+	}
+	i, err := strconv.Atoi(val)
+	if err != nil {
+		return 0, fmt.Errorf("%s is not a valid integer: %w", name, err)
+	}
+	return i, nil
+}
+
+// Duration environment variable like "15m" or "720h", or a number of days like "30d"
+func envDuration(name string, fallback time.Duration) (time.Duration, error) {
+	val := os.Getenv(name)
+	if val == "" {
+		return fallback, nil
+	}
+	if days, ok := strings.CutSuffix(val, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, fmt.Errorf("%s is not a valid duration: %w", name, err)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(val)
+	if err != nil {
+		return 0, fmt.Errorf("%s is not a valid duration: %w", name, err)
+	}
+	return d, nil
+}
+
+// Environment variable prefix of each client type's token lifetimes
+var tokenLifetimeEnv = map[auth.ClientType]string{
+	auth.ClientFirstParty:   "",
+	auth.ClientConfidential: "OAUTH_",
+	auth.ClientPublic:       "OAUTH_PUBLIC_",
+}
+
+// Token lifetimes per client type, e.g. ACCESS_TOKEN_TTL and OAUTH_PUBLIC_REFRESH_TOKEN_TTL,
+// JWT_LEEWAY, and JWT_AUDIENCE which defaults to the base URL of the deployment.
+// OAuth apps fall back to the first party lifetimes.
+func loadTokenPolicy(baseURL string) (*auth.TokenPolicy, error) {
+	policy := auth.DefaultTokenPolicy()
+	policy.Audience = baseURL
+	if audience, ok := os.LookupEnv("JWT_AUDIENCE"); ok {
+		policy.Audience = audience
+	}
+	var err error
+	policy.Leeway, err = envDuration("JWT_LEEWAY", policy.Leeway)
+	if err != nil {
+		return nil, err
+	}
+	if policy.Leeway < 0 || policy.Leeway > 5*time.Minute {
+		return nil, fmt.Errorf("JWT_LEEWAY must be between 0 and 5m, got %s", policy.Leeway)
+	}
+
+	firstParty := policy.Lifetime(auth.ClientFirstParty)
+	for _, clientType := range auth.ClientTypes {
+		prefix := tokenLifetimeEnv[clientType]
+		lifetime := auth.TokenLifetime{}
+		lifetime.Access, err = envDuration(prefix+"ACCESS_TOKEN_TTL", firstParty.Access)
+		if err != nil {
+			return nil, err
+		}
+		lifetime.Refresh, err = envDuration(prefix+"REFRESH_TOKEN_TTL", firstParty.Refresh)
+		if err != nil {
+			return nil, err
+		}
+		if lifetime.Access <= 0 || lifetime.Refresh < lifetime.Access {
+			return nil, fmt.Errorf("Invalid %s token lifetimes: access %s, refresh %s", clientType, lifetime.Access, lifetime.Refresh)
+		}
+		policy.Lifetimes[clientType] = lifetime
+		if clientType == auth.ClientFirstParty {
+			firstParty = lifetime
+		}
+	}
+	return policy, nil
+}
+
+// Overrides the argon2id parameters used for new password hashes
+func loadHashParams() error {
+	memory, err := envInt("ARGON2_MEMORY_KIB", int(auth.HashParams.Memory))
+	if err != nil {
+		return err
+	}
+	iterations, err := envInt("ARGON2_ITERATIONS", int(auth.HashParams.Iterations))
+	if err != nil {
+		return err
+	}
+	parallelism, err := envInt("ARGON2_PARALLELISM", int(auth.HashParams.Parallelism))
+	if err != nil {
+		return err
+	}
+	if memory < 1024 || iterations < 1 || parallelism < 1 || parallelism > 255 {
+		return fmt.Errorf("Invalid argon2id parameters: memory %d KiB, iterations %d, parallelism %d", memory, iterations, parallelism)
+	}
+
+	auth.HashParams.Memory = uint32(memory)
+	auth.HashParams.Iterations = uint32(iterations)
+	auth.HashParams.Parallelism = uint8(parallelism)
+	return nil
+}
+
+// External login providers, OIDC_PROVIDERS=google,gitlab and for each of them
+// OIDC_<NAME>_ISSUER, OIDC_<NAME>_CLIENT_ID and OIDC_<NAME>_CLIENT_SECRET
+func loadOIDCProviders() (map[string]*oidc.Provider, error) {
+	providers := map[string]*oidc.Provider{}
+	for _, name := range strings.Split(os.Getenv("OIDC_PROVIDERS"), ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		prefix := "OIDC_" + strings.ToUpper(name) + "_"
+		cfg := oidc.Config{
+			Name:         name,
+			Issuer:       os.Getenv(prefix + "ISSUER"),
+			ClientID:     os.Getenv(prefix + "CLIENT_ID"),
+			ClientSecret: os.Getenv(prefix + "CLIENT_SECRET"),
+		}
+		if cfg.Issuer == "" || cfg.ClientID == "" {
+			return nil, fmt.Errorf("OIDC provider %s needs %sISSUER and %sCLIENT_ID", name, prefix, prefix)
+		}
+		if scopes := os.Getenv(prefix + "SCOPES"); scopes != "" {
+			cfg.Scopes = strings.Fields(scopes)
+		}
+		providers[name] = oidc.NewProvider(cfg)
+	}
+	return providers, nil
+}
+
+// Limits of the HTTP server
+type serverConfig struct {
+	ReadTimeout       time.Duration
+	ReadHeaderTimeout time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+	// Time in-flight requests and background work get to finish on SIGINT or SIGTERM
+	ShutdownTimeout time.Duration
+	// Largest request body, bigger ones are answered with a 413
+	MaxBodyBytes int64
+}
+
+// HTTP_READ_TIMEOUT, HTTP_READ_HEADER_TIMEOUT, HTTP_WRITE_TIMEOUT, HTTP_IDLE_TIMEOUT,
+// SHUTDOWN_TIMEOUT and MAX_BODY_BYTES
+func loadServerConfig() (serverConfig, error) {
+	cfg := serverConfig{}
+	durations := []struct {
+		name     string
+		dst      *time.Duration
+		fallback time.Duration
+	}{
+		{"HTTP_READ_TIMEOUT", &cfg.ReadTimeout, 15 * time.Second},
+		{"HTTP_READ_HEADER_TIMEOUT", &cfg.ReadHeaderTimeout, 5 * time.Second},
+		{"HTTP_WRITE_TIMEOUT", &cfg.WriteTimeout, 30 * time.Second},
+		{"HTTP_IDLE_TIMEOUT", &cfg.IdleTimeout, 2 * time.Minute},
+		{"SHUTDOWN_TIMEOUT", &cfg.ShutdownTimeout, 30 * time.Second},
+	}
+	for _, d := range durations {
+		val, err := envDuration(d.name, d.fallback)
+		if err != nil {
+			return cfg, err
+		}
+		if val <= 0 {
+			return cfg, fmt.Errorf("%s must be positive", d.name)
+		}
+		*d.dst = val
+	}
+
+	maxBody, err := envInt("MAX_BODY_BYTES", 1<<20)
+	if err != nil {
+		return cfg, err
+	}
+	if maxBody < 1 {
+		return cfg, fmt.Errorf("MAX_BODY_BYTES must be positive")
+	}
+	cfg.MaxBodyBytes = int64(maxBody)
+	return cfg, nil
+}
+
+// Connection pool of db, DB_MAX_OPEN_CONNS, DB_MAX_IDLE_CONNS,
+// DB_CONN_MAX_LIFETIME and DB_CONN_MAX_IDLE_TIME
+func configureDBPool(db *sql.DB) error {
+	maxOpen, err := envInt("DB_MAX_OPEN_CONNS", 25)
+	if err != nil {
+		return err
+	}
+	maxIdle, err := envInt("DB_MAX_IDLE_CONNS", 10)
+	if err != nil {
+		return err
+	}
+	// Recycled now and then so connections follow a database failover
+	lifetime, err := envDuration("DB_CONN_MAX_LIFETIME", 30*time.Minute)
+	if err != nil {
+		return err
+	}
+	idleTime, err := envDuration("DB_CONN_MAX_IDLE_TIME", 5*time.Minute)
+	if err != nil {
+		return err
+	}
+	if maxOpen < 1 || maxIdle < 0 || maxIdle > maxOpen || lifetime < 0 || idleTime < 0 {
+		return fmt.Errorf("Invalid database pool: max open %d, max idle %d, max lifetime %s, max idle time %s", maxOpen, maxIdle, lifetime, idleTime)
+	}
+
+	db.SetMaxOpenConns(maxOpen)
+	db.SetMaxIdleConns(maxIdle)
+	db.SetConnMaxLifetime(lifetime)
+	db.SetConnMaxIdleTime(idleTime)
+	return nil
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/google/uuid"
+	"github.com/pauslik/chirpy/internal/database"
+	"github.com/pauslik/chirpy/internal/entitlements"
+)
+
+// Chirpy Red members are on the red plan, everyone else on the free one
+func userPlan(user database.User) string {
+	if user.IsChirpyRed {
+		return entitlements.PlanRed
+	}
+	return entitlements.PlanFree
+}
+
+// The user's plan and grants, resolved into what the user may do
+func (cfg *apiConfig) userEntitlements(ctx context.Context, userID uuid.UUID) (entitlements.Set, error) {
+	user, err := cfg.db.GetUserByID(ctx, userID)
+	if err != nil {
+		return entitlements.Set{}, err
+	}
+	dbGrants, err := cfg.db.GetUserEntitlements(ctx, userID)
+	if err != nil {
+		return entitlements.Set{}, err
+	}
+	return entitlements.Resolve(userPlan(user), toGrants(dbGrants)), nil
+}
+
+func toGrants(dbGrants []database.UserEntitlement) []entitlements.Grant {
+	grants := []entitlements.Grant{}
+	for _, grant := range dbGrants {
+		grants = append(grants, entitlements.Grant{Name: grant.Name, Value: grant.Value})
+	}
+	return grants
+}
+
+// Entitlements of the caller, looked up once per request from the principal
+// middlewareAuth stored in the context. Anonymous callers and API keys get the
+// free plan.
+func (cfg *apiConfig) callerEntitlements(req *http.Request) (entitlements.Set, error) {
+	p := authPrincipal(req)
+	if p == nil || p.Kind == principalAPIKey {
+		return entitlements.ForPlan(entitlements.PlanFree), nil
+	}
+	if p.entitlements != nil {
+		return *p.entitlements, nil
+	}
+
+	set, err := cfg.userEntitlements(req.Context(), p.UserID)
+	if err != nil {
+		return entitlements.Set{}, err
+	}
+	p.entitlements = &set
+	return set, nil
+}
@@ -1,10 +1,22 @@
 package main
 
 import (
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+
+	"github.com/google/uuid"
+	"github.com/pauslik/chirpy/internal/auth"
+	"github.com/pauslik/chirpy/internal/database"
 )
 
+type inputRole struct {
+	Role string `json:"role"`
+}
+
 func (cfg *apiConfig) metricsHandler(w http.ResponseWriter, req *http.Request) {
 	body := fmt.Sprintf(`<html>
   <body>
@@ -15,6 +27,19 @@ func (cfg *apiConfig) metricsHandler(w http.ResponseWriter, req *http.Request) {
 	respondWithHTML(w, 200, body)
 }
 
+// Metrics in the Prometheus text format, behind METRICS_TOKEN when it's set
+func (cfg *apiConfig) prometheusHandler(w http.ResponseWriter, req *http.Request) {
+	if cfg.metricsToken != "" {
+		token, err := auth.GetBearerToken(req.Header)
+		if err != nil || subtle.ConstantTimeCompare([]byte(token), []byte(cfg.metricsToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="metrics"`)
+			respondWithError(w, 401, codeUnauthorized, "Invalid metrics token")
+			return
+		}
+	}
+	cfg.metrics.Handler().ServeHTTP(w, req)
+}
+
 func (cfg *apiConfig) resetHandler(w http.ResponseWriter, req *http.Request) {
 	// Reset page visit stat
 	cfg.fileserverHits.Store(0)
@@ -28,3 +53,94 @@ func (cfg *apiConfig) resetHandler(w http.ResponseWriter, req *http.Request) {
 	body := "OK\n"
 	respondWithText(w, 200, body)
 }
+
+func (cfg *apiConfig) unlockUserHandler(w http.ResponseWriter, req *http.Request) {
+	userID, err := uuid.Parse(req.PathValue("userID"))
+	if err != nil {
+		respondWithInvalidID(w, "user")
+		return
+	}
+
+	dbUser, err := cfg.db.GetUserByID(req.Context(), userID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			respondWithError(w, 404, codeNotFound, "User not found")
+			return
+		}
+		respondWithInternalError(w, "Error fetching user", err)
+		return
+	}
+
+	// Drops the failure count as well as the lock
+	err = cfg.db.ClearLoginThrottle(req.Context(), accountThrottleKey(dbUser.Email))
+	if err != nil {
+		respondWithInternalError(w, "Could not unlock user", err)
+		return
+	}
+
+	respondWithText(w, 204, "")
+}
+
+// Takes effect when the user's access token is next refreshed, within an hour
+func (cfg *apiConfig) setUserRoleHandler(w http.ResponseWriter, req *http.Request) {
+	iRole := inputRole{}
+
+	userID, err := uuid.Parse(req.PathValue("userID"))
+	if err != nil {
+		respondWithInvalidID(w, "user")
+		return
+	}
+
+	decoder := json.NewDecoder(req.Body)
+	err = decoder.Decode(&iRole)
+	if err != nil {
+		respondWithInvalidJSON(w, err)
+		return
+	}
+	if !auth.ValidRole(iRole.Role) {
+		respondWithValidation(w, fieldError{Field: "role", Code: "invalid_role", Detail: fmt.Sprintf("Unknown role %q", iRole.Role)})
+		return
+	}
+
+	dbUser, err := cfg.db.GetUserByID(req.Context(), userID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			respondWithError(w, 404, codeNotFound, "User not found")
+			return
+		}
+		respondWithInternalError(w, "Error fetching user", err)
+		return
+	}
+
+	// Without an admin only the ADMIN_API_KEY or "chirpy create-admin" could recover
+	if dbUser.Role == auth.RoleAdmin && iRole.Role != auth.RoleAdmin {
+		admins, err := cfg.db.CountAdmins(req.Context())
+		if err != nil {
+			respondWithInternalError(w, "Error counting admins", err)
+			return
+		}
+		if admins <= 1 {
+			respondWithError(w, 409, "last_admin", "Can't demote the last admin")
+			return
+		}
+	}
+
+	supr := database.SetUserRoleParams{
+		ID:   userID,
+		Role: iRole.Role,
+	}
+	dbUser, err = cfg.db.SetUserRole(req.Context(), supr)
+	if err != nil {
+		respondWithInternalError(w, "Could not set role", err)
+		return
+	}
+
+	oUser := outputUser{}
+	oUser.ID = dbUser.ID
+	oUser.CreatedAt = dbUser.CreatedAt
+	oUser.UpdatedAt = dbUser.UpdatedAt
+	oUser.Email = dbUser.Email
+	oUser.IsChirpyRed = dbUser.IsChirpyRed
+	oUser.Role = dbUser.Role
+	respondWithJSON(w, 200, oUser)
+}
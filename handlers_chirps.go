@@ -54,41 +54,61 @@ func (cfg *apiConfig) createChirpHandler(w http.ResponseWriter, req *http.Reques
 	decoder := json.NewDecoder(req.Body)
 	err := decoder.Decode(&iChirp)
 	if err != nil {
-		fErr := fmt.Sprintf("Error decoding input: %s", err)
-		respondWithText(w, 500, fErr)
+		respondWithInvalidJSON(w, err)
 		return
 	}
 
-	// Auth
-	token, err := auth.GetBearerToken(req.Header)
+	// Authenticated by middlewareAuth
+	authID := authUserID(req)
+
+	ents, err := cfg.callerEntitlements(req)
 	if err != nil {
-		fErr := fmt.Sprintf("Error getting bearer: %s", err)
-		respondWithText(w, 500, fErr)
+		respondWithInternalError(w, "Error getting entitlements", err)
 		return
 	}
-	authID, err := auth.ValidateJWT(token, cfg.jwt)
-	if err != nil {
-		fErr := fmt.Sprintf("Error validating %s JWT: %s", authID.String(), err)
-		respondWithText(w, 401, fErr)
-		return
+	if ents.ChirpsPerHour > 0 {
+		cucsp := database.CountUserChirpsSinceParams{
+			UserID:    authID,
+			CreatedAt: time.Now().Add(-time.Hour),
+		}
+		recent, err := cfg.db.CountUserChirpsSince(req.Context(), cucsp)
+		if err != nil {
+			respondWithInternalError(w, "Error counting chirps", err)
+			return
+		}
+		if recent >= int64(ents.ChirpsPerHour) {
+			respondWithError(w, 429, codeRateLimited, fmt.Sprintf("Up to %d chirps per hour", ents.ChirpsPerHour))
+			return
+		}
 	}
 
 	// Process Chirp
-	if len(iChirp.Body) > 140 {
-		respondWithText(w, 400, "Chirp is too long")
+	if len(iChirp.Body) > ents.ChirpLength {
+		respondWithValidation(w, fieldError{
+			Field:  "body",
+			Code:   "too_long",
+			Detail: fmt.Sprintf("Chirp is too long, up to %d characters", ents.ChirpLength),
+		})
 		return
 	}
 	iChirp.cleanBody()
 
-	// Create Chirp
+	// Create Chirp, with the webhook deliveries for it
+	tx, err := cfg.sqlDB.BeginTx(req.Context(), nil)
+	if err != nil {
+		respondWithInternalError(w, "Error starting transaction", err)
+		return
+	}
+	defer tx.Rollback()
+	qtx := cfg.withTx(tx)
+
 	ccp := database.CreateChirpParams{
 		Body:   iChirp.Body,
 		UserID: authID,
 	}
-	dbChirp, err := cfg.db.CreateChirp(req.Context(), ccp)
+	dbChirp, err := qtx.CreateChirp(req.Context(), ccp)
 	if err != nil {
-		fErr := fmt.Sprintf("Error creating chirp: %s", err)
-		respondWithText(w, 500, fErr)
+		respondWithInternalError(w, "Error creating chirp", err)
 		return
 	}
 
@@ -98,6 +118,18 @@ func (cfg *apiConfig) createChirpHandler(w http.ResponseWriter, req *http.Reques
 	oChirp.CreatedAt = dbChirp.CreatedAt
 	oChirp.UpdatedAt = dbChirp.UpdatedAt
 
+	err = enqueueWebhookEvent(req.Context(), qtx, eventChirpCreated, uuid.NullUUID{}, oChirp)
+	if err != nil {
+		respondWithInternalError(w, "Error queueing webhooks", err)
+		return
+	}
+	err = tx.Commit()
+	if err != nil {
+		respondWithInternalError(w, "Error saving chirp", err)
+		return
+	}
+	cfg.wakeDeliveryWorker()
+
 	respondWithJSON(w, 201, oChirp)
 }
 
@@ -111,21 +143,18 @@ func (cfg *apiConfig) getChirpsHandler(w http.ResponseWriter, req *http.Request)
 		var err error
 		dbChirps, err = cfg.db.GetChirps(req.Context())
 		if err != nil {
-			fErr := fmt.Sprintf("Error getting chirps: %s", err)
-			respondWithText(w, 500, fErr)
+			respondWithInternalError(w, "Error getting chirps", err)
 			return
 		}
 	} else {
 		userID, err := uuid.Parse(aID)
 		if err != nil {
-			fErr := fmt.Sprintf("Error parsing author_id: %s", err)
-			respondWithText(w, 500, fErr)
+			respondWithInvalidID(w, "author")
 			return
 		}
 		dbChirps, err = cfg.db.GetChirpsUser(req.Context(), userID)
 		if err != nil {
-			fErr := fmt.Sprintf("Error getting chirps: %s", err)
-			respondWithText(w, 500, fErr)
+			respondWithInternalError(w, "Error getting chirps", err)
 			return
 		}
 	}
@@ -155,8 +184,7 @@ func (cfg *apiConfig) getChirpIDHandler(w http.ResponseWriter, req *http.Request
 
 	chirpID, err := uuid.Parse(req.PathValue("chirpID"))
 	if err != nil {
-		fErr := fmt.Sprintf("Not valid Chirp ID: %s", err)
-		respondWithText(w, 500, fErr)
+		respondWithInvalidID(w, "chirp")
 		return
 	}
 
@@ -164,11 +192,10 @@ func (cfg *apiConfig) getChirpIDHandler(w http.ResponseWriter, req *http.Request
 	if err != nil {
 		// Handle not found error
 		if errors.Is(err, sql.ErrNoRows) {
-			respondWithText(w, 404, "Chirp not found")
+			respondWithError(w, 404, codeNotFound, "Chirp not found")
 			return
 		}
-		fErr := fmt.Sprintf("Error getting chirps: %s", err)
-		respondWithText(w, 500, fErr)
+		respondWithInternalError(w, "Error getting chirps", err)
 		return
 	}
 
@@ -182,25 +209,13 @@ func (cfg *apiConfig) getChirpIDHandler(w http.ResponseWriter, req *http.Request
 }
 
 func (cfg *apiConfig) deleteChirpIDHandler(w http.ResponseWriter, req *http.Request) {
-	// Auth
-	token, err := auth.GetBearerToken(req.Header)
-	if err != nil {
-		fErr := fmt.Sprintf("Error getting bearer: %s", err)
-		respondWithText(w, 401, fErr)
-		return
-	}
-	authID, err := auth.ValidateJWT(token, cfg.jwt)
-	if err != nil {
-		fErr := fmt.Sprintf("Error validating %s JWT: %s", authID.String(), err)
-		respondWithText(w, 401, fErr)
-		return
-	}
+	// Authenticated by middlewareAuth
+	authID := authUserID(req)
 
 	// Check and parse Chirp ID
 	chirpID, err := uuid.Parse(req.PathValue("chirpID"))
 	if err != nil {
-		fErr := fmt.Sprintf("Not valid Chirp ID: %s", err)
-		respondWithText(w, 500, fErr)
+		respondWithInvalidID(w, "chirp")
 		return
 	}
 
@@ -209,25 +224,47 @@ func (cfg *apiConfig) deleteChirpIDHandler(w http.ResponseWriter, req *http.Requ
 	if err != nil {
 		// Handle not found error
 		if errors.Is(err, sql.ErrNoRows) {
-			respondWithText(w, 404, "Chirp not found")
+			respondWithError(w, 404, codeNotFound, "Chirp not found")
 			return
 		}
-		fErr := fmt.Sprintf("Error getting chirps: %s", err)
-		respondWithText(w, 500, fErr)
+		respondWithInternalError(w, "Error getting chirps", err)
+		return
+	}
+
+	// Moderators may delete anyone's chirps
+	if authID != dbChirp.UserID && !authPrincipal(req).hasRole(auth.RoleModerator) {
+		respondWithError(w, 403, codeForbidden, "Permission denied")
 		return
 	}
 
-	if authID != dbChirp.UserID {
-		respondWithText(w, 403, "Permission denied")
+	tx, err := cfg.sqlDB.BeginTx(req.Context(), nil)
+	if err != nil {
+		respondWithInternalError(w, "Error starting transaction", err)
 		return
 	}
+	defer tx.Rollback()
+	qtx := cfg.withTx(tx)
 
-	err = cfg.db.DeleteChirp(req.Context(), chirpID)
+	err = qtx.DeleteChirp(req.Context(), chirpID)
+	if err != nil {
+		respondWithInternalError(w, "Delete failed", err)
+		return
+	}
+	ocd := outputChirpDeleted{
+		ID:     dbChirp.ID,
+		UserID: dbChirp.UserID,
+	}
+	err = enqueueWebhookEvent(req.Context(), qtx, eventChirpDeleted, uuid.NullUUID{}, ocd)
+	if err != nil {
+		respondWithInternalError(w, "Error queueing webhooks", err)
+		return
+	}
+	err = tx.Commit()
 	if err != nil {
-		fErr := fmt.Sprintf("Delete failed: %s", err)
-		respondWithText(w, 500, fErr)
+		respondWithInternalError(w, "Delete failed", err)
 		return
 	}
+	cfg.wakeDeliveryWorker()
 
 	respondWithText(w, 204, "Chirp deleted")
 }
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pauslik/chirpy/internal/database"
+	"github.com/pauslik/chirpy/internal/entitlements"
+)
+
+type outputEntitlementSet struct {
+	ChirpLength   int    `json:"chirp_length"`
+	EditWindow    string `json:"edit_window"`
+	MediaPerChirp int    `json:"media_per_chirp"`
+	ChirpsPerHour int    `json:"chirps_per_hour"`
+	Analytics     bool   `json:"analytics"`
+}
+
+type outputEntitlementGrant struct {
+	Name      string     `json:"name"`
+	Value     string     `json:"value"`
+	Reason    string     `json:"reason"`
+	GrantedBy *uuid.UUID `json:"granted_by,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+type outputEntitlements struct {
+	Plan         string                   `json:"plan"`
+	Entitlements outputEntitlementSet     `json:"entitlements"`
+	Grants       []outputEntitlementGrant `json:"grants"`
+}
+
+type inputEntitlementGrant struct {
+	Value  string `json:"value"`
+	Reason string `json:"reason"`
+	// Optional, the grant lasts until revoked otherwise
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+func toOutputEntitlementSet(set entitlements.Set) outputEntitlementSet {
+	oSet := outputEntitlementSet{}
+	oSet.ChirpLength = set.ChirpLength
+	oSet.EditWindow = set.EditWindow.String()
+	oSet.MediaPerChirp = set.MediaPerChirp
+	oSet.ChirpsPerHour = set.ChirpsPerHour
+	oSet.Analytics = set.Analytics
+	return oSet
+}
+
+func toOutputEntitlementGrant(grant database.UserEntitlement) outputEntitlementGrant {
+	oGrant := outputEntitlementGrant{}
+	oGrant.Name = grant.Name
+	oGrant.Value = grant.Value
+	oGrant.Reason = grant.Reason
+	if grant.GrantedBy.Valid {
+		oGrant.GrantedBy = &grant.GrantedBy.UUID
+	}
+	if grant.ExpiresAt.Valid {
+		oGrant.ExpiresAt = &grant.ExpiresAt.Time
+	}
+	oGrant.CreatedAt = grant.CreatedAt
+	return oGrant
+}
+
+// Plan, resolved entitlements and grants of a user, responds itself on failure
+// and with missing when there's no such user
+func (cfg *apiConfig) respondWithEntitlements(w http.ResponseWriter, req *http.Request, userID uuid.UUID, missing *apiError) {
+	oEntitlements := outputEntitlements{}
+
+	dbUser, err := cfg.db.GetUserByID(req.Context(), userID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			respondWithProblem(w, missing)
+			return
+		}
+		respondWithInternalError(w, "Error fetching user", err)
+		return
+	}
+	dbGrants, err := cfg.db.GetUserEntitlements(req.Context(), userID)
+	if err != nil {
+		respondWithInternalError(w, "Error getting entitlements", err)
+		return
+	}
+
+	oEntitlements.Plan = userPlan(dbUser)
+	oEntitlements.Entitlements = toOutputEntitlementSet(entitlements.Resolve(oEntitlements.Plan, toGrants(dbGrants)))
+	oEntitlements.Grants = []outputEntitlementGrant{}
+	for _, grant := range dbGrants {
+		oEntitlements.Grants = append(oEntitlements.Grants, toOutputEntitlementGrant(grant))
+	}
+	respondWithJSON(w, 200, oEntitlements)
+}
+
+// What the caller's plan and grants allow
+func (cfg *apiConfig) getEntitlementsHandler(w http.ResponseWriter, req *http.Request) {
+	// Authenticated by middlewareAuth
+	cfg.respondWithEntitlements(w, req, authUserID(req), &apiError{Status: 401, Code: codeUnauthorized, Detail: "User no longer exists"})
+}
+
+func (cfg *apiConfig) adminGetEntitlementsHandler(w http.ResponseWriter, req *http.Request) {
+	userID, err := uuid.Parse(req.PathValue("userID"))
+	if err != nil {
+		respondWithInvalidID(w, "user")
+		return
+	}
+	cfg.respondWithEntitlements(w, req, userID, &apiError{Status: 404, Code: codeNotFound, Detail: "User not found"})
+}
+
+// Overrides one entitlement of the user's plan, replacing an earlier grant of it
+func (cfg *apiConfig) grantEntitlementHandler(w http.ResponseWriter, req *http.Request) {
+	iGrant := inputEntitlementGrant{}
+
+	userID, err := uuid.Parse(req.PathValue("userID"))
+	if err != nil {
+		respondWithInvalidID(w, "user")
+		return
+	}
+	name := req.PathValue("name")
+
+	// Decoding input
+	decoder := json.NewDecoder(req.Body)
+	err = decoder.Decode(&iGrant)
+	if err != nil {
+		respondWithInvalidJSON(w, err)
+		return
+	}
+
+	var fields []fieldError
+	err = entitlements.Validate(name, iGrant.Value)
+	if errors.Is(err, entitlements.ErrUnknownEntitlement) {
+		respondWithError(w, 400, "unknown_entitlement", fmt.Sprintf("Unknown entitlement %q", name))
+		return
+	}
+	if err != nil {
+		fields = append(fields, fieldError{Field: "value", Code: "invalid_value", Detail: err.Error()})
+	}
+	// Support cases need an explanation for whoever looks at the grant later
+	if iGrant.Reason == "" {
+		fields = append(fields, fieldError{Field: "reason", Code: "required", Detail: "Reason is required"})
+	}
+	if iGrant.ExpiresAt != nil && !iGrant.ExpiresAt.After(time.Now()) {
+		fields = append(fields, fieldError{Field: "expires_at", Code: "not_in_future", Detail: "Expiry must be in the future"})
+	}
+	if len(fields) > 0 {
+		respondWithValidation(w, fields...)
+		return
+	}
+
+	_, err = cfg.db.GetUserByID(req.Context(), userID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			respondWithError(w, 404, codeNotFound, "User not found")
+			return
+		}
+		respondWithInternalError(w, "Error fetching user", err)
+		return
+	}
+
+	guep := database.GrantUserEntitlementParams{
+		UserID: userID,
+		Name:   name,
+		Value:  iGrant.Value,
+		Reason: iGrant.Reason,
+	}
+	// The admin API key has no user to record
+	if p := authPrincipal(req); p != nil && p.Kind == principalUser {
+		guep.GrantedBy = uuid.NullUUID{UUID: p.UserID, Valid: true}
+	}
+	if iGrant.ExpiresAt != nil {
+		guep.ExpiresAt = sql.NullTime{Time: *iGrant.ExpiresAt, Valid: true}
+	}
+	grant, err := cfg.db.GrantUserEntitlement(req.Context(), guep)
+	if err != nil {
+		respondWithInternalError(w, "Could not grant entitlement", err)
+		return
+	}
+
+	respondWithJSON(w, 200, toOutputEntitlementGrant(grant))
+}
+
+// Removes a grant, the user is back to the plan's value
+func (cfg *apiConfig) revokeEntitlementHandler(w http.ResponseWriter, req *http.Request) {
+	userID, err := uuid.Parse(req.PathValue("userID"))
+	if err != nil {
+		respondWithInvalidID(w, "user")
+		return
+	}
+
+	ruep := database.RevokeUserEntitlementParams{
+		UserID: userID,
+		Name:   req.PathValue("name"),
+	}
+	revoked, err := cfg.db.RevokeUserEntitlement(req.Context(), ruep)
+	if err != nil {
+		respondWithInternalError(w, "Could not revoke entitlement", err)
+		return
+	}
+	if revoked == 0 {
+		respondWithError(w, 404, codeNotFound, "Grant not found")
+		return
+	}
+
+	respondWithText(w, 204, "")
+}
@@ -0,0 +1,11 @@
+package main
+
+import (
+	"net/http"
+)
+
+func (cfg *apiConfig) jwksHandler(w http.ResponseWriter, req *http.Request) {
+	// Short enough that a rotated key is picked up before it starts signing
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	respondWithJSON(w, 200, cfg.jwt.JWKS())
+}
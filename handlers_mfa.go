@@ -0,0 +1,364 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pauslik/chirpy/internal/auth"
+	"github.com/pauslik/chirpy/internal/database"
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+const (
+	totpIssuer        = "Chirpy"
+	recoveryCodeCount = 10
+)
+
+type inputCurrentPassword struct {
+	CurrentPassword string `json:"current_password"`
+}
+
+type inputTOTPCode struct {
+	Code string `json:"code"`
+}
+
+type inputMFALogin struct {
+	MFAToken     string `json:"mfa_token"`
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recovery_code"`
+}
+
+type outputTOTPEnrollment struct {
+	Secret string `json:"secret"`
+	URI    string `json:"otpauth_uri"`
+}
+
+type outputRecoveryCodes struct {
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+type outputMFAChallenge struct {
+	MFARequired bool   `json:"mfa_required"`
+	MFAToken    string `json:"mfa_token"`
+}
+
+// Only confirmed credentials count, a pending enrollment doesn't change the login
+func (cfg *apiConfig) totpEnabled(ctx context.Context, userID uuid.UUID) (bool, error) {
+	cred, err := cfg.db.GetTotpCredential(ctx, userID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return false, nil
+		}
+		return false, err
+	}
+	return cred.ConfirmedAt.Valid, nil
+}
+
+func (cfg *apiConfig) enrollTOTPHandler(w http.ResponseWriter, req *http.Request) {
+	iPass := inputCurrentPassword{}
+	// Authenticated by middlewareAuth
+	authID := authUserID(req)
+
+	// Decoding input
+	decoder := json.NewDecoder(req.Body)
+	err := decoder.Decode(&iPass)
+	if err != nil {
+		respondWithInvalidJSON(w, err)
+		return
+	}
+	dbUser, ok := cfg.reauthenticate(w, req, authID, iPass.CurrentPassword)
+	if !ok {
+		return
+	}
+
+	enabled, err := cfg.totpEnabled(req.Context(), dbUser.ID)
+	if err != nil {
+		respondWithInternalError(w, "Error checking two-factor authentication", err)
+		return
+	}
+	if enabled {
+		respondWithError(w, 409, "mfa_enabled", "Two-factor authentication is already enabled")
+		return
+	}
+
+	// A new enrollment replaces any earlier one that was never confirmed
+	secret, err := auth.MakeTOTPSecret()
+	if err != nil {
+		respondWithInternalError(w, "Could not generate TOTP secret", err)
+		return
+	}
+	utcp := database.UpsertTotpCredentialParams{
+		UserID: dbUser.ID,
+		Secret: secret,
+	}
+	_, err = cfg.db.UpsertTotpCredential(req.Context(), utcp)
+	if err != nil {
+		respondWithInternalError(w, "Could not save TOTP secret", err)
+		return
+	}
+
+	oEnroll := outputTOTPEnrollment{
+		Secret: secret,
+		URI:    auth.TOTPURI(totpIssuer, dbUser.Email, secret),
+	}
+	respondWithJSON(w, 201, oEnroll)
+}
+
+func (cfg *apiConfig) totpQRHandler(w http.ResponseWriter, req *http.Request) {
+	// Authenticated by middlewareAuth
+	authID := authUserID(req)
+
+	dbUser, err := cfg.db.GetUserByID(req.Context(), authID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			respondWithError(w, 404, codeNotFound, "User not found")
+			return
+		}
+		respondWithInternalError(w, "Error fetching user", err)
+		return
+	}
+	// The secret of a confirmed credential is never shown again
+	cred, err := cfg.db.GetTotpCredential(req.Context(), authID)
+	if err != nil || cred.ConfirmedAt.Valid {
+		respondWithError(w, 404, codeNotFound, "No pending two-factor enrollment")
+		return
+	}
+
+	png, err := qrcode.Encode(auth.TOTPURI(totpIssuer, dbUser.Email, cred.Secret), qrcode.Medium, 256)
+	if err != nil {
+		respondWithInternalError(w, "Could not render QR code", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(200)
+	w.Write(png)
+}
+
+func (cfg *apiConfig) confirmTOTPHandler(w http.ResponseWriter, req *http.Request) {
+	iCode := inputTOTPCode{}
+	// Authenticated by middlewareAuth
+	authID := authUserID(req)
+
+	// Decoding input
+	decoder := json.NewDecoder(req.Body)
+	err := decoder.Decode(&iCode)
+	if err != nil {
+		respondWithInvalidJSON(w, err)
+		return
+	}
+
+	cred, err := cfg.db.GetTotpCredential(req.Context(), authID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			respondWithError(w, 404, codeNotFound, "No pending two-factor enrollment")
+			return
+		}
+		respondWithInternalError(w, "Error fetching TOTP credential", err)
+		return
+	}
+	if cred.ConfirmedAt.Valid {
+		respondWithError(w, 409, "mfa_enabled", "Two-factor authentication is already enabled")
+		return
+	}
+
+	step, ok := auth.ValidateTOTP(cred.Secret, iCode.Code, time.Now())
+	if !ok {
+		respondWithError(w, 400, "invalid_code", "Invalid code")
+		return
+	}
+
+	codes, err := auth.MakeRecoveryCodes(recoveryCodeCount)
+	if err != nil {
+		respondWithInternalError(w, "Could not generate recovery codes", err)
+		return
+	}
+
+	tx, err := cfg.sqlDB.BeginTx(req.Context(), nil)
+	if err != nil {
+		respondWithInternalError(w, "Could not start transaction", err)
+		return
+	}
+	defer tx.Rollback()
+	qtx := cfg.withTx(tx)
+
+	utsp := database.UseTotpStepParams{
+		UserID:       authID,
+		LastUsedStep: step,
+	}
+	_, err = qtx.UseTotpStep(req.Context(), utsp)
+	if err != nil {
+		respondWithInternalError(w, "Could not save TOTP step", err)
+		return
+	}
+	err = qtx.ConfirmTotpCredential(req.Context(), authID)
+	if err != nil {
+		respondWithInternalError(w, "Could not confirm TOTP credential", err)
+		return
+	}
+
+	// Recovery codes are shown once and only their hashes are kept
+	err = qtx.DeleteRecoveryCodes(req.Context(), authID)
+	if err != nil {
+		respondWithInternalError(w, "Could not delete old recovery codes", err)
+		return
+	}
+	for _, code := range codes {
+		crcp := database.CreateRecoveryCodeParams{
+			UserID:   authID,
+			CodeHash: auth.HashToken(code),
+		}
+		err = qtx.CreateRecoveryCode(req.Context(), crcp)
+		if err != nil {
+			respondWithInternalError(w, "Could not save recovery code", err)
+			return
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		respondWithInternalError(w, "Could not commit two-factor enrollment", err)
+		return
+	}
+
+	respondWithJSON(w, 200, outputRecoveryCodes{RecoveryCodes: codes})
+}
+
+func (cfg *apiConfig) disableTOTPHandler(w http.ResponseWriter, req *http.Request) {
+	iPass := inputCurrentPassword{}
+	// Authenticated by middlewareAuth
+	authID := authUserID(req)
+
+	// Decoding input
+	decoder := json.NewDecoder(req.Body)
+	err := decoder.Decode(&iPass)
+	if err != nil {
+		respondWithInvalidJSON(w, err)
+		return
+	}
+	_, ok := cfg.reauthenticate(w, req, authID, iPass.CurrentPassword)
+	if !ok {
+		return
+	}
+
+	tx, err := cfg.sqlDB.BeginTx(req.Context(), nil)
+	if err != nil {
+		respondWithInternalError(w, "Could not start transaction", err)
+		return
+	}
+	defer tx.Rollback()
+	qtx := cfg.withTx(tx)
+
+	err = qtx.DeleteTotpCredential(req.Context(), authID)
+	if err != nil {
+		respondWithInternalError(w, "Could not delete TOTP credential", err)
+		return
+	}
+	err = qtx.DeleteRecoveryCodes(req.Context(), authID)
+	if err != nil {
+		respondWithInternalError(w, "Could not delete recovery codes", err)
+		return
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		respondWithInternalError(w, "Could not commit", err)
+		return
+	}
+
+	respondWithText(w, 204, "")
+}
+
+// Second step of the login, trades the MFA challenge token and a code for the usual tokens
+func (cfg *apiConfig) mfaLoginHandler(w http.ResponseWriter, req *http.Request) {
+	iLogin := inputMFALogin{}
+	// Decoding input
+	decoder := json.NewDecoder(req.Body)
+	err := decoder.Decode(&iLogin)
+	if err != nil {
+		respondWithInvalidJSON(w, err)
+		return
+	}
+
+	userID, err := auth.ValidateMFAToken(iLogin.MFAToken, cfg.jwt, cfg.tokenPolicy)
+	if err != nil {
+		respondWithProblem(w, &apiError{Status: 401, Code: "invalid_mfa_token", Detail: "MFA token is invalid or expired", Err: err})
+		return
+	}
+	dbUser, err := cfg.db.GetUserByID(req.Context(), userID)
+	if err != nil {
+		respondWithInternalError(w, "Error fetching user", err)
+		return
+	}
+
+	// Codes are short, so wrong ones count towards the same lockout as wrong passwords
+	wait, err := cfg.loginRetryAfter(req.Context(), accountThrottleKey(dbUser.Email), ipThrottleKey(req))
+	if err != nil {
+		respondWithInternalError(w, "Error checking login attempts", err)
+		return
+	}
+	if wait > 0 {
+		respondWithRetryAfter(w, wait)
+		return
+	}
+
+	valid, err := cfg.checkSecondFactor(req.Context(), userID, iLogin.Code, iLogin.RecoveryCode)
+	if err != nil {
+		respondWithInternalError(w, "Error checking code", err)
+		return
+	}
+	if !valid {
+		cfg.loginFailed(w, req, dbUser.Email, &dbUser)
+		return
+	}
+
+	cfg.completeLogin(w, req, dbUser)
+}
+
+// Checks a TOTP code, or a recovery code when one is given. Either only works once.
+func (cfg *apiConfig) checkSecondFactor(ctx context.Context, userID uuid.UUID, code, recoveryCode string) (bool, error) {
+	if recoveryCode != "" {
+		urcp := database.UseRecoveryCodeParams{
+			UserID:   userID,
+			CodeHash: auth.HashToken(auth.NormalizeRecoveryCode(recoveryCode)),
+		}
+		used, err := cfg.db.UseRecoveryCode(ctx, urcp)
+		if err != nil {
+			return false, err
+		}
+		return used == 1, nil
+	}
+
+	// 2FA may have been disabled, or disabled and enrolled again without
+	// confirming, since the MFA token was issued. The caller logs in again.
+	cred, err := cfg.db.GetTotpCredential(ctx, userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if !cred.ConfirmedAt.Valid {
+		return false, nil
+	}
+	step, ok := auth.ValidateTOTP(cred.Secret, code, time.Now())
+	if !ok {
+		return false, nil
+	}
+	// Fails if this or a later code was already used, so a code only works once
+	utsp := database.UseTotpStepParams{
+		UserID:       userID,
+		LastUsedStep: step,
+	}
+	updated, err := cfg.db.UseTotpStep(ctx, utsp)
+	if err != nil {
+		return false, err
+	}
+	return updated == 1, nil
+}
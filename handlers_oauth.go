@@ -0,0 +1,609 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"errors"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pauslik/chirpy/internal/auth"
+	"github.com/pauslik/chirpy/internal/database"
+)
+
+// Chirpy as an OAuth 2.0 authorization server (RFC 6749) for third-party apps:
+// authorization code grant with mandatory PKCE, refresh tokens, revocation
+// (RFC 7009) and introspection (RFC 7662)
+
+const oauthCodeTTL = 5 * time.Minute
+
+// What each scope lets an app do, shown on the consent page
+var scopeDescriptions = map[string]string{
+	auth.ScopeChirpsWrite: "Post and delete chirps as you",
+	auth.ScopeProfileRead: "See your email address and account details",
+}
+
+// RFC 6749 section 5.2 error response
+type oauthError struct {
+	Code        string `json:"error"`
+	Description string `json:"error_description,omitempty"`
+}
+
+func respondWithOauthError(w http.ResponseWriter, code int, errCode, description string) {
+	if errCode == "invalid_client" {
+		w.Header().Set("WWW-Authenticate", `Basic realm="chirpy"`)
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	respondWithJSON(w, code, oauthError{Code: errCode, Description: description})
+}
+
+// invalid_client for apiErrors of authenticateClient, anything else is a
+// database error and not the client's business
+func respondWithClientAuthError(w http.ResponseWriter, err error) {
+	var aErr *apiError
+	if errors.As(err, &aErr) {
+		respondWithOauthError(w, aErr.Status, aErr.Code, aErr.Detail)
+		return
+	}
+	slog.Error("Could not authenticate client", "request_id", w.Header().Get(requestIDHeader), "error", err)
+	respondWithOauthError(w, 500, "server_error", "")
+}
+
+// Authorization requests
+
+type authorizeRequest struct {
+	Client        database.OauthClient
+	RedirectURI   string
+	State         string
+	CodeChallenge string
+	Scopes        []string
+}
+
+// Error that is sent back to the app on its redirect URI
+type authorizeError struct {
+	code        string
+	description string
+}
+
+func (e *authorizeError) Error() string {
+	return e.code + ": " + e.description
+}
+
+// Validates the parameters of GET and POST /oauth/authorize. Until the client and
+// redirect URI are known to be good, errors are shown to the user instead of
+// redirected, so nobody can use Chirpy to bounce users to an arbitrary URL.
+func (cfg *apiConfig) parseAuthorizeRequest(ctx context.Context, form url.Values) (authorizeRequest, error) {
+	ar := authorizeRequest{
+		RedirectURI:   form.Get("redirect_uri"),
+		State:         form.Get("state"),
+		CodeChallenge: form.Get("code_challenge"),
+	}
+
+	clientID, err := uuid.Parse(form.Get("client_id"))
+	if err != nil {
+		return ar, &apiError{Status: 400, Code: "invalid_client", Detail: "Unknown client"}
+	}
+	ar.Client, err = cfg.db.GetOauthClient(ctx, clientID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ar, &apiError{Status: 400, Code: "invalid_client", Detail: "Unknown client"}
+		}
+		return ar, err
+	}
+	// Exact match only, no prefix or pattern matching
+	if !slices.Contains(ar.Client.RedirectUris, ar.RedirectURI) {
+		return ar, &apiError{Status: 400, Code: "invalid_redirect_uri", Detail: "Redirect URI is not registered for this client"}
+	}
+
+	if form.Get("response_type") != "code" {
+		return ar, &authorizeError{"unsupported_response_type", "Only the code response type is supported"}
+	}
+	if ar.CodeChallenge == "" || form.Get("code_challenge_method") != auth.PKCEMethodS256 {
+		return ar, &authorizeError{"invalid_request", "PKCE with code_challenge_method S256 is required"}
+	}
+
+	ar.Scopes = strings.Fields(form.Get("scope"))
+	if len(ar.Scopes) == 0 {
+		ar.Scopes = ar.Client.Scopes
+	}
+	for _, scope := range ar.Scopes {
+		if !slices.Contains(ar.Client.Scopes, scope) {
+			return ar, &authorizeError{"invalid_scope", fmt.Sprintf("Scope %q is not allowed for this client", scope)}
+		}
+	}
+	return ar, nil
+}
+
+// Sends the user back to the app with either code or the error in the query
+func redirectToClient(w http.ResponseWriter, req *http.Request, ar authorizeRequest, params url.Values) {
+	u, _ := url.Parse(ar.RedirectURI)
+	q := u.Query()
+	for key, values := range params {
+		q[key] = values
+	}
+	if ar.State != "" {
+		q.Set("state", ar.State)
+	}
+	u.RawQuery = q.Encode()
+	http.Redirect(w, req, u.String(), http.StatusSeeOther)
+}
+
+var consentPage = template.Must(template.New("consent").Parse(`<html>
+  <body>
+    <h1>Authorize {{.Client.Name}}</h1>
+    <p><b>{{.Client.Name}}</b> wants to access your Chirpy account. It will be able to:</p>
+    <ul>
+      {{range .Scopes}}<li>{{.}}</li>{{end}}
+    </ul>
+    {{if .Error}}<p style="color: red">{{.Error}}</p>{{end}}
+    <form method="POST" action="/oauth/authorize">
+      {{range $key, $values := .Params}}{{range $values}}<input type="hidden" name="{{$key}}" value="{{.}}">{{end}}{{end}}
+      <p><label>Email <input type="email" name="email" value="{{.Email}}" required></label></p>
+      <p><label>Password <input type="password" name="password"></label></p>
+      <p><label>Two-factor or recovery code, if enabled <input type="text" name="code" autocomplete="one-time-code"></label></p>
+      <button type="submit" name="decision" value="approve">Allow</button>
+      <button type="submit" name="decision" value="deny" formnovalidate>Deny</button>
+    </form>
+    <p>You will be sent back to {{.RedirectURI}}</p>
+  </body>
+</html>`))
+
+type consentData struct {
+	Client      database.OauthClient
+	Scopes      []string
+	Params      url.Values
+	RedirectURI string
+	Email       string
+	Error       string
+}
+
+func renderConsent(w http.ResponseWriter, code int, ar authorizeRequest, form url.Values, errMsg string) {
+	data := consentData{
+		Client:      ar.Client,
+		Params:      url.Values{},
+		RedirectURI: ar.RedirectURI,
+		Email:       form.Get("email"),
+		Error:       errMsg,
+	}
+	for _, scope := range ar.Scopes {
+		data.Scopes = append(data.Scopes, scopeDescriptions[scope])
+	}
+	// The authorization request travels with the form
+	for _, key := range []string{"response_type", "client_id", "redirect_uri", "scope", "state", "code_challenge", "code_challenge_method"} {
+		if form.Has(key) {
+			data.Params[key] = form[key]
+		}
+	}
+
+	// The page takes a password, it must not be framed by another site
+	w.Header().Set("X-Frame-Options", "DENY")
+	w.Header().Set("Content-Security-Policy", "frame-ancestors 'none'")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(code)
+	consentPage.Execute(w, data)
+}
+
+func (cfg *apiConfig) authorizeHandler(w http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	ar, err := cfg.parseAuthorizeRequest(req.Context(), query)
+	if err != nil {
+		cfg.authorizeFailed(w, req, ar, err)
+		return
+	}
+	renderConsent(w, 200, ar, query, "")
+}
+
+// The user signs in on the consent page itself, so the app never sees the password
+func (cfg *apiConfig) authorizeDecisionHandler(w http.ResponseWriter, req *http.Request) {
+	err := req.ParseForm()
+	if err != nil {
+		respondWithBodyError(w, err)
+		return
+	}
+	form := req.PostForm
+	ar, err := cfg.parseAuthorizeRequest(req.Context(), form)
+	if err != nil {
+		cfg.authorizeFailed(w, req, ar, err)
+		return
+	}
+
+	if form.Get("decision") != "approve" {
+		redirectToClient(w, req, ar, url.Values{"error": {"access_denied"}})
+		return
+	}
+
+	email := form.Get("email")
+	wait, err := cfg.loginRetryAfter(req.Context(), accountThrottleKey(email), ipThrottleKey(req))
+	if err != nil {
+		respondWithInternalError(w, "Error checking login attempts", err)
+		return
+	}
+	if wait > 0 {
+		renderConsent(w, 429, ar, form, fmt.Sprintf("Too many failed login attempts, try again in %d seconds", int(wait.Seconds())+1))
+		return
+	}
+
+	dbUser, ok, err := cfg.checkConsentLogin(req, email, form.Get("password"), form.Get("code"))
+	if err != nil {
+		respondWithInternalError(w, "Error checking login", err)
+		return
+	}
+	if !ok {
+		renderConsent(w, 401, ar, form, "Incorrect email, password or code")
+		return
+	}
+
+	code, err := auth.MakeOpaqueToken()
+	if err != nil {
+		respondWithInternalError(w, "Could not create code", err)
+		return
+	}
+	coacp := database.CreateOauthAuthorizationCodeParams{
+		CodeHash:      auth.HashToken(code),
+		ClientID:      ar.Client.ID,
+		UserID:        dbUser.ID,
+		RedirectUri:   ar.RedirectURI,
+		Scopes:        ar.Scopes,
+		CodeChallenge: ar.CodeChallenge,
+		ExpiresAt:     time.Now().Add(oauthCodeTTL),
+	}
+	err = cfg.db.CreateOauthAuthorizationCode(req.Context(), coacp)
+	if err != nil {
+		respondWithInternalError(w, "Could not store code", err)
+		return
+	}
+
+	redirectToClient(w, req, ar, url.Values{"code": {code}})
+}
+
+func (cfg *apiConfig) authorizeFailed(w http.ResponseWriter, req *http.Request, ar authorizeRequest, err error) {
+	var aErr *authorizeError
+	if errors.As(err, &aErr) {
+		redirectToClient(w, req, ar, url.Values{"error": {aErr.code}, "error_description": {aErr.description}})
+		return
+	}
+	// Bad client or redirect URI, or a database error
+	respondWithProblem(w, err)
+}
+
+// Password and, when enabled, the second factor; failures count like failed logins.
+// The code is a TOTP code if it's all digits, a recovery code otherwise.
+func (cfg *apiConfig) checkConsentLogin(req *http.Request, email, password, code string) (database.User, bool, error) {
+	dbUser, err := cfg.db.GetUser(req.Context(), email)
+	if errors.Is(err, sql.ErrNoRows) {
+		return database.User{}, false, cfg.recordFailedLogin(req, email, nil)
+	}
+	if err != nil {
+		return database.User{}, false, err
+	}
+
+	correct, err := auth.CheckPasswordHash(password, dbUser.HashedPassword)
+	if err != nil {
+		return database.User{}, false, err
+	}
+	if correct {
+		mfaEnabled, err := cfg.totpEnabled(req.Context(), dbUser.ID)
+		if err != nil {
+			return database.User{}, false, err
+		}
+		if mfaEnabled {
+			totpCode, recoveryCode := code, ""
+			if strings.Trim(code, "0123456789") != "" {
+				totpCode, recoveryCode = "", code
+			}
+			correct, err = cfg.checkSecondFactor(req.Context(), dbUser.ID, totpCode, recoveryCode)
+			if err != nil {
+				return database.User{}, false, err
+			}
+		}
+	}
+	if !correct {
+		return database.User{}, false, cfg.recordFailedLogin(req, email, &dbUser)
+	}
+
+	err = cfg.db.ClearLoginThrottle(req.Context(), accountThrottleKey(dbUser.Email))
+	if err != nil {
+		return database.User{}, false, err
+	}
+	return dbUser, true, nil
+}
+
+// Client authentication
+
+// Confidential clients send client_id and client_secret with HTTP Basic (or
+// in the form), public clients only their client_id. A bad client is an
+// apiError, see respondWithClientAuthError.
+func (cfg *apiConfig) authenticateClient(req *http.Request) (database.OauthClient, error) {
+	id, secret, ok := req.BasicAuth()
+	if ok {
+		// RFC 6749 section 2.3.1 form-encodes both before Basic encoding
+		id, _ = url.QueryUnescape(id)
+		secret, _ = url.QueryUnescape(secret)
+	} else {
+		id = req.PostForm.Get("client_id")
+		secret = req.PostForm.Get("client_secret")
+	}
+
+	clientID, err := uuid.Parse(id)
+	if err != nil {
+		return database.OauthClient{}, &apiError{Status: 401, Code: "invalid_client", Detail: "Unknown client"}
+	}
+	client, err := cfg.db.GetOauthClient(req.Context(), clientID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return database.OauthClient{}, &apiError{Status: 401, Code: "invalid_client", Detail: "Unknown client"}
+		}
+		return database.OauthClient{}, err
+	}
+
+	if client.SecretHash.Valid && subtle.ConstantTimeCompare([]byte(auth.HashToken(secret)), []byte(client.SecretHash.String)) != 1 {
+		return database.OauthClient{}, &apiError{Status: 401, Code: "invalid_client", Detail: "Wrong client secret"}
+	}
+	return client, nil
+}
+
+// Token endpoint
+
+// Public apps can get shorter lifetimes, a leaked refresh token of theirs works without a secret
+func clientType(client database.OauthClient) auth.ClientType {
+	if client.SecretHash.Valid {
+		return auth.ClientConfidential
+	}
+	return auth.ClientPublic
+}
+
+type outputOauthToken struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"`
+	RefreshToken string `json:"refresh_token"`
+	Scope        string `json:"scope"`
+}
+
+func (cfg *apiConfig) oauthTokenHandler(w http.ResponseWriter, req *http.Request) {
+	err := req.ParseForm()
+	if err != nil {
+		respondWithOauthError(w, 400, "invalid_request", "Invalid form")
+		return
+	}
+	client, err := cfg.authenticateClient(req)
+	if err != nil {
+		respondWithClientAuthError(w, err)
+		return
+	}
+
+	tx, err := cfg.sqlDB.BeginTx(req.Context(), nil)
+	if err != nil {
+		respondWithOauthError(w, 500, "server_error", "")
+		return
+	}
+	defer tx.Rollback()
+	qtx := cfg.withTx(tx)
+
+	var userID uuid.UUID
+	var scopes []string
+	switch req.PostForm.Get("grant_type") {
+	case "authorization_code":
+		coacp := database.ConsumeOauthAuthorizationCodeParams{
+			CodeHash: auth.HashToken(req.PostForm.Get("code")),
+			ClientID: client.ID,
+		}
+		grant, err := qtx.ConsumeOauthAuthorizationCode(req.Context(), coacp)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				respondWithOauthError(w, 400, "invalid_grant", "Code is invalid, expired or already used")
+				return
+			}
+			respondWithOauthError(w, 500, "server_error", "")
+			return
+		}
+		if grant.RedirectUri != req.PostForm.Get("redirect_uri") {
+			respondWithOauthError(w, 400, "invalid_grant", "Redirect URI doesn't match the authorization request")
+			return
+		}
+		if !auth.VerifyPKCE(req.PostForm.Get("code_verifier"), grant.CodeChallenge) {
+			respondWithOauthError(w, 400, "invalid_grant", "PKCE verification failed")
+			return
+		}
+		userID = grant.UserID
+		scopes = grant.Scopes
+
+	case "refresh_token":
+		// Rotated like first-party refresh tokens, each one works once
+		uortp := database.UseOauthRefreshTokenParams{
+			TokenHash: auth.HashToken(req.PostForm.Get("refresh_token")),
+			ClientID:  client.ID,
+		}
+		previous, err := qtx.UseOauthRefreshToken(req.Context(), uortp)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				respondWithOauthError(w, 400, "invalid_grant", "Refresh token is invalid, expired or revoked")
+				return
+			}
+			respondWithOauthError(w, 500, "server_error", "")
+			return
+		}
+		userID = previous.UserID
+		scopes = previous.Scopes
+		// An app may ask for fewer scopes than it was granted, never more
+		if requested := strings.Fields(req.PostForm.Get("scope")); len(requested) > 0 {
+			for _, scope := range requested {
+				if !slices.Contains(previous.Scopes, scope) {
+					respondWithOauthError(w, 400, "invalid_scope", fmt.Sprintf("Scope %q was not granted", scope))
+					return
+				}
+			}
+			scopes = requested
+		}
+
+	default:
+		respondWithOauthError(w, 400, "unsupported_grant_type", "Use authorization_code or refresh_token")
+		return
+	}
+
+	refreshToken, err := auth.MakeOpaqueToken()
+	if err != nil {
+		respondWithOauthError(w, 500, "server_error", "")
+		return
+	}
+	accessToken, access, err := auth.MakeClientJWT(userID, client.ID.String(), clientType(client), scopes, cfg.jwt, cfg.tokenPolicy)
+	if err != nil {
+		respondWithOauthError(w, 500, "server_error", "")
+		return
+	}
+	// The access token's ID goes with the refresh token, so the user can revoke both
+	cortp := database.CreateOauthRefreshTokenParams{
+		TokenHash:       auth.HashToken(refreshToken),
+		ClientID:        client.ID,
+		UserID:          userID,
+		Scopes:          scopes,
+		ExpiresAt:       time.Now().Add(cfg.tokenPolicy.Lifetime(clientType(client)).Refresh),
+		AccessJti:       access.ID,
+		AccessExpiresAt: access.ExpiresAt,
+	}
+	err = qtx.CreateOauthRefreshToken(req.Context(), cortp)
+	if err != nil {
+		respondWithOauthError(w, 500, "server_error", "")
+		return
+	}
+	err = tx.Commit()
+	if err != nil {
+		respondWithOauthError(w, 500, "server_error", "")
+		return
+	}
+
+	oToken := outputOauthToken{}
+	oToken.AccessToken = accessToken
+	oToken.TokenType = "Bearer"
+	oToken.ExpiresIn = int(time.Until(access.ExpiresAt).Seconds())
+	oToken.RefreshToken = refreshToken
+	oToken.Scope = strings.Join(scopes, " ")
+
+	w.Header().Set("Cache-Control", "no-store")
+	respondWithJSON(w, 200, oToken)
+}
+
+// Revocation (RFC 7009)
+
+// Always answers 200, unknown tokens and tokens of other clients included, so
+// the endpoint can't be used to probe for valid tokens
+func (cfg *apiConfig) oauthRevokeHandler(w http.ResponseWriter, req *http.Request) {
+	err := req.ParseForm()
+	if err != nil {
+		respondWithOauthError(w, 400, "invalid_request", "Invalid form")
+		return
+	}
+	client, err := cfg.authenticateClient(req)
+	if err != nil {
+		respondWithClientAuthError(w, err)
+		return
+	}
+	token := req.PostForm.Get("token")
+
+	rortp := database.RevokeOauthRefreshTokenParams{
+		TokenHash: auth.HashToken(token),
+		ClientID:  client.ID,
+	}
+	revoked, err := cfg.db.RevokeOauthRefreshToken(req.Context(), rortp)
+	if err != nil {
+		respondWithOauthError(w, 500, "server_error", "")
+		return
+	}
+
+	if revoked == 0 {
+		access, err := auth.ValidateAccessToken(token, cfg.jwt, cfg.tokenPolicy)
+		if err == nil && access.ClientID == client.ID.String() {
+			// Rows of tokens that expired on their own aren't needed anymore,
+			// validation still takes them within the leeway
+			cfg.db.DeleteExpiredOauthRevocations(req.Context(), time.Now().Add(-cfg.tokenPolicy.Leeway))
+			roatp := database.RevokeOauthAccessTokenParams{
+				Jti:       access.ID,
+				ExpiresAt: access.ExpiresAt,
+			}
+			err = cfg.db.RevokeOauthAccessToken(req.Context(), roatp)
+			if err != nil {
+				respondWithOauthError(w, 500, "server_error", "")
+				return
+			}
+		}
+	}
+
+	w.WriteHeader(200)
+}
+
+// Introspection (RFC 7662)
+
+type outputIntrospection struct {
+	Active    bool   `json:"active"`
+	Scope     string `json:"scope,omitempty"`
+	ClientID  string `json:"client_id,omitempty"`
+	Subject   string `json:"sub,omitempty"`
+	TokenType string `json:"token_type,omitempty"`
+	ExpiresAt int64  `json:"exp,omitempty"`
+	IssuedAt  int64  `json:"iat,omitempty"`
+}
+
+// A client can only introspect its own tokens, anything else is reported inactive
+func (cfg *apiConfig) oauthIntrospectHandler(w http.ResponseWriter, req *http.Request) {
+	err := req.ParseForm()
+	if err != nil {
+		respondWithOauthError(w, 400, "invalid_request", "Invalid form")
+		return
+	}
+	client, err := cfg.authenticateClient(req)
+	if err != nil {
+		respondWithClientAuthError(w, err)
+		return
+	}
+	token := req.PostForm.Get("token")
+	oIntro := outputIntrospection{}
+	w.Header().Set("Cache-Control", "no-store")
+
+	refresh, err := cfg.db.GetOauthRefreshToken(req.Context(), auth.HashToken(token))
+	if err == nil {
+		if refresh.ClientID == client.ID {
+			oIntro.Active = true
+			oIntro.Scope = strings.Join(refresh.Scopes, " ")
+			oIntro.ClientID = refresh.ClientID.String()
+			oIntro.Subject = refresh.UserID.String()
+			oIntro.ExpiresAt = refresh.ExpiresAt.Unix()
+			oIntro.IssuedAt = refresh.CreatedAt.Unix()
+		}
+		respondWithJSON(w, 200, oIntro)
+		return
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		respondWithOauthError(w, 500, "server_error", "")
+		return
+	}
+
+	access, err := auth.ValidateAccessToken(token, cfg.jwt, cfg.tokenPolicy)
+	if err != nil || access.ClientID != client.ID.String() {
+		respondWithJSON(w, 200, oIntro)
+		return
+	}
+	revoked, err := cfg.db.IsOauthAccessTokenRevoked(req.Context(), access.ID)
+	if err != nil {
+		respondWithOauthError(w, 500, "server_error", "")
+		return
+	}
+	if !revoked {
+		oIntro.Active = true
+		oIntro.Scope = strings.Join(access.Scopes, " ")
+		oIntro.ClientID = access.ClientID
+		oIntro.Subject = access.UserID.String()
+		oIntro.TokenType = "Bearer"
+		oIntro.ExpiresAt = access.ExpiresAt.Unix()
+		oIntro.IssuedAt = access.IssuedAt.Unix()
+	}
+	respondWithJSON(w, 200, oIntro)
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pauslik/chirpy/internal/database"
+)
+
+// An app the user has given access to their account
+type outputOauthAuthorization struct {
+	ClientID uuid.UUID `json:"client_id"`
+	Name     string    `json:"name"`
+	Scopes   []string  `json:"scopes"`
+	// Refresh tokens rotate on use, so the newest one was issued on the last refresh
+	LastUsedAt time.Time `json:"last_used_at"`
+}
+
+func (cfg *apiConfig) getOauthAuthorizationsHandler(w http.ResponseWriter, req *http.Request) {
+	authorizations := []outputOauthAuthorization{}
+	// Authenticated by middlewareAuth
+	authID := authUserID(req)
+
+	// An app is authorized as long as it holds a live refresh token
+	dbAuthorizations, err := cfg.db.GetUserOauthAuthorizations(req.Context(), authID)
+	if err != nil {
+		respondWithInternalError(w, "Error getting authorized apps", err)
+		return
+	}
+
+	for _, dba := range dbAuthorizations {
+		authorization := outputOauthAuthorization{}
+		authorization.ClientID = dba.ClientID
+		authorization.Name = dba.Name
+		authorization.Scopes = dba.Scopes
+		authorization.LastUsedAt = dba.CreatedAt
+		authorizations = append(authorizations, authorization)
+	}
+
+	respondWithJSON(w, 200, authorizations)
+}
+
+// Takes the app's access away: its refresh tokens are revoked and so are the
+// access tokens issued with them
+func (cfg *apiConfig) revokeOauthAuthorizationHandler(w http.ResponseWriter, req *http.Request) {
+	// Authenticated by middlewareAuth
+	authID := authUserID(req)
+
+	clientID, err := uuid.Parse(req.PathValue("clientID"))
+	if err != nil {
+		respondWithInvalidID(w, "client")
+		return
+	}
+
+	tx, err := cfg.sqlDB.BeginTx(req.Context(), nil)
+	if err != nil {
+		respondWithInternalError(w, "Could not start transaction", err)
+		return
+	}
+	defer tx.Rollback()
+	qtx := cfg.withTx(tx)
+
+	// Access tokens past their expiry are still taken within the leeway
+	ruocatp := database.RevokeUserOauthClientAccessTokensParams{
+		UserID:   authID,
+		ClientID: clientID,
+		Cutoff:   time.Now().Add(-cfg.tokenPolicy.Leeway),
+	}
+	err = qtx.RevokeUserOauthClientAccessTokens(req.Context(), ruocatp)
+	if err != nil {
+		respondWithInternalError(w, "Could not revoke app access tokens", err)
+		return
+	}
+	ruocrtp := database.RevokeUserOauthClientRefreshTokensParams{
+		UserID:   authID,
+		ClientID: clientID,
+	}
+	revoked, err := qtx.RevokeUserOauthClientRefreshTokens(req.Context(), ruocrtp)
+	if err != nil {
+		respondWithInternalError(w, "Could not revoke app refresh tokens", err)
+		return
+	}
+	if revoked == 0 {
+		respondWithError(w, 404, codeNotFound, "Authorization not found")
+		return
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		respondWithInternalError(w, "Could not commit app revocation", err)
+		return
+	}
+
+	respondWithText(w, 204, "")
+}
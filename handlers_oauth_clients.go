@@ -0,0 +1,161 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pauslik/chirpy/internal/auth"
+	"github.com/pauslik/chirpy/internal/database"
+)
+
+type inputOauthClient struct {
+	Name         string   `json:"name"`
+	RedirectURIs []string `json:"redirect_uris"`
+	Scopes       []string `json:"scopes"`
+	// Apps that can't keep a secret (mobile, single page) only rely on PKCE
+	Public bool `json:"public"`
+}
+
+type outputOauthClient struct {
+	ID           uuid.UUID `json:"client_id"`
+	Name         string    `json:"name"`
+	RedirectURIs []string  `json:"redirect_uris"`
+	Scopes       []string  `json:"scopes"`
+	Public       bool      `json:"public"`
+	CreatedAt    time.Time `json:"created_at"`
+	// Only returned on registration, the database keeps the hash
+	Secret string `json:"client_secret,omitempty"`
+}
+
+const maxClientNameLength = 100
+
+func toOutputOauthClient(client database.OauthClient) outputOauthClient {
+	oClient := outputOauthClient{}
+	oClient.ID = client.ID
+	oClient.Name = client.Name
+	oClient.RedirectURIs = client.RedirectUris
+	oClient.Scopes = client.Scopes
+	oClient.Public = !client.SecretHash.Valid
+	oClient.CreatedAt = client.CreatedAt
+	return oClient
+}
+
+// Absolute URIs without a fragment, https except for local development
+func validRedirectURI(raw string) bool {
+	u, err := url.Parse(raw)
+	if err != nil || u.Fragment != "" || u.Host == "" {
+		return false
+	}
+	if u.Scheme == "https" {
+		return true
+	}
+	return u.Scheme == "http" && (u.Hostname() == "localhost" || u.Hostname() == "127.0.0.1")
+}
+
+func (cfg *apiConfig) createOauthClientHandler(w http.ResponseWriter, req *http.Request) {
+	iClient := inputOauthClient{}
+	// Authenticated by middlewareAuth
+	authID := authUserID(req)
+
+	// Decoding input
+	decoder := json.NewDecoder(req.Body)
+	err := decoder.Decode(&iClient)
+	if err != nil {
+		respondWithInvalidJSON(w, err)
+		return
+	}
+
+	var fields []fieldError
+	if iClient.Name == "" || len(iClient.Name) > maxClientNameLength {
+		fields = append(fields, fieldError{Field: "name", Code: "invalid_length", Detail: fmt.Sprintf("Name is required, up to %d characters", maxClientNameLength)})
+	}
+	if len(iClient.RedirectURIs) == 0 {
+		fields = append(fields, fieldError{Field: "redirect_uris", Code: "required", Detail: "At least one redirect URI is required"})
+	}
+	for i, uri := range iClient.RedirectURIs {
+		if !validRedirectURI(uri) {
+			fields = append(fields, fieldError{Field: fmt.Sprintf("redirect_uris[%d]", i), Code: "invalid_redirect_uri", Detail: fmt.Sprintf("Redirect URI %q must be an absolute https URI without fragment", uri)})
+		}
+	}
+	fields = append(fields, scopeFieldErrors(iClient.Scopes)...)
+	if len(fields) > 0 {
+		respondWithValidation(w, fields...)
+		return
+	}
+
+	coacp := database.CreateOauthClientParams{
+		UserID:       authID,
+		Name:         iClient.Name,
+		RedirectUris: iClient.RedirectURIs,
+		Scopes:       iClient.Scopes,
+	}
+	var secret string
+	if !iClient.Public {
+		secret, err = auth.MakeOpaqueToken()
+		if err != nil {
+			respondWithInternalError(w, "Could not create client secret", err)
+			return
+		}
+		coacp.SecretHash = sql.NullString{String: auth.HashToken(secret), Valid: true}
+	}
+	client, err := cfg.db.CreateOauthClient(req.Context(), coacp)
+	if err != nil {
+		respondWithInternalError(w, "Could not store client", err)
+		return
+	}
+
+	oClient := toOutputOauthClient(client)
+	oClient.Secret = secret
+	respondWithJSON(w, 201, oClient)
+}
+
+func (cfg *apiConfig) getOauthClientsHandler(w http.ResponseWriter, req *http.Request) {
+	clients := []outputOauthClient{}
+	// Authenticated by middlewareAuth
+	authID := authUserID(req)
+
+	dbClients, err := cfg.db.GetUserOauthClients(req.Context(), authID)
+	if err != nil {
+		respondWithInternalError(w, "Error getting clients", err)
+		return
+	}
+	for _, client := range dbClients {
+		clients = append(clients, toOutputOauthClient(client))
+	}
+
+	respondWithJSON(w, 200, clients)
+}
+
+// Deleting a client also deletes its codes and refresh tokens, its access tokens expire within the hour
+func (cfg *apiConfig) deleteOauthClientHandler(w http.ResponseWriter, req *http.Request) {
+	// Authenticated by middlewareAuth
+	authID := authUserID(req)
+
+	clientID, err := uuid.Parse(req.PathValue("clientID"))
+	if err != nil {
+		respondWithInvalidID(w, "client")
+		return
+	}
+
+	// Scoped to the owner, someone else's client looks the same as a missing one
+	doacp := database.DeleteOauthClientParams{
+		ID:     clientID,
+		UserID: authID,
+	}
+	deleted, err := cfg.db.DeleteOauthClient(req.Context(), doacp)
+	if err != nil {
+		respondWithInternalError(w, "Could not delete client", err)
+		return
+	}
+	if deleted == 0 {
+		respondWithError(w, 404, codeNotFound, "Client not found")
+		return
+	}
+
+	respondWithText(w, 204, "")
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pauslik/chirpy/internal/auth"
+	"github.com/pauslik/chirpy/internal/database"
+	"github.com/pauslik/chirpy/internal/oidc"
+)
+
+// How long the user has to finish logging in at the provider
+const oidcLoginTTL = 10 * time.Minute
+
+// Binds the login to the browser that started it, so nobody can hand a victim
+// a callback URL that logs them into the attacker's account
+const oidcStateCookie = "chirpy_oidc_state"
+
+var errEmailNotVerified = errors.New("The provider hasn't verified this email address")
+
+func (cfg *apiConfig) oidcRedirectURI(provider string) string {
+	return cfg.baseURL + "/api/auth/" + provider + "/callback"
+}
+
+func (cfg *apiConfig) oidcLoginHandler(w http.ResponseWriter, req *http.Request) {
+	name := req.PathValue("provider")
+	provider, ok := cfg.oidcProviders[name]
+	if !ok {
+		respondWithError(w, 404, codeNotFound, "Unknown login provider")
+		return
+	}
+
+	state, err := auth.MakeOpaqueToken()
+	if err != nil {
+		respondWithInternalError(w, "Could not create state", err)
+		return
+	}
+	nonce, err := auth.MakeOpaqueToken()
+	if err != nil {
+		respondWithInternalError(w, "Could not create nonce", err)
+		return
+	}
+	verifier, err := auth.MakePKCEVerifier()
+	if err != nil {
+		respondWithInternalError(w, "Could not create PKCE verifier", err)
+		return
+	}
+
+	authURL, err := provider.AuthCodeURL(req.Context(), cfg.oidcRedirectURI(name), state, nonce, verifier)
+	if err != nil {
+		respondWithProblem(w, &apiError{Status: 502, Code: "provider_unavailable", Detail: "Login provider unavailable", Err: err})
+		return
+	}
+
+	// Abandoned logins are cleaned up here rather than by a job
+	cfg.db.DeleteExpiredOidcLoginStates(req.Context())
+	colsp := database.CreateOidcLoginStateParams{
+		StateHash:    auth.HashToken(state),
+		Provider:     name,
+		CodeVerifier: verifier,
+		Nonce:        nonce,
+		ExpiresAt:    time.Now().Add(oidcLoginTTL),
+	}
+	err = cfg.db.CreateOidcLoginState(req.Context(), colsp)
+	if err != nil {
+		respondWithInternalError(w, "Could not store login state", err)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    state,
+		Path:     "/api/auth/",
+		MaxAge:   int(oidcLoginTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(cfg.baseURL, "https://"),
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, req, authURL, http.StatusFound)
+}
+
+// Finishes the login like POST /api/login would: JWT and refresh token, or
+// the MFA challenge when the user has two-factor authentication enabled
+func (cfg *apiConfig) oidcCallbackHandler(w http.ResponseWriter, req *http.Request) {
+	name := req.PathValue("provider")
+	provider, ok := cfg.oidcProviders[name]
+	if !ok {
+		respondWithError(w, 404, codeNotFound, "Unknown login provider")
+		return
+	}
+
+	query := req.URL.Query()
+	if providerErr := query.Get("error"); providerErr != "" {
+		respondWithError(w, 400, "login_not_completed", fmt.Sprintf("Login was not completed: %s %s", providerErr, query.Get("error_description")))
+		return
+	}
+
+	state := query.Get("state")
+	cookie, err := req.Cookie(oidcStateCookie)
+	if err != nil || state == "" || cookie.Value != state {
+		respondWithError(w, 400, "invalid_login_state", "Login state doesn't match this browser")
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: oidcStateCookie, Path: "/api/auth/", MaxAge: -1})
+
+	// Single use, a replayed callback finds nothing
+	colsp := database.ConsumeOidcLoginStateParams{
+		StateHash: auth.HashToken(state),
+		Provider:  name,
+	}
+	loginState, err := cfg.db.ConsumeOidcLoginState(req.Context(), colsp)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			respondWithError(w, 400, "invalid_login_state", "Login expired or already used")
+			return
+		}
+		respondWithInternalError(w, "Error getting login state", err)
+		return
+	}
+
+	claims, err := provider.Exchange(req.Context(), cfg.oidcRedirectURI(name), query.Get("code"), loginState.CodeVerifier, loginState.Nonce)
+	if err != nil {
+		respondWithProblem(w, &apiError{Status: 401, Code: "login_not_verified", Detail: fmt.Sprintf("Could not verify login with %s", name), Err: err})
+		return
+	}
+
+	dbUser, err := cfg.userForIdentity(req.Context(), name, claims)
+	if err != nil {
+		if errors.Is(err, errEmailNotVerified) {
+			respondWithError(w, 403, "email_not_verified", err.Error())
+			return
+		}
+		respondWithInternalError(w, "Could not link identity", err)
+		return
+	}
+
+	cfg.firstFactorPassed(w, req, dbUser)
+}
+
+// Known identities log into their user. New ones are linked to the user with
+// the same email, or get a new account, but only if the provider verified the email.
+func (cfg *apiConfig) userForIdentity(ctx context.Context, provider string, claims *oidc.Claims) (database.User, error) {
+	guip := database.GetUserIdentityParams{
+		Provider: provider,
+		Subject:  claims.Subject,
+	}
+	identity, err := cfg.db.GetUserIdentity(ctx, guip)
+	if err == nil {
+		tuip := database.TouchUserIdentityParams{
+			ID:    identity.ID,
+			Email: claims.Email,
+		}
+		err = cfg.db.TouchUserIdentity(ctx, tuip)
+		if err != nil {
+			return database.User{}, err
+		}
+		return cfg.db.GetUserByID(ctx, identity.UserID)
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return database.User{}, err
+	}
+
+	if claims.Email == "" || !claims.Verified() {
+		return database.User{}, errEmailNotVerified
+	}
+
+	tx, err := cfg.sqlDB.BeginTx(ctx, nil)
+	if err != nil {
+		return database.User{}, err
+	}
+	defer tx.Rollback()
+	qtx := cfg.withTx(tx)
+
+	dbUser, err := qtx.GetUser(ctx, claims.Email)
+	if errors.Is(err, sql.ErrNoRows) {
+		// No usable password, one can be set with the password reset
+		var password, hash string
+		password, err = auth.MakeOpaqueToken()
+		if err != nil {
+			return database.User{}, err
+		}
+		hash, err = auth.HashPassword(password)
+		if err != nil {
+			return database.User{}, err
+		}
+		cup := database.CreateUserParams{
+			Email:          claims.Email,
+			HashedPassword: hash,
+		}
+		dbUser, err = qtx.CreateUser(ctx, cup)
+	}
+	if err != nil {
+		return database.User{}, err
+	}
+
+	cuip := database.CreateUserIdentityParams{
+		UserID:   dbUser.ID,
+		Provider: provider,
+		Subject:  claims.Subject,
+		Email:    claims.Email,
+	}
+	_, err = qtx.CreateUserIdentity(ctx, cuip)
+	if err != nil {
+		return database.User{}, err
+	}
+
+	return dbUser, tx.Commit()
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/pauslik/chirpy/internal/auth"
+	"github.com/pauslik/chirpy/internal/database"
+	"github.com/pauslik/chirpy/internal/mail"
+)
+
+const passwordResetTTL = time.Hour
+
+type inputForgotPassword struct {
+	Email string `json:"email"`
+}
+
+type inputResetPassword struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+func (cfg *apiConfig) forgotPasswordHandler(w http.ResponseWriter, req *http.Request) {
+	iForgot := inputForgotPassword{}
+	// Decoding input
+	decoder := json.NewDecoder(req.Body)
+	err := decoder.Decode(&iForgot)
+	if err != nil {
+		respondWithInvalidJSON(w, err)
+		return
+	}
+
+	// The response is the same whether or not the account exists,
+	// otherwise this endpoint could be used to enumerate users
+	accepted := "If the account exists, a password reset email has been sent"
+
+	dbUser, err := cfg.db.GetUser(req.Context(), iForgot.Email)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			respondWithText(w, 202, accepted)
+			return
+		}
+		respondWithInternalError(w, "Error fetching user by email", err)
+		return
+	}
+
+	token, err := auth.MakeOpaqueToken()
+	if err != nil {
+		respondWithInternalError(w, "Could not generate reset token", err)
+		return
+	}
+	cprtp := database.CreatePasswordResetTokenParams{
+		TokenHash: auth.HashToken(token),
+		UserID:    dbUser.ID,
+		ExpiresAt: time.Now().Add(passwordResetTTL),
+	}
+	_, err = cfg.db.CreatePasswordResetToken(req.Context(), cprtp)
+	if err != nil {
+		respondWithInternalError(w, "Could not save reset token", err)
+		return
+	}
+
+	// Send in the background so the response time doesn't reveal whether the account exists
+	msg := mail.Message{
+		To:      dbUser.Email,
+		Subject: "Reset your Chirpy password",
+		Body: fmt.Sprintf("Someone asked to reset the password for your Chirpy account.\n\n"+
+			"Use this token within %s to choose a new password:\n\n%s\n\n"+
+			"%s/app/reset?token=%s\n\n"+
+			"If this wasn't you, you can ignore this email.\n",
+			passwordResetTTL, token, cfg.baseURL, token),
+	}
+	cfg.background.Go(func() {
+		// Outlives the request, but stays in its trace
+		err := cfg.mailer.Send(context.WithoutCancel(req.Context()), msg)
+		if err != nil {
+			slog.Error("Could not send password reset email", "error", err)
+		}
+	})
+
+	respondWithText(w, 202, accepted)
+}
+
+func (cfg *apiConfig) resetPasswordHandler(w http.ResponseWriter, req *http.Request) {
+	iReset := inputResetPassword{}
+	// Decoding input
+	decoder := json.NewDecoder(req.Body)
+	err := decoder.Decode(&iReset)
+	if err != nil {
+		respondWithInvalidJSON(w, err)
+		return
+	}
+	var fields []fieldError
+	if iReset.Token == "" {
+		fields = append(fields, fieldError{Field: "token", Code: "required", Detail: "Token is required"})
+	}
+	if iReset.Password == "" {
+		fields = append(fields, fieldError{Field: "password", Code: "required", Detail: "Password is required"})
+	}
+	if len(fields) > 0 {
+		respondWithValidation(w, fields...)
+		return
+	}
+
+	if !cfg.checkPasswordPolicy(w, iReset.Password) {
+		return
+	}
+
+	// Hash before opening the transaction, argon2id is slow on purpose
+	passHashed, err := auth.HashPassword(iReset.Password)
+	if err != nil {
+		respondWithInternalError(w, "Error hashing password", err)
+		return
+	}
+
+	tx, err := cfg.sqlDB.BeginTx(req.Context(), nil)
+	if err != nil {
+		respondWithInternalError(w, "Could not start transaction", err)
+		return
+	}
+	defer tx.Rollback()
+	qtx := cfg.withTx(tx)
+
+	// Consuming marks the token as used, so it can only ever succeed once
+	resetToken, err := qtx.ConsumePasswordResetToken(req.Context(), auth.HashToken(iReset.Token))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			respondWithError(w, 400, "invalid_token", "Reset token is invalid or expired")
+			return
+		}
+		respondWithInternalError(w, "Error checking reset token", err)
+		return
+	}
+
+	uupp := database.UpdateUserPasswordParams{
+		ID:             resetToken.UserID,
+		HashedPassword: passHashed,
+	}
+	_, err = qtx.UpdateUserPassword(req.Context(), uupp)
+	if err != nil {
+		respondWithInternalError(w, "Error updating password", err)
+		return
+	}
+
+	// Log out everywhere and kill any other reset links that are still out there
+	err = cfg.revokeUserAccess(req.Context(), qtx, resetToken.UserID)
+	if err != nil {
+		respondWithInternalError(w, "Error revoking access", err)
+		return
+	}
+	err = qtx.InvalidatePasswordResetTokens(req.Context(), resetToken.UserID)
+	if err != nil {
+		respondWithInternalError(w, "Error invalidating reset tokens", err)
+		return
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		respondWithInternalError(w, "Could not commit password reset", err)
+		return
+	}
+
+	respondWithText(w, 204, "")
+}
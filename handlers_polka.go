@@ -1,58 +1,192 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"database/sql"
 	"encoding/json"
-	"fmt"
+	"errors"
+	"io"
 	"net/http"
+	"time"
 
 	"github.com/google/uuid"
-	"github.com/pauslik/chirpy/internal/auth"
+	"github.com/pauslik/chirpy/internal/database"
+	"github.com/pauslik/chirpy/internal/tracing"
 )
 
-type inputUpgrade struct {
+const (
+	polkaSignatureHeader = "Polka-Signature"
+	// Source of Polka events in webhook_events
+	webhookSourcePolka = "polka"
+	maxWebhookBodySize = 1 << 20
+)
+
+// Polka events about Chirpy Red
+const (
+	polkaUserUpgraded   = "user.upgraded"
+	polkaUserDowngraded = "user.downgraded"
+	polkaRenewed        = "subscription.renewed"
+	polkaPaymentFailed  = "subscription.payment_failed"
+	polkaRefunded       = "subscription.refunded"
+)
+
+type inputPolkaEvent struct {
+	// Unique per event and kept across Polka's retries
+	ID    string `json:"id"`
 	Event string `json:"event"`
 	Data  struct {
 		UserID string `json:"user_id"`
+		// End of the paid period for upgrades and renewals, one month when missing
+		PeriodEnd *time.Time `json:"period_end"`
 	} `json:"data"`
 }
 
-func (cfg *apiConfig) upgradeRedHandler(w http.ResponseWriter, req *http.Request) {
-	iUpgrade := inputUpgrade{}
+// Polka signs every request, see internal/webhook. The signature covers the raw
+// body, so it's checked before anything is decoded.
+func (cfg *apiConfig) polkaWebhookHandler(w http.ResponseWriter, req *http.Request) {
+	iEvent := inputPolkaEvent{}
 
-	// Check if API key matches the expected
-	apiKey, _ := auth.GetAPIKey(req.Header)
-	if apiKey != cfg.polka {
-		respondWithText(w, 401, "Wrong API key")
+	body, err := io.ReadAll(http.MaxBytesReader(w, req.Body, maxWebhookBodySize))
+	if err != nil {
+		respondWithBodyError(w, err)
 		return
 	}
-
-	// Decoding input
-	decoder := json.NewDecoder(req.Body)
-	err := decoder.Decode(&iUpgrade)
-	if err != nil {
-		fErr := fmt.Sprintf("Error decoding input: %s", err)
-		respondWithText(w, 500, fErr)
+	if len(cfg.polkaWebhook.Secrets) == 0 {
+		respondWithError(w, 503, codeUnavailable, "Polka webhooks are not configured")
 		return
 	}
-
-	if iUpgrade.Event != "user.upgraded" {
-		respondWithText(w, 204, "")
+	_, err = cfg.polkaWebhook.Verify(req.Header.Get(polkaSignatureHeader), body)
+	if err != nil {
+		respondWithError(w, 401, "invalid_signature", err.Error())
 		return
 	}
 
-	parsedID, err := uuid.Parse(iUpgrade.Data.UserID)
+	// Decoding input
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	err = decoder.Decode(&iEvent)
 	if err != nil {
-		fErr := fmt.Sprintf("Not valid user ID: %s", err)
-		respondWithText(w, 500, fErr)
+		respondWithInvalidJSON(w, err)
+		return
+	}
+	if iEvent.ID == "" {
+		respondWithValidation(w, fieldError{Field: "id", Code: "required", Detail: "Event ID is required"})
 		return
 	}
 
-	_, err = cfg.db.UpgradeUserRed(req.Context(), parsedID)
+	// Stored before acknowledging, the worker in webhook_inbox.go applies it
+	cwep := database.CreateWebhookEventParams{
+		Source:  webhookSourcePolka,
+		EventID: iEvent.ID,
+		Event:   iEvent.Event,
+		Payload: string(body),
+		// Events about one user are applied in the order they came in
+		Subject: iEvent.Data.UserID,
+		// The worker continues Polka's trace, if it sent one
+		Traceparent: tracing.Traceparent(req.Context()),
+	}
+	stored, err := cfg.db.CreateWebhookEvent(req.Context(), cwep)
 	if err != nil {
-		fErr := fmt.Sprintf("User not found with respective ID: %s", err)
-		respondWithText(w, 500, fErr)
+		respondWithInternalError(w, "Error storing event", err)
 		return
 	}
+	// An event ID seen before stores nothing, a replay or a retry after a lost response
+	if stored > 0 {
+		cfg.wakeWebhookWorker()
+	}
 
 	respondWithText(w, 204, "")
 }
+
+func polkaSubscriptionEvent(event string) bool {
+	switch event {
+	case polkaUserUpgraded, polkaUserDowngraded, polkaRenewed, polkaPaymentFailed, polkaRefunded:
+		return true
+	}
+	return false
+}
+
+// Moves the user's subscription through its lifecycle and keeps is_chirpy_red
+// in step. Returns sql.ErrNoRows when the user doesn't exist.
+func applyPolkaEvent(ctx context.Context, q *database.Queries, userID uuid.UUID, event inputPolkaEvent) error {
+	current, err := q.GetCurrentSubscription(ctx, userID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+	live := err == nil && subscriptionLive(current.Status)
+
+	switch event.Event {
+	case polkaUserUpgraded, polkaRenewed:
+		_, err = q.UpgradeUserRed(ctx, userID)
+		if err != nil {
+			return err
+		}
+		if !live {
+			// First upgrade, or a renewal after the subscription lapsed
+			start := time.Now()
+			csp := database.CreateSubscriptionParams{
+				UserID:             userID,
+				CurrentPeriodStart: start,
+				CurrentPeriodEnd:   periodEnd(start, event),
+			}
+			_, err = q.CreateSubscription(ctx, csp)
+			if err != nil {
+				return err
+			}
+			oUpgraded := outputUserUpgraded{UserID: userID}
+			return enqueueWebhookEvent(ctx, q, eventUserUpgraded, uuid.NullUUID{UUID: userID, Valid: true}, oUpgraded)
+		}
+		if event.Event == polkaUserUpgraded {
+			return nil
+		}
+		// Renewals continue from the end of the paid period, not from when Polka got to us.
+		// Backfilled subscriptions don't know theirs, they start over.
+		start := current.CurrentPeriodEnd
+		if start.Before(time.Now()) || current.Source == subscriptionSourceBackfill {
+			start = time.Now()
+		}
+		rsp := database.RenewSubscriptionParams{
+			ID:                 current.ID,
+			CurrentPeriodStart: start,
+			CurrentPeriodEnd:   periodEnd(start, event),
+		}
+		_, err = q.RenewSubscription(ctx, rsp)
+		return err
+
+	case polkaPaymentFailed:
+		// Red stays until the paid period ends, the expiry job takes it away if
+		// no renewal comes in by then
+		if !live {
+			return nil
+		}
+		_, err = q.MarkSubscriptionPastDue(ctx, current.ID)
+		return err
+
+	case polkaUserDowngraded, polkaRefunded:
+		_, err = q.DowngradeUserRed(ctx, userID)
+		if err != nil {
+			return err
+		}
+		if !live {
+			return nil
+		}
+		status := subscriptionCanceled
+		if event.Event == polkaRefunded {
+			status = subscriptionRefunded
+		}
+		esp := database.EndSubscriptionParams{
+			ID:     current.ID,
+			Status: status,
+		}
+		_, err = q.EndSubscription(ctx, esp)
+		return err
+	}
+	return nil
+}
+
+func periodEnd(start time.Time, event inputPolkaEvent) time.Time {
+	if event.Data.PeriodEnd != nil && event.Data.PeriodEnd.After(start) {
+		return *event.Data.PeriodEnd
+	}
+	return start.AddDate(0, 1, 0)
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+	"github.com/pauslik/chirpy/internal/database"
+)
+
+// A session is a refresh token family: it starts at login and keeps its ID
+// (the family ID) through every rotation until it's revoked or expires.
+type sessionInfo struct {
+	FamilyID  uuid.UUID
+	StartedAt time.Time
+	UserAgent string
+	IP        string
+}
+
+const maxUserAgentLength = 512
+
+type outputSession struct {
+	ID         uuid.UUID `json:"id"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	UserAgent  string    `json:"user_agent"`
+	IP         string    `json:"ip"`
+}
+
+// Session for a fresh login
+func newSession(req *http.Request) sessionInfo {
+	return sessionInfo{
+		FamilyID:  uuid.New(),
+		StartedAt: time.Now(),
+		UserAgent: truncateUserAgent(req.UserAgent()),
+		IP:        clientIP(req),
+	}
+}
+
+// Session continued by a refresh, the device details are updated to the latest request
+func continueSession(req *http.Request, previous database.RefreshToken) sessionInfo {
+	return sessionInfo{
+		FamilyID:  previous.FamilyID,
+		StartedAt: previous.SessionStartedAt,
+		UserAgent: truncateUserAgent(req.UserAgent()),
+		IP:        clientIP(req),
+	}
+}
+
+// Postgres refuses text that isn't valid UTF-8, so invalid bytes are dropped
+// and the cut never splits a character
+func truncateUserAgent(ua string) string {
+	ua = strings.ToValidUTF8(ua, "")
+	if len(ua) <= maxUserAgentLength {
+		return ua
+	}
+	cut := maxUserAgentLength
+	for cut > 0 && !utf8.RuneStart(ua[cut]) {
+		cut--
+	}
+	return ua[:cut]
+}
+
+func (cfg *apiConfig) getSessionsHandler(w http.ResponseWriter, req *http.Request) {
+	sessions := []outputSession{}
+	// Authenticated by middlewareAuth
+	authID := authUserID(req)
+
+	// Only the live token of each family is returned, so there's one row per session
+	dbTokens, err := cfg.db.GetUserSessions(req.Context(), authID)
+	if err != nil {
+		respondWithInternalError(w, "Error getting sessions", err)
+		return
+	}
+
+	for _, dbt := range dbTokens {
+		session := outputSession{}
+		session.ID = dbt.FamilyID
+		session.CreatedAt = dbt.SessionStartedAt
+		session.LastUsedAt = dbt.LastUsedAt
+		session.ExpiresAt = dbt.ExpiresAt
+		session.UserAgent = dbt.UserAgent
+		session.IP = dbt.Ip
+		sessions = append(sessions, session)
+	}
+
+	respondWithJSON(w, 200, sessions)
+}
+
+func (cfg *apiConfig) deleteSessionHandler(w http.ResponseWriter, req *http.Request) {
+	// Authenticated by middlewareAuth
+	authID := authUserID(req)
+
+	sessionID, err := uuid.Parse(req.PathValue("sessionID"))
+	if err != nil {
+		respondWithInvalidID(w, "session")
+		return
+	}
+
+	// Scoped to the caller, someone else's session looks the same as a missing one
+	rusp := database.RevokeUserSessionParams{
+		UserID:   authID,
+		FamilyID: sessionID,
+	}
+	revoked, err := cfg.db.RevokeUserSession(req.Context(), rusp)
+	if err != nil {
+		respondWithInternalError(w, "Could not revoke session", err)
+		return
+	}
+	if revoked == 0 {
+		respondWithError(w, 404, codeNotFound, "Session not found")
+		return
+	}
+
+	respondWithText(w, 204, "")
+}
+
+// Signs the user out of everything: sessions, personal access tokens and the
+// apps they've authorized, along with the access tokens those apps hold
+func (cfg *apiConfig) revokeUserAccess(ctx context.Context, q *database.Queries, userID uuid.UUID) error {
+	err := q.RevokeUserRefreshTokens(ctx, userID)
+	if err != nil {
+		return err
+	}
+	err = q.RevokeUserPersonalAccessTokens(ctx, userID)
+	if err != nil {
+		return err
+	}
+	// Access tokens past their expiry are still taken within the leeway
+	ruoatp := database.RevokeUserOauthAccessTokensParams{
+		UserID: userID,
+		Cutoff: time.Now().Add(-cfg.tokenPolicy.Leeway),
+	}
+	err = q.RevokeUserOauthAccessTokens(ctx, ruoatp)
+	if err != nil {
+		return err
+	}
+	return q.RevokeUserOauthRefreshTokens(ctx, userID)
+}
+
+func (cfg *apiConfig) revokeAllSessionsHandler(w http.ResponseWriter, req *http.Request) {
+	// Authenticated by middlewareAuth
+	authID := authUserID(req)
+
+	tx, err := cfg.sqlDB.BeginTx(req.Context(), nil)
+	if err != nil {
+		respondWithInternalError(w, "Could not start transaction", err)
+		return
+	}
+	defer tx.Rollback()
+
+	err = cfg.revokeUserAccess(req.Context(), cfg.withTx(tx), authID)
+	if err != nil {
+		respondWithInternalError(w, "Could not revoke sessions", err)
+		return
+	}
+	err = tx.Commit()
+	if err != nil {
+		respondWithInternalError(w, "Could not commit session revocation", err)
+		return
+	}
+
+	respondWithText(w, 204, "")
+}
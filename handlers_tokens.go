@@ -0,0 +1,161 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pauslik/chirpy/internal/auth"
+	"github.com/pauslik/chirpy/internal/database"
+)
+
+type inputPersonalAccessToken struct {
+	Name          string   `json:"name"`
+	Scopes        []string `json:"scopes"`
+	ExpiresInDays int      `json:"expires_in_days"`
+}
+
+type outputPersonalAccessToken struct {
+	ID         uuid.UUID  `json:"id"`
+	Name       string     `json:"name"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	// Only returned on creation, the database keeps the hash
+	Token string `json:"token,omitempty"`
+}
+
+const maxTokenNameLength = 100
+
+func toOutputPersonalAccessToken(pat database.PersonalAccessToken) outputPersonalAccessToken {
+	oToken := outputPersonalAccessToken{}
+	oToken.ID = pat.ID
+	oToken.Name = pat.Name
+	oToken.Scopes = pat.Scopes
+	oToken.CreatedAt = pat.CreatedAt
+	if pat.LastUsedAt.Valid {
+		oToken.LastUsedAt = &pat.LastUsedAt.Time
+	}
+	if pat.ExpiresAt.Valid {
+		oToken.ExpiresAt = &pat.ExpiresAt.Time
+	}
+	return oToken
+}
+
+// Token management needs a login (JWT), a personal access token can't mint or revoke others
+func (cfg *apiConfig) createTokenHandler(w http.ResponseWriter, req *http.Request) {
+	iToken := inputPersonalAccessToken{}
+
+	// Authenticated by middlewareAuth
+	authID := authUserID(req)
+
+	// Decoding input
+	decoder := json.NewDecoder(req.Body)
+	err := decoder.Decode(&iToken)
+	if err != nil {
+		respondWithInvalidJSON(w, err)
+		return
+	}
+
+	var fields []fieldError
+	if iToken.Name == "" || len(iToken.Name) > maxTokenNameLength {
+		fields = append(fields, fieldError{Field: "name", Code: "invalid_length", Detail: fmt.Sprintf("Name is required, up to %d characters", maxTokenNameLength)})
+	}
+	fields = append(fields, scopeFieldErrors(iToken.Scopes)...)
+	if iToken.ExpiresInDays < 0 {
+		fields = append(fields, fieldError{Field: "expires_in_days", Code: "negative", Detail: "expires_in_days can't be negative"})
+	}
+	if len(fields) > 0 {
+		respondWithValidation(w, fields...)
+		return
+	}
+
+	plain, err := auth.MakePersonalAccessToken()
+	if err != nil {
+		respondWithInternalError(w, "Could not create token", err)
+		return
+	}
+
+	// Zero days means the token doesn't expire
+	cpatp := database.CreatePersonalAccessTokenParams{
+		UserID:    authID,
+		Name:      iToken.Name,
+		TokenHash: auth.HashToken(plain),
+		Scopes:    iToken.Scopes,
+	}
+	if iToken.ExpiresInDays > 0 {
+		cpatp.ExpiresAt = sql.NullTime{Time: time.Now().AddDate(0, 0, iToken.ExpiresInDays), Valid: true}
+	}
+	pat, err := cfg.db.CreatePersonalAccessToken(req.Context(), cpatp)
+	if err != nil {
+		respondWithInternalError(w, "Could not store token", err)
+		return
+	}
+
+	oToken := toOutputPersonalAccessToken(pat)
+	oToken.Token = plain
+	respondWithJSON(w, 201, oToken)
+}
+
+func (cfg *apiConfig) getTokensHandler(w http.ResponseWriter, req *http.Request) {
+	tokens := []outputPersonalAccessToken{}
+	// Authenticated by middlewareAuth
+	authID := authUserID(req)
+
+	dbTokens, err := cfg.db.GetUserPersonalAccessTokens(req.Context(), authID)
+	if err != nil {
+		respondWithInternalError(w, "Error getting tokens", err)
+		return
+	}
+	for _, pat := range dbTokens {
+		tokens = append(tokens, toOutputPersonalAccessToken(pat))
+	}
+
+	respondWithJSON(w, 200, tokens)
+}
+
+func (cfg *apiConfig) deleteTokenHandler(w http.ResponseWriter, req *http.Request) {
+	// Authenticated by middlewareAuth
+	authID := authUserID(req)
+
+	tokenID, err := uuid.Parse(req.PathValue("tokenID"))
+	if err != nil {
+		respondWithInvalidID(w, "token")
+		return
+	}
+
+	// Scoped to the caller, someone else's token looks the same as a missing one
+	rpatp := database.RevokePersonalAccessTokenParams{
+		ID:     tokenID,
+		UserID: authID,
+	}
+	revoked, err := cfg.db.RevokePersonalAccessToken(req.Context(), rpatp)
+	if err != nil {
+		respondWithInternalError(w, "Could not revoke token", err)
+		return
+	}
+	if revoked == 0 {
+		respondWithError(w, 404, codeNotFound, "Token not found")
+		return
+	}
+
+	respondWithText(w, 204, "")
+}
+
+// Scopes a token or app asks for, at least one and all known
+func scopeFieldErrors(scopes []string) []fieldError {
+	if len(scopes) == 0 {
+		return []fieldError{{Field: "scopes", Code: "required", Detail: "At least one scope is required"}}
+	}
+	var fields []fieldError
+	for i, scope := range scopes {
+		if !auth.ValidScope(scope) {
+			fields = append(fields, fieldError{Field: fmt.Sprintf("scopes[%d]", i), Code: "invalid_scope", Detail: fmt.Sprintf("Unknown scope %q", scope)})
+		}
+	}
+	return fields
+}
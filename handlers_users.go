@@ -1,16 +1,20 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"log/slog"
 	"net/http"
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/lib/pq"
 	"github.com/pauslik/chirpy/internal/auth"
 	"github.com/pauslik/chirpy/internal/database"
+	"github.com/pauslik/chirpy/internal/mail"
 )
 
 type inputUser struct {
@@ -18,18 +22,34 @@ type inputUser struct {
 	Password string `json:"password"`
 }
 
+// Fields left out of the request are not changed
+type inputChangeUser struct {
+	Email           *string `json:"email"`
+	Password        *string `json:"password"`
+	CurrentPassword string  `json:"current_password"`
+}
+
+type inputConfirmEmail struct {
+	Token string `json:"token"`
+}
+
 type outputUser struct {
 	ID           uuid.UUID `json:"id"`
 	CreatedAt    time.Time `json:"created_at"`
 	UpdatedAt    time.Time `json:"updated_at"`
 	Email        string    `json:"email"`
+	PendingEmail string    `json:"pending_email,omitempty"`
 	Token        string    `json:"token"`
 	RefreshToken string    `json:"refresh_token"`
 	IsChirpyRed  bool      `json:"is_chirpy_red"`
+	Role         string    `json:"role"`
 }
 
+const emailChangeTTL = 24 * time.Hour
+
 type outputRefresToken struct {
-	Token string `json:"token"`
+	Token        string `json:"token"`
+	RefreshToken string `json:"refresh_token"`
 }
 
 func (cfg *apiConfig) createUserHandler(w http.ResponseWriter, req *http.Request) {
@@ -39,15 +59,16 @@ func (cfg *apiConfig) createUserHandler(w http.ResponseWriter, req *http.Request
 	decoder := json.NewDecoder(req.Body)
 	err := decoder.Decode(&iUser)
 	if err != nil {
-		fErr := fmt.Sprintf("Error decoding input: %s", err)
-		respondWithText(w, 500, fErr)
+		respondWithInvalidJSON(w, err)
 		return
 	}
 
+	if !cfg.checkPasswordPolicy(w, iUser.Password) {
+		return
+	}
 	passHashed, err := auth.HashPassword(iUser.Password)
 	if err != nil {
-		fErr := fmt.Sprintf("Error hashing password: %s", err)
-		respondWithText(w, 500, fErr)
+		respondWithInternalError(w, "Error hashing password", err)
 		return
 	}
 	cup := database.CreateUserParams{
@@ -56,8 +77,12 @@ func (cfg *apiConfig) createUserHandler(w http.ResponseWriter, req *http.Request
 	}
 	dbUser, err := cfg.db.CreateUser(req.Context(), cup)
 	if err != nil {
-		fErr := fmt.Sprintf("Error creating user: %s", err)
-		respondWithText(w, 500, fErr)
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+			respondWithError(w, 409, "email_taken", "Email is already in use")
+			return
+		}
+		respondWithInternalError(w, "Error creating user", err)
 		return
 	}
 
@@ -66,55 +91,255 @@ func (cfg *apiConfig) createUserHandler(w http.ResponseWriter, req *http.Request
 	oUser.CreatedAt = dbUser.CreatedAt
 	oUser.UpdatedAt = dbUser.UpdatedAt
 	oUser.IsChirpyRed = dbUser.IsChirpyRed
+	oUser.Role = dbUser.Role
 
 	respondWithJSON(w, 201, oUser)
 }
 
+// Writes a 400 with the policy error code and returns false if the password is not allowed
+func (cfg *apiConfig) checkPasswordPolicy(w http.ResponseWriter, password string) bool {
+	err := cfg.passwordPolicy.Check(password)
+	if err == nil {
+		return true
+	}
+	var pErr *auth.PasswordError
+	if errors.As(err, &pErr) {
+		// The policy code stays the problem code, clients matched on it before problems had fields
+		respondWithProblem(w, &apiError{
+			Status: 400,
+			Code:   string(pErr.Code),
+			Detail: pErr.Message,
+			Fields: []fieldError{{Field: "password", Code: string(pErr.Code), Detail: pErr.Message}},
+		})
+		return false
+	}
+	respondWithInternalError(w, "Error checking password", err)
+	return false
+}
+
+// Checks the current password of the authenticated user for sensitive changes.
+// Writes the error response and returns false if it doesn't match.
+func (cfg *apiConfig) reauthenticate(w http.ResponseWriter, req *http.Request, userID uuid.UUID, password string) (database.User, bool) {
+	dbUser, err := cfg.db.GetUserByID(req.Context(), userID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			respondWithError(w, 401, codeUnauthorized, "User no longer exists")
+			return database.User{}, false
+		}
+		respondWithInternalError(w, "Error fetching user", err)
+		return database.User{}, false
+	}
+
+	correct, err := auth.CheckPasswordHash(password, dbUser.HashedPassword)
+	if err != nil {
+		respondWithInternalError(w, "Error checking password", err)
+		return database.User{}, false
+	}
+	if !correct {
+		respondWithError(w, 403, "incorrect_password", "Current password is incorrect")
+		return database.User{}, false
+	}
+	return dbUser, true
+}
+
 func (cfg *apiConfig) changeUserHandler(w http.ResponseWriter, req *http.Request) {
-	iUser := inputUser{}
+	iChange := inputChangeUser{}
 	oUser := outputUser{}
-	// Parse auth header
-	token, err := auth.GetBearerToken(req.Header)
+	// Authenticated by middlewareAuth
+	authID := authUserID(req)
+
+	// Decode input JSON, missing fields are left unchanged
+	decoder := json.NewDecoder(req.Body)
+	err := decoder.Decode(&iChange)
 	if err != nil {
-		fErr := fmt.Sprintf("Access token is malformed or missing: %s", err)
-		respondWithText(w, 401, fErr)
+		respondWithInvalidJSON(w, err)
 		return
 	}
-	// Validate user
-	authID, err := auth.ValidateJWT(token, cfg.jwt)
+	if iChange.Email == nil && iChange.Password == nil {
+		respondWithError(w, 400, codeValidationFailed, "Nothing to change, provide email and/or password")
+		return
+	}
+
+	// Re-authenticate, a stolen access token alone must not be enough to take over the account
+	dbUser, ok := cfg.reauthenticate(w, req, authID, iChange.CurrentPassword)
+	if !ok {
+		return
+	}
+
+	var passHashed string
+	if iChange.Password != nil {
+		if !cfg.checkPasswordPolicy(w, *iChange.Password) {
+			return
+		}
+		passHashed, err = auth.HashPassword(*iChange.Password)
+		if err != nil {
+			respondWithInternalError(w, "Error hashing password", err)
+			return
+		}
+	}
+	changeEmail := iChange.Email != nil && *iChange.Email != dbUser.Email
+
+	// Both changes commit together, so a failure can't leave the password
+	// changed and every session revoked without handing out the new refresh token
+	tx, err := cfg.sqlDB.BeginTx(req.Context(), nil)
+	if err != nil {
+		respondWithInternalError(w, "Could not start transaction", err)
+		return
+	}
+	defer tx.Rollback()
+	qtx := cfg.withTx(tx)
+
+	if iChange.Password != nil {
+		uupp := database.UpdateUserPasswordParams{
+			ID:             dbUser.ID,
+			HashedPassword: passHashed,
+		}
+		dbUser, err = qtx.UpdateUserPassword(req.Context(), uupp)
+		if err != nil {
+			respondWithInternalError(w, "Error updating password", err)
+			return
+		}
+
+		// Log out every other session, token and app, the caller gets a fresh refresh token to stay logged in
+		err = cfg.revokeUserAccess(req.Context(), qtx, dbUser.ID)
+		if err != nil {
+			respondWithInternalError(w, "Error revoking access", err)
+			return
+		}
+		oUser.RefreshToken, err = cfg.createRefreshToken(req.Context(), qtx, dbUser.ID, newSession(req))
+		if err != nil {
+			respondWithInternalError(w, "Could not create refresh token", err)
+			return
+		}
+	}
+
+	var emailToken string
+	if changeEmail {
+		// The address only switches once the link sent to it is confirmed
+		emailToken, err = createEmailChangeToken(req.Context(), qtx, dbUser.ID, *iChange.Email)
+		if err != nil {
+			respondWithInternalError(w, "Could not request email change", err)
+			return
+		}
+		oUser.PendingEmail = *iChange.Email
+	}
+
+	err = tx.Commit()
 	if err != nil {
-		fErr := fmt.Sprintf("Error validating %s JWT: %s", authID.String(), err)
-		respondWithText(w, 401, fErr)
+		respondWithInternalError(w, "Could not commit user change", err)
 		return
 	}
 
-	// Decode input JSON
+	if changeEmail {
+		// The change is stored, a mail that doesn't go out only means asking again
+		newEmail := *iChange.Email
+		cfg.background.Go(func() {
+			err := cfg.sendEmailChangeMail(context.WithoutCancel(req.Context()), dbUser, newEmail, emailToken)
+			if err != nil {
+				slog.Error("Could not send email change mail", "user_id", dbUser.ID, "error", err)
+			}
+		})
+	}
+
+	oUser.ID = dbUser.ID
+	oUser.CreatedAt = dbUser.CreatedAt
+	oUser.UpdatedAt = dbUser.UpdatedAt
+	oUser.Email = dbUser.Email
+	oUser.IsChirpyRed = dbUser.IsChirpyRed
+	oUser.Role = dbUser.Role
+
+	respondWithJSON(w, 200, oUser)
+}
+
+// Stores a pending email change, q should be bound to the transaction of the change
+func createEmailChangeToken(ctx context.Context, q *database.Queries, userID uuid.UUID, newEmail string) (string, error) {
+	token, err := auth.MakeOpaqueToken()
+	if err != nil {
+		return "", err
+	}
+	cectp := database.CreateEmailChangeTokenParams{
+		TokenHash: auth.HashToken(token),
+		UserID:    userID,
+		NewEmail:  newEmail,
+		ExpiresAt: time.Now().Add(emailChangeTTL),
+	}
+	_, err = q.CreateEmailChangeToken(ctx, cectp)
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// Sends the confirmation link to the new address and a heads-up to the current one
+func (cfg *apiConfig) sendEmailChangeMail(ctx context.Context, dbUser database.User, newEmail, token string) error {
+	err := cfg.mailer.Send(ctx, mail.Message{
+		To:      newEmail,
+		Subject: "Confirm your new Chirpy email address",
+		Body: fmt.Sprintf("Use this token within %s to confirm %s as the email of your Chirpy account:\n\n%s\n\n"+
+			"%s/app/confirm-email?token=%s\n",
+			emailChangeTTL, newEmail, token, cfg.baseURL, token),
+	})
+	if err != nil {
+		return err
+	}
+
+	// Let the current address know, in case the change wasn't made by its owner
+	return cfg.mailer.Send(ctx, mail.Message{
+		To:      dbUser.Email,
+		Subject: "Your Chirpy email address is being changed",
+		Body: fmt.Sprintf("A change of your Chirpy account email to %s was requested.\n"+
+			"If this wasn't you, reset your password right away.\n", newEmail),
+	})
+}
+
+func (cfg *apiConfig) confirmEmailHandler(w http.ResponseWriter, req *http.Request) {
+	iConfirm := inputConfirmEmail{}
+	oUser := outputUser{}
+	// Decoding input
 	decoder := json.NewDecoder(req.Body)
-	err = decoder.Decode(&iUser)
+	err := decoder.Decode(&iConfirm)
 	if err != nil {
-		fErr := fmt.Sprintf("Error decoding input: %s", err)
-		respondWithText(w, 500, fErr)
+		respondWithInvalidJSON(w, err)
 		return
 	}
 
-	// Create new hashed password
-	passHashed, err := auth.HashPassword(iUser.Password)
+	tx, err := cfg.sqlDB.BeginTx(req.Context(), nil)
 	if err != nil {
-		fErr := fmt.Sprintf("Error hashing password: %s", err)
-		respondWithText(w, 500, fErr)
+		respondWithInternalError(w, "Could not start transaction", err)
 		return
 	}
+	defer tx.Rollback()
+	qtx := cfg.withTx(tx)
 
-	// Update user
-	uup := database.UpdateUserParams{
-		ID:             authID,
-		Email:          iUser.Email,
-		HashedPassword: passHashed,
+	changeToken, err := qtx.ConsumeEmailChangeToken(req.Context(), auth.HashToken(iConfirm.Token))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			respondWithError(w, 400, "invalid_token", "Confirmation token is invalid or expired")
+			return
+		}
+		respondWithInternalError(w, "Error checking confirmation token", err)
+		return
+	}
+
+	uuep := database.UpdateUserEmailParams{
+		ID:    changeToken.UserID,
+		Email: changeToken.NewEmail,
+	}
+	dbUser, err := qtx.UpdateUserEmail(req.Context(), uuep)
+	if err != nil {
+		// The address may have been taken since the change was requested
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+			respondWithError(w, 409, "email_taken", "Email is already in use")
+			return
+		}
+		respondWithInternalError(w, "Error updating email", err)
+		return
 	}
-	dbUser, err := cfg.db.UpdateUser(req.Context(), uup)
+
+	err = tx.Commit()
 	if err != nil {
-		fErr := fmt.Sprintf("Error creating user: %s", err)
-		respondWithText(w, 500, fErr)
+		respondWithInternalError(w, "Could not commit email change", err)
 		return
 	}
 
@@ -123,19 +348,29 @@ func (cfg *apiConfig) changeUserHandler(w http.ResponseWriter, req *http.Request
 	oUser.UpdatedAt = dbUser.UpdatedAt
 	oUser.Email = dbUser.Email
 	oUser.IsChirpyRed = dbUser.IsChirpyRed
+	oUser.Role = dbUser.Role
 
 	respondWithJSON(w, 200, oUser)
 }
 
 func (cfg *apiConfig) loginHandler(w http.ResponseWriter, req *http.Request) {
 	iUser := inputUser{}
-	oUser := outputUser{}
 	// Decoding input
 	decoder := json.NewDecoder(req.Body)
 	err := decoder.Decode(&iUser)
 	if err != nil {
-		fErr := fmt.Sprintf("Error decoding input: %s", err)
-		respondWithText(w, 500, fErr)
+		respondWithInvalidJSON(w, err)
+		return
+	}
+
+	// Refuse early while the account or client IP is locked
+	wait, err := cfg.loginRetryAfter(req.Context(), accountThrottleKey(iUser.Email), ipThrottleKey(req))
+	if err != nil {
+		respondWithInternalError(w, "Error checking login attempts", err)
+		return
+	}
+	if wait > 0 {
+		respondWithRetryAfter(w, wait)
 		return
 	}
 
@@ -144,29 +379,66 @@ func (cfg *apiConfig) loginHandler(w http.ResponseWriter, req *http.Request) {
 	if err != nil {
 		// Handle not found error
 		if errors.Is(err, sql.ErrNoRows) {
-			respondWithText(w, 401, "Incorrect email or password")
+			cfg.loginFailed(w, req, iUser.Email, nil)
 			return
 		}
-		fErr := fmt.Sprintf("Error fetching user by email: %s", err)
-		respondWithText(w, 500, fErr)
+		respondWithInternalError(w, "Error fetching user by email", err)
 		return
 	}
 
 	// Check if password matches
 	correct, err := auth.CheckPasswordHash(iUser.Password, dbUser.HashedPassword)
 	if err != nil {
-		fErr := fmt.Sprintf("Error checking password: %s", err)
-		respondWithText(w, 500, fErr)
+		respondWithInternalError(w, "Error checking password", err)
 		return
 	}
 	if !correct {
-		respondWithText(w, 401, "Incorrect email or password")
+		cfg.loginFailed(w, req, iUser.Email, &dbUser)
+		return
+	}
+
+	// Upgrade old hashes now that we know the plain password
+	if auth.NeedsRehash(dbUser.HashedPassword) {
+		cfg.rehashPassword(req.Context(), dbUser, iUser.Password)
+	}
+
+	cfg.firstFactorPassed(w, req, dbUser)
+}
+
+// After the password (or an external provider) vouched for the user: with 2FA
+// enabled the tokens are only issued by mfaLoginHandler, otherwise right away
+func (cfg *apiConfig) firstFactorPassed(w http.ResponseWriter, req *http.Request, dbUser database.User) {
+	mfaEnabled, err := cfg.totpEnabled(req.Context(), dbUser.ID)
+	if err != nil {
+		respondWithInternalError(w, "Error checking two-factor authentication", err)
+		return
+	}
+	if mfaEnabled {
+		mfaToken, err := auth.MakeMFAToken(dbUser.ID, cfg.jwt, cfg.tokenPolicy)
+		if err != nil {
+			respondWithInternalError(w, "Could not generate MFA token", err)
+			return
+		}
+		respondWithJSON(w, 200, outputMFAChallenge{MFARequired: true, MFAToken: mfaToken})
+		return
 	}
 
-	token, err := auth.MakeJWT(dbUser.ID, cfg.jwt)
+	cfg.completeLogin(w, req, dbUser)
+}
+
+// Last step of every login, clears failed attempts and issues the JWT and refresh token
+func (cfg *apiConfig) completeLogin(w http.ResponseWriter, req *http.Request, dbUser database.User) {
+	oUser := outputUser{}
+
+	err := cfg.db.ClearLoginThrottle(req.Context(), accountThrottleKey(dbUser.Email))
 	if err != nil {
-		fErr := fmt.Sprintf("Could not generate JWT token: %s", err)
-		respondWithText(w, 500, fErr)
+		respondWithInternalError(w, "Could not clear failed logins", err)
+		return
+	}
+
+	token, err := auth.MakeJWT(dbUser.ID, dbUser.Role, cfg.jwt, cfg.tokenPolicy)
+	if err != nil {
+		respondWithInternalError(w, "Could not generate JWT token", err)
 		return
 	}
 
@@ -175,83 +447,216 @@ func (cfg *apiConfig) loginHandler(w http.ResponseWriter, req *http.Request) {
 	oUser.CreatedAt = dbUser.CreatedAt
 	oUser.UpdatedAt = dbUser.UpdatedAt
 	oUser.IsChirpyRed = dbUser.IsChirpyRed
+	oUser.Role = dbUser.Role
 	oUser.Token = token
-	// create refresh token and save it in database, maybe there's a better way to do this?
-	refreshToken, _ := auth.MakeRefreshToken()
-	crtp := database.CreateRefreshTokenParams{
-		Token:     refreshToken,
-		UserID:    oUser.ID,
-		ExpiresAt: time.Now().AddDate(0, 0, 60),
-	}
-	dbRefreshToken, err := cfg.db.CreateRefreshToken(req.Context(), crtp)
+	// create refresh token and save it in database
+	oUser.RefreshToken, err = cfg.createRefreshToken(req.Context(), cfg.db, oUser.ID, newSession(req))
 	if err != nil {
-		fErr := fmt.Sprintf("Could not create refresh token: %s", err)
-		respondWithText(w, 500, fErr)
+		respondWithInternalError(w, "Could not create refresh token", err)
 		return
 	}
-	oUser.RefreshToken = dbRefreshToken.Token
 
 	respondWithJSON(w, 200, oUser)
 }
 
+// Best effort, a failed rehash shouldn't fail the login. Skipped when the
+// password was changed since dbUser was read, the new hash is current anyway.
+func (cfg *apiConfig) rehashPassword(ctx context.Context, dbUser database.User, password string) {
+	passHashed, err := auth.HashPassword(password)
+	if err != nil {
+		slog.ErrorContext(ctx, "Could not rehash password", "user_id", dbUser.ID, "error", err)
+		return
+	}
+	rupp := database.RehashUserPasswordParams{
+		NewHash: passHashed,
+		ID:      dbUser.ID,
+		OldHash: dbUser.HashedPassword,
+	}
+	err = cfg.db.RehashUserPassword(ctx, rupp)
+	if err != nil {
+		slog.ErrorContext(ctx, "Could not save rehashed password", "user_id", dbUser.ID, "error", err)
+	}
+}
+
+// Saves a new refresh token for the user, q can be bound to a transaction.
+// Only the hash is stored, the returned plain token is shown to the client once.
+func (cfg *apiConfig) createRefreshToken(ctx context.Context, q *database.Queries, userID uuid.UUID, session sessionInfo) (string, error) {
+	refreshToken, err := auth.MakeRefreshToken()
+	if err != nil {
+		return "", err
+	}
+	crtp := database.CreateRefreshTokenParams{
+		TokenHash:        auth.HashToken(refreshToken),
+		UserID:           userID,
+		ExpiresAt:        time.Now().Add(cfg.tokenPolicy.Lifetime(auth.ClientFirstParty).Refresh),
+		FamilyID:         session.FamilyID,
+		SessionStartedAt: session.StartedAt,
+		UserAgent:        session.UserAgent,
+		Ip:               session.IP,
+	}
+	_, err = q.CreateRefreshToken(ctx, crtp)
+	if err != nil {
+		return "", err
+	}
+	return refreshToken, nil
+}
+
 func (cfg *apiConfig) refreshHandler(w http.ResponseWriter, req *http.Request) {
 	oToken := outputRefresToken{}
 
 	token, err := auth.GetBearerToken(req.Header)
 	if err != nil {
-		fErr := fmt.Sprintf("Error getting bearer: %s", err)
-		respondWithText(w, 500, fErr)
+		w.Header().Set("WWW-Authenticate", `Bearer realm="chirpy"`)
+		respondWithError(w, 401, codeUnauthorized, "Missing or malformed bearer token")
 		return
 	}
+	tokenHash := auth.HashToken(token)
 
-	dbRefreshToken, err := cfg.db.GetRefreshToken(req.Context(), token)
+	tx, err := cfg.sqlDB.BeginTx(req.Context(), nil)
+	if err != nil {
+		respondWithInternalError(w, "Could not start transaction", err)
+		return
+	}
+	defer tx.Rollback()
+	qtx := cfg.withTx(tx)
+
+	// Every refresh token works once, using it retires it and hands out its successor
+	dbRefreshToken, err := qtx.RotateRefreshToken(req.Context(), tokenHash)
 	if err != nil {
-		// Handle not found error
 		if errors.Is(err, sql.ErrNoRows) {
-			respondWithText(w, 401, "Refresh token not found or expired")
+			cfg.refreshFailed(w, req, tokenHash)
 			return
 		}
-		fErr := fmt.Sprintf("Error getting chirps: %s", err)
-		respondWithText(w, 500, fErr)
+		respondWithInternalError(w, "Error rotating refresh token", err)
+		return
+	}
+
+	oToken.RefreshToken, err = cfg.createRefreshToken(req.Context(), qtx, dbRefreshToken.UserID, continueSession(req, dbRefreshToken))
+	if err != nil {
+		respondWithInternalError(w, "Could not create refresh token", err)
 		return
 	}
-	// Handle Null value
-	if !dbRefreshToken.RevokedAt.Time.IsZero() {
-		respondWithText(w, 401, "Refresh token not found or expired")
+
+	// Create new JWT, with the role as it is now so role changes apply on refresh.
+	// Done before committing, a failure here must leave the old refresh token usable.
+	dbUser, err := qtx.GetUserByID(req.Context(), dbRefreshToken.UserID)
+	if err != nil {
+		respondWithInternalError(w, "Error fetching user", err)
+		return
+	}
+	oToken.Token, err = auth.MakeJWT(dbUser.ID, dbUser.Role, cfg.jwt, cfg.tokenPolicy)
+	if err != nil {
+		respondWithInternalError(w, "Could not generate JWT token", err)
 		return
 	}
 
-	// GetUserFromRefreshToken
-	dbUser, err := cfg.db.GetUserFromRefreshToken(req.Context(), token)
+	err = tx.Commit()
 	if err != nil {
-		fErr := fmt.Sprintf("No user associated with refresh token: %s", err)
-		respondWithText(w, 500, fErr)
+		respondWithInternalError(w, "Could not commit refresh token rotation", err)
 		return
 	}
 
-	// Create new JWT
-	token, err = auth.MakeJWT(dbUser.ID, cfg.jwt)
+	respondWithJSON(w, 200, oToken)
+}
+
+// Works out why a refresh token couldn't be rotated. A token that was already
+// rotated out is being replayed, so it or its successor has leaked: the whole
+// family is revoked and both the thief and the owner have to log in again.
+func (cfg *apiConfig) refreshFailed(w http.ResponseWriter, req *http.Request, tokenHash string) {
+	dbRefreshToken, err := cfg.db.GetRefreshToken(req.Context(), tokenHash)
 	if err != nil {
-		fErr := fmt.Sprintf("Could not generate JWT token: %s", err)
-		respondWithText(w, 500, fErr)
+		if errors.Is(err, sql.ErrNoRows) {
+			respondWithError(w, 401, codeUnauthorized, "Refresh token not found or expired")
+			return
+		}
+		respondWithInternalError(w, "Error getting refresh token", err)
 		return
 	}
 
-	oToken.Token = token
+	if dbRefreshToken.RotatedAt.Valid {
+		err = cfg.db.RevokeRefreshTokenFamily(req.Context(), dbRefreshToken.FamilyID)
+		if err != nil {
+			respondWithInternalError(w, "Could not revoke refresh token family", err)
+			return
+		}
+		details := fmt.Sprintf("family %s, token rotated at %s", dbRefreshToken.FamilyID, dbRefreshToken.RotatedAt.Time.Format(time.RFC3339))
+		cfg.logSecurityEvent(req, dbRefreshToken.UserID, securityEventRefreshReuse, details)
+	}
 
-	respondWithJSON(w, 200, oToken)
+	respondWithError(w, 401, codeUnauthorized, "Refresh token not found or expired")
 }
 
 func (cfg *apiConfig) revokeHandler(w http.ResponseWriter, req *http.Request) {
 	bearer, err := auth.GetBearerToken(req.Header)
 	if err != nil {
-		fErr := fmt.Sprintf("Error getting bearer: %s", err)
-		respondWithText(w, 500, fErr)
+		w.Header().Set("WWW-Authenticate", `Bearer realm="chirpy"`)
+		respondWithError(w, 401, codeUnauthorized, "Missing or malformed bearer token")
 		return
 	}
 
 	// Revoke the token, setting the time to current timestamp is done in database, is that ok?
-	cfg.db.RevokeRefreshToken(req.Context(), bearer)
+	cfg.db.RevokeRefreshToken(req.Context(), auth.HashToken(bearer))
 
 	respondWithText(w, 204, "")
 }
+
+func (cfg *apiConfig) getMeHandler(w http.ResponseWriter, req *http.Request) {
+	oUser := outputUser{}
+
+	dbUser, err := cfg.db.GetUserByID(req.Context(), authUserID(req))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			respondWithError(w, 401, codeUnauthorized, "User no longer exists")
+			return
+		}
+		respondWithInternalError(w, "Error fetching user", err)
+		return
+	}
+
+	oUser.ID = dbUser.ID
+	oUser.CreatedAt = dbUser.CreatedAt
+	oUser.UpdatedAt = dbUser.UpdatedAt
+	oUser.Email = dbUser.Email
+	oUser.IsChirpyRed = dbUser.IsChirpyRed
+	oUser.Role = dbUser.Role
+
+	respondWithJSON(w, 200, oUser)
+}
+
+type outputSubscription struct {
+	ID                 uuid.UUID `json:"id"`
+	Status             string    `json:"status"`
+	IsChirpyRed        bool      `json:"is_chirpy_red"`
+	CurrentPeriodStart time.Time `json:"current_period_start"`
+	// Unknown for backfilled members, until a renewal
+	CurrentPeriodEnd *time.Time `json:"current_period_end"`
+	EndedAt          *time.Time `json:"ended_at"`
+}
+
+// The caller's latest Chirpy Red subscription, ended ones included
+func (cfg *apiConfig) getSubscriptionHandler(w http.ResponseWriter, req *http.Request) {
+	oSubscription := outputSubscription{}
+
+	subscription, err := cfg.db.GetCurrentSubscription(req.Context(), authUserID(req))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			respondWithError(w, 404, codeNotFound, "No Chirpy Red subscription")
+			return
+		}
+		respondWithInternalError(w, "Error fetching subscription", err)
+		return
+	}
+
+	oSubscription.ID = subscription.ID
+	oSubscription.Status = subscription.Status
+	oSubscription.IsChirpyRed = subscriptionLive(subscription.Status)
+	oSubscription.CurrentPeriodStart = subscription.CurrentPeriodStart
+	if subscription.Source != subscriptionSourceBackfill {
+		oSubscription.CurrentPeriodEnd = &subscription.CurrentPeriodEnd
+	}
+	if subscription.EndedAt.Valid {
+		oSubscription.EndedAt = &subscription.EndedAt.Time
+	}
+
+	respondWithJSON(w, 200, oSubscription)
+}
@@ -0,0 +1,374 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pauslik/chirpy/internal/auth"
+	"github.com/pauslik/chirpy/internal/database"
+)
+
+type inputWebhookEndpoint struct {
+	URL    string   `json:"url"`
+	Events []string `json:"events"`
+}
+
+type outputWebhookEndpoint struct {
+	ID        uuid.UUID `json:"id"`
+	ClientID  uuid.UUID `json:"client_id"`
+	URL       string    `json:"url"`
+	Events    []string  `json:"events"`
+	CreatedAt time.Time `json:"created_at"`
+	// Only returned on registration, used to verify the Chirpy-Signature header
+	Secret string `json:"secret,omitempty"`
+}
+
+type outputWebhookDeliveryAttempt struct {
+	AttemptedAt    time.Time `json:"attempted_at"`
+	DurationMs     int32     `json:"duration_ms"`
+	ResponseStatus int32     `json:"response_status,omitempty"`
+	Error          string    `json:"error,omitempty"`
+}
+
+type outputWebhookDelivery struct {
+	ID            uuid.UUID                      `json:"id"`
+	EventID       uuid.UUID                      `json:"event_id"`
+	Event         string                         `json:"event"`
+	Status        string                         `json:"status"`
+	Attempts      int32                          `json:"attempts"`
+	NextAttemptAt *time.Time                     `json:"next_attempt_at,omitempty"`
+	CreatedAt     time.Time                      `json:"created_at"`
+	DeliveredAt   *time.Time                     `json:"delivered_at,omitempty"`
+	Payload       json.RawMessage                `json:"payload,omitempty"`
+	AttemptLog    []outputWebhookDeliveryAttempt `json:"attempt_log,omitempty"`
+}
+
+const (
+	maxWebhookEndpoints         = 10
+	defaultWebhookDeliveryLimit = 50
+	maxWebhookDeliveryLimit     = 500
+)
+
+func toOutputWebhookEndpoint(endpoint database.WebhookEndpoint) outputWebhookEndpoint {
+	oEndpoint := outputWebhookEndpoint{}
+	oEndpoint.ID = endpoint.ID
+	oEndpoint.ClientID = endpoint.ClientID
+	oEndpoint.URL = endpoint.Url
+	oEndpoint.Events = endpoint.Events
+	oEndpoint.CreatedAt = endpoint.CreatedAt
+	return oEndpoint
+}
+
+func toOutputWebhookDelivery(delivery database.WebhookDelivery) outputWebhookDelivery {
+	oDelivery := outputWebhookDelivery{}
+	oDelivery.ID = delivery.ID
+	oDelivery.EventID = delivery.EventID
+	oDelivery.Event = delivery.Event
+	oDelivery.Status = delivery.Status
+	oDelivery.Attempts = delivery.Attempts
+	oDelivery.CreatedAt = delivery.CreatedAt
+	// Only meaningful while the delivery still waits for an attempt
+	if delivery.Status == deliveryPending || delivery.Status == deliveryFailed {
+		oDelivery.NextAttemptAt = &delivery.NextAttemptAt
+	}
+	if delivery.DeliveredAt.Valid {
+		oDelivery.DeliveredAt = &delivery.DeliveredAt.Time
+	}
+	return oDelivery
+}
+
+// Absolute https URLs, the signature is all that protects the payload otherwise
+func validWebhookURL(raw string) bool {
+	u, err := url.Parse(raw)
+	if err != nil || u.Fragment != "" || u.Host == "" || u.User != nil {
+		return false
+	}
+	return u.Scheme == "https"
+}
+
+// Looks up the client from the path for its owner. Someone else's client looks
+// the same as a missing one. Responds and reports false on failure.
+func (cfg *apiConfig) ownedOauthClient(w http.ResponseWriter, req *http.Request) (database.OauthClient, bool) {
+	// Authenticated by middlewareAuth
+	authID := authUserID(req)
+
+	clientID, err := uuid.Parse(req.PathValue("clientID"))
+	if err != nil {
+		respondWithInvalidID(w, "client")
+		return database.OauthClient{}, false
+	}
+	client, err := cfg.db.GetOauthClient(req.Context(), clientID)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && client.UserID != authID) {
+		respondWithError(w, 404, codeNotFound, "Client not found")
+		return database.OauthClient{}, false
+	}
+	if err != nil {
+		respondWithInternalError(w, "Error getting client", err)
+		return database.OauthClient{}, false
+	}
+	return client, true
+}
+
+// Same for an endpoint of one of the user's clients
+func (cfg *apiConfig) ownedWebhookEndpoint(w http.ResponseWriter, req *http.Request) (database.WebhookEndpoint, bool) {
+	client, ok := cfg.ownedOauthClient(w, req)
+	if !ok {
+		return database.WebhookEndpoint{}, false
+	}
+
+	endpointID, err := uuid.Parse(req.PathValue("webhookID"))
+	if err != nil {
+		respondWithInvalidID(w, "webhook")
+		return database.WebhookEndpoint{}, false
+	}
+	endpoint, err := cfg.db.GetWebhookEndpoint(req.Context(), endpointID)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && endpoint.ClientID != client.ID) {
+		respondWithError(w, 404, codeNotFound, "Webhook not found")
+		return database.WebhookEndpoint{}, false
+	}
+	if err != nil {
+		respondWithInternalError(w, "Error getting webhook", err)
+		return database.WebhookEndpoint{}, false
+	}
+	return endpoint, true
+}
+
+func (cfg *apiConfig) createWebhookEndpointHandler(w http.ResponseWriter, req *http.Request) {
+	iEndpoint := inputWebhookEndpoint{}
+	client, ok := cfg.ownedOauthClient(w, req)
+	if !ok {
+		return
+	}
+
+	// Decoding input
+	decoder := json.NewDecoder(req.Body)
+	err := decoder.Decode(&iEndpoint)
+	if err != nil {
+		respondWithInvalidJSON(w, err)
+		return
+	}
+
+	var fields []fieldError
+	if !validWebhookURL(iEndpoint.URL) {
+		fields = append(fields, fieldError{Field: "url", Code: "invalid_url", Detail: "Webhook URL must be an absolute https URL"})
+	}
+	if len(iEndpoint.Events) == 0 {
+		fields = append(fields, fieldError{Field: "events", Code: "required", Detail: "At least one event is required"})
+	}
+	for i, event := range iEndpoint.Events {
+		if !validWebhookEvent(event) {
+			fields = append(fields, fieldError{Field: fmt.Sprintf("events[%d]", i), Code: "invalid_event", Detail: fmt.Sprintf("Unknown event %q", event)})
+		}
+	}
+	if len(fields) > 0 {
+		respondWithValidation(w, fields...)
+		return
+	}
+
+	existing, err := cfg.db.GetClientWebhookEndpoints(req.Context(), client.ID)
+	if err != nil {
+		respondWithInternalError(w, "Error getting webhooks", err)
+		return
+	}
+	if len(existing) >= maxWebhookEndpoints {
+		respondWithError(w, 409, "too_many_webhooks", fmt.Sprintf("Clients can have up to %d webhooks", maxWebhookEndpoints))
+		return
+	}
+
+	// Kept as is, it's needed to sign every delivery
+	secret, err := auth.MakeOpaqueToken()
+	if err != nil {
+		respondWithInternalError(w, "Could not create webhook secret", err)
+		return
+	}
+	cwep := database.CreateWebhookEndpointParams{
+		ClientID: client.ID,
+		Url:      iEndpoint.URL,
+		Secret:   secret,
+		Events:   iEndpoint.Events,
+	}
+	endpoint, err := cfg.db.CreateWebhookEndpoint(req.Context(), cwep)
+	if err != nil {
+		respondWithInternalError(w, "Could not store webhook", err)
+		return
+	}
+
+	oEndpoint := toOutputWebhookEndpoint(endpoint)
+	oEndpoint.Secret = secret
+	respondWithJSON(w, 201, oEndpoint)
+}
+
+func (cfg *apiConfig) getWebhookEndpointsHandler(w http.ResponseWriter, req *http.Request) {
+	endpoints := []outputWebhookEndpoint{}
+	client, ok := cfg.ownedOauthClient(w, req)
+	if !ok {
+		return
+	}
+
+	dbEndpoints, err := cfg.db.GetClientWebhookEndpoints(req.Context(), client.ID)
+	if err != nil {
+		respondWithInternalError(w, "Error getting webhooks", err)
+		return
+	}
+	for _, endpoint := range dbEndpoints {
+		endpoints = append(endpoints, toOutputWebhookEndpoint(endpoint))
+	}
+
+	respondWithJSON(w, 200, endpoints)
+}
+
+// Deleting an endpoint also deletes its deliveries, pending ones are never sent
+func (cfg *apiConfig) deleteWebhookEndpointHandler(w http.ResponseWriter, req *http.Request) {
+	endpoint, ok := cfg.ownedWebhookEndpoint(w, req)
+	if !ok {
+		return
+	}
+
+	dwep := database.DeleteWebhookEndpointParams{
+		ID:       endpoint.ID,
+		ClientID: endpoint.ClientID,
+	}
+	_, err := cfg.db.DeleteWebhookEndpoint(req.Context(), dwep)
+	if err != nil {
+		respondWithInternalError(w, "Could not delete webhook", err)
+		return
+	}
+
+	respondWithText(w, 204, "")
+}
+
+// Newest first, without payloads
+func (cfg *apiConfig) getWebhookDeliveriesHandler(w http.ResponseWriter, req *http.Request) {
+	deliveries := []outputWebhookDelivery{}
+	endpoint, ok := cfg.ownedWebhookEndpoint(w, req)
+	if !ok {
+		return
+	}
+
+	limit := defaultWebhookDeliveryLimit
+	if rawLimit := req.URL.Query().Get("limit"); rawLimit != "" {
+		var err error
+		limit, err = strconv.Atoi(rawLimit)
+		if err != nil || limit < 1 || limit > maxWebhookDeliveryLimit {
+			respondWithValidation(w, fieldError{Field: "limit", Code: "out_of_range", Detail: fmt.Sprintf("Limit must be between 1 and %d", maxWebhookDeliveryLimit)})
+			return
+		}
+	}
+
+	gewdp := database.GetEndpointWebhookDeliveriesParams{
+		EndpointID: endpoint.ID,
+		Limit:      int32(limit),
+	}
+	dbDeliveries, err := cfg.db.GetEndpointWebhookDeliveries(req.Context(), gewdp)
+	if err != nil {
+		respondWithInternalError(w, "Error getting deliveries", err)
+		return
+	}
+	for _, delivery := range dbDeliveries {
+		deliveries = append(deliveries, toOutputWebhookDelivery(delivery))
+	}
+
+	respondWithJSON(w, 200, deliveries)
+}
+
+// One delivery with its payload and the log of every attempt
+func (cfg *apiConfig) getWebhookDeliveryHandler(w http.ResponseWriter, req *http.Request) {
+	endpoint, ok := cfg.ownedWebhookEndpoint(w, req)
+	if !ok {
+		return
+	}
+
+	deliveryID, err := uuid.Parse(req.PathValue("deliveryID"))
+	if err != nil {
+		respondWithInvalidID(w, "delivery")
+		return
+	}
+	gwdp := database.GetWebhookDeliveryParams{
+		ID:         deliveryID,
+		EndpointID: endpoint.ID,
+	}
+	delivery, err := cfg.db.GetWebhookDelivery(req.Context(), gwdp)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			respondWithError(w, 404, codeNotFound, "Delivery not found")
+			return
+		}
+		respondWithInternalError(w, "Error getting delivery", err)
+		return
+	}
+	attempts, err := cfg.db.GetWebhookDeliveryAttempts(req.Context(), delivery.ID)
+	if err != nil {
+		respondWithInternalError(w, "Error getting delivery attempts", err)
+		return
+	}
+
+	oDelivery := toOutputWebhookDelivery(delivery)
+	oDelivery.Payload = json.RawMessage(delivery.Payload)
+	oDelivery.AttemptLog = []outputWebhookDeliveryAttempt{}
+	for _, attempt := range attempts {
+		oDelivery.AttemptLog = append(oDelivery.AttemptLog, outputWebhookDeliveryAttempt{
+			AttemptedAt:    attempt.AttemptedAt,
+			DurationMs:     attempt.DurationMs,
+			ResponseStatus: attempt.ResponseStatus.Int32,
+			Error:          attempt.Error.String,
+		})
+	}
+	respondWithJSON(w, 200, oDelivery)
+}
+
+// Sends the delivery again with a fresh set of attempts, delivered and dead
+// ones alike. The payload and event ID stay the same.
+func (cfg *apiConfig) redeliverWebhookDeliveryHandler(w http.ResponseWriter, req *http.Request) {
+	endpoint, ok := cfg.ownedWebhookEndpoint(w, req)
+	if !ok {
+		return
+	}
+
+	deliveryID, err := uuid.Parse(req.PathValue("deliveryID"))
+	if err != nil {
+		respondWithInvalidID(w, "delivery")
+		return
+	}
+	gwdp := database.GetWebhookDeliveryParams{
+		ID:         deliveryID,
+		EndpointID: endpoint.ID,
+	}
+	delivery, err := cfg.db.GetWebhookDelivery(req.Context(), gwdp)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			respondWithError(w, 404, codeNotFound, "Delivery not found")
+			return
+		}
+		respondWithInternalError(w, "Error getting delivery", err)
+		return
+	}
+	if delivery.Status == deliveryDelivering {
+		respondWithError(w, 409, "delivery_in_progress", "Delivery is being sent right now")
+		return
+	}
+
+	rwdp := database.RedeliverWebhookDeliveryParams{
+		ID:         delivery.ID,
+		EndpointID: endpoint.ID,
+	}
+	delivery, err = cfg.db.RedeliverWebhookDelivery(req.Context(), rwdp)
+	if err != nil {
+		// Claimed by the worker in the meantime
+		if errors.Is(err, sql.ErrNoRows) {
+			respondWithError(w, 409, "delivery_in_progress", "Delivery is being sent right now")
+			return
+		}
+		respondWithInternalError(w, "Could not redeliver", err)
+		return
+	}
+	cfg.wakeDeliveryWorker()
+
+	respondWithJSON(w, 202, toOutputWebhookDelivery(delivery))
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pauslik/chirpy/internal/database"
+)
+
+type outputWebhookEvent struct {
+	ID            uuid.UUID       `json:"id"`
+	Source        string          `json:"source"`
+	EventID       string          `json:"event_id"`
+	Event         string          `json:"event"`
+	Status        string          `json:"status"`
+	Attempts      int32           `json:"attempts"`
+	LastError     string          `json:"last_error,omitempty"`
+	NextAttemptAt *time.Time      `json:"next_attempt_at,omitempty"`
+	ReceivedAt    time.Time       `json:"received_at"`
+	ProcessedAt   *time.Time      `json:"processed_at,omitempty"`
+	Payload       json.RawMessage `json:"payload,omitempty"`
+}
+
+const (
+	defaultWebhookEventsLimit = 50
+	maxWebhookEventsLimit     = 500
+)
+
+func toOutputWebhookEvent(event database.WebhookEvent) outputWebhookEvent {
+	oEvent := outputWebhookEvent{}
+	oEvent.ID = event.ID
+	oEvent.Source = event.Source
+	oEvent.EventID = event.EventID
+	oEvent.Event = event.Event
+	oEvent.Status = event.Status
+	oEvent.Attempts = event.Attempts
+	oEvent.LastError = event.LastError.String
+	oEvent.ReceivedAt = event.ReceivedAt
+	// Only meaningful while the event still waits for an attempt
+	if event.Status == webhookPending || event.Status == webhookFailed {
+		oEvent.NextAttemptAt = &event.NextAttemptAt
+	}
+	if event.ProcessedAt.Valid {
+		oEvent.ProcessedAt = &event.ProcessedAt.Time
+	}
+	return oEvent
+}
+
+// Newest first, ?status=dead to find events waiting for a replay
+func (cfg *apiConfig) getWebhookEventsHandler(w http.ResponseWriter, req *http.Request) {
+	events := []outputWebhookEvent{}
+
+	limit := defaultWebhookEventsLimit
+	if rawLimit := req.URL.Query().Get("limit"); rawLimit != "" {
+		var err error
+		limit, err = strconv.Atoi(rawLimit)
+		if err != nil || limit < 1 || limit > maxWebhookEventsLimit {
+			respondWithValidation(w, fieldError{Field: "limit", Code: "out_of_range", Detail: fmt.Sprintf("Limit must be between 1 and %d", maxWebhookEventsLimit)})
+			return
+		}
+	}
+
+	var dbEvents []database.WebhookEvent
+	var err error
+	if status := req.URL.Query().Get("status"); status != "" {
+		lwebsp := database.ListWebhookEventsByStatusParams{
+			Status: status,
+			Limit:  int32(limit),
+		}
+		dbEvents, err = cfg.db.ListWebhookEventsByStatus(req.Context(), lwebsp)
+	} else {
+		dbEvents, err = cfg.db.ListWebhookEvents(req.Context(), int32(limit))
+	}
+	if err != nil {
+		respondWithInternalError(w, "Error getting webhook events", err)
+		return
+	}
+	for _, event := range dbEvents {
+		events = append(events, toOutputWebhookEvent(event))
+	}
+
+	respondWithJSON(w, 200, events)
+}
+
+// One event with the payload as it was received
+func (cfg *apiConfig) getWebhookEventHandler(w http.ResponseWriter, req *http.Request) {
+	eventID, err := uuid.Parse(req.PathValue("eventID"))
+	if err != nil {
+		respondWithInvalidID(w, "event")
+		return
+	}
+
+	event, err := cfg.db.GetWebhookEvent(req.Context(), eventID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			respondWithError(w, 404, codeNotFound, "Webhook event not found")
+			return
+		}
+		respondWithInternalError(w, "Error getting webhook event", err)
+		return
+	}
+
+	oEvent := toOutputWebhookEvent(event)
+	if json.Valid([]byte(event.Payload)) {
+		oEvent.Payload = json.RawMessage(event.Payload)
+	}
+	respondWithJSON(w, 200, oEvent)
+}
+
+// Queues the event again with a fresh set of attempts, dead-lettered and
+// already processed events alike
+func (cfg *apiConfig) replayWebhookEventHandler(w http.ResponseWriter, req *http.Request) {
+	eventID, err := uuid.Parse(req.PathValue("eventID"))
+	if err != nil {
+		respondWithInvalidID(w, "event")
+		return
+	}
+
+	event, err := cfg.db.GetWebhookEvent(req.Context(), eventID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			respondWithError(w, 404, codeNotFound, "Webhook event not found")
+			return
+		}
+		respondWithInternalError(w, "Error getting webhook event", err)
+		return
+	}
+	if event.Status == webhookProcessing {
+		respondWithError(w, 409, "event_processing", "Event is being processed right now")
+		return
+	}
+	// Applying an event twice would e.g. extend a renewed subscription again
+	if event.Status == webhookProcessed {
+		respondWithError(w, 409, "event_processed", "Event was already processed")
+		return
+	}
+	if event.Payload == "" {
+		respondWithError(w, 409, "no_payload", "Event was received before payloads were stored")
+		return
+	}
+
+	event, err = cfg.db.ReplayWebhookEvent(req.Context(), eventID)
+	if err != nil {
+		// A worker got to it since
+		if errors.Is(err, sql.ErrNoRows) {
+			respondWithError(w, 409, "event_processing", "Event is being processed right now")
+			return
+		}
+		respondWithInternalError(w, "Could not replay webhook event", err)
+		return
+	}
+	cfg.wakeWebhookWorker()
+
+	respondWithJSON(w, 202, toOutputWebhookEvent(event))
+}
@@ -6,24 +6,59 @@ import (
 	"strings"
 
 	"github.com/alexedwards/argon2id"
+	"golang.org/x/crypto/bcrypt"
 )
 
+// Parameters for new password hashes, set from the environment on startup
+var HashParams = &argon2id.Params{
+	Memory:      64 * 1024, // 64 MB
+	Iterations:  3,
+	Parallelism: 2,
+	SaltLength:  16,
+	KeyLength:   32,
+}
+
+// Policy checks are done by PasswordPolicy, this only refuses an empty password
 func HashPassword(password string) (string, error) {
-	// Add checks for password complexity here
-	params := &argon2id.Params{
-		Memory:      64 * 1024, // 64 MB
-		Iterations:  3,
-		Parallelism: 2,
-		SaltLength:  16,
-		KeyLength:   32,
+	if password == "" {
+		return "", errors.New("Password is empty")
 	}
-	return argon2id.CreateHash(password, params)
+	return argon2id.CreateHash(password, HashParams)
 }
 
+// Accepts argon2id hashes and bcrypt hashes imported from other systems
 func CheckPasswordHash(password, hash string) (bool, error) {
+	if isBcrypt(hash) {
+		err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+		if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+			return false, nil
+		}
+		return err == nil, err
+	}
 	return argon2id.ComparePasswordAndHash(password, hash)
 }
 
+// Reports whether a hash should be replaced after a successful login,
+// either because it isn't argon2id or its parameters are weaker than HashParams
+func NeedsRehash(hash string) bool {
+	if isBcrypt(hash) {
+		return true
+	}
+	params, _, _, err := argon2id.DecodeHash(hash)
+	if err != nil {
+		return true
+	}
+	return params.Memory < HashParams.Memory ||
+		params.Iterations < HashParams.Iterations ||
+		params.Parallelism < HashParams.Parallelism ||
+		params.SaltLength < HashParams.SaltLength ||
+		params.KeyLength < HashParams.KeyLength
+}
+
+func isBcrypt(hash string) bool {
+	return strings.HasPrefix(hash, "$2a$") || strings.HasPrefix(hash, "$2b$") || strings.HasPrefix(hash, "$2y$")
+}
+
 func GetBearerToken(headers http.Header) (string, error) {
 	bear := headers.Get("Authorization")
 	split := strings.Split(bear, " ")
@@ -6,6 +6,9 @@ import (
 	"net/http/httptest"
 	"strings"
 	"testing"
+
+	"github.com/alexedwards/argon2id"
+	"golang.org/x/crypto/bcrypt"
 )
 
 func TestHahsing(t *testing.T) {
@@ -30,6 +33,40 @@ func TestHahsing(t *testing.T) {
 	}
 }
 
+func TestRehash(t *testing.T) {
+	pass := "password"
+
+	current, _ := HashPassword(pass)
+	if NeedsRehash(current) {
+		t.Errorf("Hash with current params needs rehash: %s\n", current)
+	}
+
+	weak, _ := argon2id.CreateHash(pass, &argon2id.Params{
+		Memory:      16 * 1024,
+		Iterations:  1,
+		Parallelism: 1,
+		SaltLength:  16,
+		KeyLength:   32,
+	})
+	if !NeedsRehash(weak) {
+		t.Errorf("Hash with weak params doesn't need rehash: %s\n", weak)
+	}
+
+	// Imported bcrypt hashes still log in, and get upgraded
+	imported, _ := bcrypt.GenerateFromPassword([]byte(pass), bcrypt.MinCost)
+	tf, err := CheckPasswordHash(pass, string(imported))
+	if err != nil || !tf {
+		t.Errorf("bcrypt check failed: %v\n", err)
+	}
+	tf, err = CheckPasswordHash("wrong", string(imported))
+	if err != nil || tf {
+		t.Errorf("bcrypt accepted a wrong password: %v\n", err)
+	}
+	if !NeedsRehash(string(imported)) {
+		t.Errorf("bcrypt hash doesn't need rehash\n")
+	}
+}
+
 func TestBearer(t *testing.T) {
 	bad := "OfBadNews"
 	bear := fmt.Sprintf("Bearer %s", bad)
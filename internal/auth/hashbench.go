@@ -0,0 +1,47 @@
+package auth
+
+import (
+	"time"
+
+	"github.com/alexedwards/argon2id"
+)
+
+// Lower bound recommended by OWASP for argon2id (19 MiB, 2 iterations)
+const minBenchMemory = 19 * 1024
+
+// Finds the strongest parameters whose hash time on this host stays under target.
+// Memory is preferred over iterations: start at maxMemory, halve it while a single
+// iteration is too slow, then add iterations while there's time left.
+func SuggestHashParams(target time.Duration, maxMemory uint32, parallelism uint8) (*argon2id.Params, time.Duration) {
+	params := &argon2id.Params{
+		Memory:      maxMemory,
+		Iterations:  1,
+		Parallelism: parallelism,
+		SaltLength:  HashParams.SaltLength,
+		KeyLength:   HashParams.KeyLength,
+	}
+
+	took := timeHash(params)
+	for took > target && params.Memory/2 >= minBenchMemory {
+		params.Memory /= 2
+		took = timeHash(params)
+	}
+
+	for {
+		next := *params
+		next.Iterations++
+		nextTook := timeHash(&next)
+		if nextTook > target {
+			break
+		}
+		params, took = &next, nextTook
+	}
+
+	return params, took
+}
+
+func timeHash(params *argon2id.Params) time.Duration {
+	start := time.Now()
+	argon2id.CreateHash("benchmark password", params)
+	return time.Since(start)
+}
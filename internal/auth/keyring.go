@@ -0,0 +1,343 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	AlgRS256 = "RS256"
+	AlgEdDSA = "EdDSA"
+)
+
+// Key IDs start with the creation time, so sorting them sorts keys by age
+const kidTimeLayout = "20060102T150405Z"
+
+// New keys are published in the JWKS right away but only sign tokens after
+// this delay, so other instances and JWKS caches know them before they're used
+const KeyActivationDelay = 10 * time.Minute
+
+// How often a keyring backed by a directory looks for rotated keys
+const keyringReloadInterval = time.Minute
+
+type SigningKey struct {
+	ID        string
+	Algorithm string
+	Private   crypto.Signer
+	CreatedAt time.Time
+}
+
+// Holds the key used to sign new tokens and every key that may still have
+// signed a live one. Either a single HS256 secret (the JWT_SECRET setup) or a
+// directory of RS256/EdDSA keys, one PKCS#8 PEM file per key named <kid>.pem.
+type Keyring struct {
+	hmacSecret []byte
+
+	dir      string
+	mu       sync.RWMutex
+	keys     map[string]*SigningKey
+	loadedAt time.Time
+}
+
+func NewHMACKeyring(secret string) *Keyring {
+	return &Keyring{hmacSecret: []byte(secret)}
+}
+
+func LoadKeyring(dir string) (*Keyring, error) {
+	k := &Keyring{dir: dir}
+	err := k.reload()
+	if err != nil {
+		return nil, err
+	}
+	if len(k.keys) == 0 {
+		return nil, fmt.Errorf("No signing keys in %s, create one with \"chirpy rotate-jwt-key\"", dir)
+	}
+	return k, nil
+}
+
+func (k *Keyring) reload() error {
+	entries, err := os.ReadDir(k.dir)
+	if err != nil {
+		return err
+	}
+
+	keys := map[string]*SigningKey{}
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), ".pem") {
+			continue
+		}
+		key, err := readSigningKey(filepath.Join(k.dir, e.Name()))
+		if err != nil {
+			return err
+		}
+		keys[key.ID] = key
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.keys = keys
+	k.loadedAt = time.Now()
+	return nil
+}
+
+// Picks up keys added or removed by a rotation on another instance
+func (k *Keyring) maybeReload() {
+	k.mu.RLock()
+	stale := time.Since(k.loadedAt) > keyringReloadInterval
+	k.mu.RUnlock()
+	if stale {
+		// Keep the keys we have if the directory can't be read right now
+		k.reload()
+	}
+}
+
+// Newest key past its activation delay, or the newest key if none is yet
+func (k *Keyring) signingKey() (*SigningKey, error) {
+	k.maybeReload()
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	var newest, active *SigningKey
+	for _, key := range k.keys {
+		if newest == nil || key.CreatedAt.After(newest.CreatedAt) {
+			newest = key
+		}
+		if time.Since(key.CreatedAt) >= KeyActivationDelay && (active == nil || key.CreatedAt.After(active.CreatedAt)) {
+			active = key
+		}
+	}
+	if active != nil {
+		return active, nil
+	}
+	if newest != nil {
+		return newest, nil
+	}
+	return nil, errors.New("No signing key")
+}
+
+func (k *Keyring) verificationKey(kid string) (*SigningKey, bool) {
+	k.maybeReload()
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	key, ok := k.keys[kid]
+	return key, ok
+}
+
+func (k *Keyring) Sign(claims jwt.Claims) (string, error) {
+	if k.hmacSecret != nil {
+		return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(k.hmacSecret)
+	}
+
+	key, err := k.signingKey()
+	if err != nil {
+		return "", err
+	}
+	token := jwt.NewWithClaims(jwt.GetSigningMethod(key.Algorithm), claims)
+	token.Header["kid"] = key.ID
+	return token.SignedString(key.Private)
+}
+
+// Resolves the verification key from the kid header. The algorithm is pinned
+// to the key, so a token can't pick a weaker one (e.g. HS256 with the public key).
+func (k *Keyring) Keyfunc(token *jwt.Token) (any, error) {
+	if k.hmacSecret != nil {
+		if token.Method.Alg() != jwt.SigningMethodHS256.Alg() {
+			return nil, fmt.Errorf("Unexpected signing method %s", token.Method.Alg())
+		}
+		return k.hmacSecret, nil
+	}
+
+	kid, _ := token.Header["kid"].(string)
+	key, ok := k.verificationKey(kid)
+	if !ok {
+		return nil, fmt.Errorf("Unknown key ID %q", kid)
+	}
+	if token.Method.Alg() != key.Algorithm {
+		return nil, fmt.Errorf("Unexpected signing method %s for key %s", token.Method.Alg(), kid)
+	}
+	return key.Private.Public(), nil
+}
+
+// JSON Web Key Set
+
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	// RSA
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+	// Ed25519
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+}
+
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// Public keys for other services, empty for an HMAC keyring since the secret can't be shared
+func (k *Keyring) JWKS() JWKS {
+	set := JWKS{Keys: []JWK{}}
+	if k.hmacSecret != nil {
+		return set
+	}
+
+	k.maybeReload()
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	for _, key := range k.keys {
+		jwk := JWK{Kid: key.ID, Use: "sig", Alg: key.Algorithm}
+		switch pub := key.Private.Public().(type) {
+		case *rsa.PublicKey:
+			jwk.Kty = "RSA"
+			jwk.N = base64.RawURLEncoding.EncodeToString(pub.N.Bytes())
+			jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes())
+		case ed25519.PublicKey:
+			jwk.Kty = "OKP"
+			jwk.Crv = "Ed25519"
+			jwk.X = base64.RawURLEncoding.EncodeToString(pub)
+		}
+		set.Keys = append(set.Keys, jwk)
+	}
+	sort.Slice(set.Keys, func(i, j int) bool { return set.Keys[i].Kid > set.Keys[j].Kid })
+	return set
+}
+
+// Key files
+
+func readSigningKey(path string) (*SigningKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s is not a PEM file", path)
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	kid := strings.TrimSuffix(filepath.Base(path), ".pem")
+	key := &SigningKey{ID: kid}
+	switch priv := parsed.(type) {
+	case *rsa.PrivateKey:
+		key.Algorithm = AlgRS256
+		key.Private = priv
+	case ed25519.PrivateKey:
+		key.Algorithm = AlgEdDSA
+		key.Private = priv
+	default:
+		return nil, fmt.Errorf("%s: unsupported key type %T", path, parsed)
+	}
+
+	// Keys without a timestamp in their ID count as old, i.e. already active
+	stamp, _, _ := strings.Cut(kid, "-")
+	key.CreatedAt, _ = time.Parse(kidTimeLayout, stamp)
+	return key, nil
+}
+
+// Writes a new key to dir and returns its ID
+func GenerateSigningKey(dir, algorithm string) (string, error) {
+	var priv crypto.Signer
+	var err error
+	switch algorithm {
+	case AlgRS256:
+		priv, err = rsa.GenerateKey(rand.Reader, 2048)
+	case AlgEdDSA:
+		_, priv, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		return "", fmt.Errorf("Unsupported algorithm %s, use %s or %s", algorithm, AlgRS256, AlgEdDSA)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return "", err
+	}
+	suffix := make([]byte, 4)
+	_, err = rand.Read(suffix)
+	if err != nil {
+		return "", err
+	}
+	kid := time.Now().UTC().Format(kidTimeLayout) + "-" + hex.EncodeToString(suffix)
+
+	err = os.MkdirAll(dir, 0o700)
+	if err != nil {
+		return "", err
+	}
+	data := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	err = os.WriteFile(filepath.Join(dir, kid+".pem"), data, 0o600)
+	if err != nil {
+		return "", err
+	}
+	return kid, nil
+}
+
+// Deletes all but the newest keep generated keys, returns the removed key IDs.
+// Keep at least two: the active key and the one it replaced, whose tokens are still live.
+// Keys whose ID doesn't start with a timestamp were placed by hand and are left alone.
+func PruneSigningKeys(dir string, keep int) ([]string, error) {
+	matches, err := filepath.Glob(filepath.Join(dir, "*.pem"))
+	if err != nil {
+		return nil, err
+	}
+
+	type generatedKey struct {
+		kid     string
+		created time.Time
+	}
+	keys := []generatedKey{}
+	for _, path := range matches {
+		kid := strings.TrimSuffix(filepath.Base(path), ".pem")
+		stamp, _, _ := strings.Cut(kid, "-")
+		created, err := time.Parse(kidTimeLayout, stamp)
+		if err != nil {
+			continue
+		}
+		keys = append(keys, generatedKey{kid: kid, created: created})
+	}
+	// Newest first, the random suffix breaks ties within a second
+	sort.Slice(keys, func(i, j int) bool {
+		if !keys[i].created.Equal(keys[j].created) {
+			return keys[i].created.After(keys[j].created)
+		}
+		return keys[i].kid > keys[j].kid
+	})
+
+	removed := []string{}
+	for i, key := range keys {
+		if i < keep {
+			continue
+		}
+		err = os.Remove(filepath.Join(dir, key.kid+".pem"))
+		if err != nil {
+			return removed, err
+		}
+		removed = append(removed, key.kid)
+	}
+	return removed, nil
+}
@@ -0,0 +1,105 @@
+package auth
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+)
+
+func TestKeyringSignVerify(t *testing.T) {
+	for _, alg := range []string{AlgEdDSA, AlgRS256} {
+		dir := t.TempDir()
+		kid, err := GenerateSigningKey(dir, alg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys, err := LoadKeyring(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		id := uuid.New()
+		jwtStr, err := MakeJWT(id, RoleUser, keys, DefaultTokenPolicy())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		token, _, err := jwt.NewParser().ParseUnverified(jwtStr, &jwt.RegisteredClaims{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token.Header["kid"] != kid || token.Method.Alg() != alg {
+			t.Errorf("%s: bad header %v\n", alg, token.Header)
+		}
+
+		id2, err := ValidateJWT(jwtStr, keys, DefaultTokenPolicy())
+		if err != nil || id2 != id {
+			t.Errorf("%s: validation failed: %v\n", alg, err)
+		}
+
+		jwks := keys.JWKS()
+		if len(jwks.Keys) != 1 || jwks.Keys[0].Kid != kid || jwks.Keys[0].Alg != alg {
+			t.Errorf("%s: bad JWKS %+v\n", alg, jwks)
+		}
+	}
+}
+
+func TestKeyringRejectsForeignTokens(t *testing.T) {
+	dir := t.TempDir()
+	GenerateSigningKey(dir, AlgEdDSA)
+	keys, _ := LoadKeyring(dir)
+
+	// Signed by a key this keyring doesn't hold
+	otherDir := t.TempDir()
+	GenerateSigningKey(otherDir, AlgEdDSA)
+	other, _ := LoadKeyring(otherDir)
+	foreign, _ := MakeJWT(uuid.New(), RoleUser, other, DefaultTokenPolicy())
+	if _, err := ValidateJWT(foreign, keys, DefaultTokenPolicy()); err == nil {
+		t.Errorf("Token from unknown key accepted\n")
+	}
+
+	// HS256 tokens must not be accepted by an asymmetric keyring
+	hmacToken, _ := MakeJWT(uuid.New(), RoleUser, NewHMACKeyring("secret"), DefaultTokenPolicy())
+	if _, err := ValidateJWT(hmacToken, keys, DefaultTokenPolicy()); err == nil {
+		t.Errorf("HS256 token accepted\n")
+	}
+}
+
+func TestPruneSigningKeys(t *testing.T) {
+	dir := t.TempDir()
+	names := []string{"20250101T000000Z-aaaa", "20250201T000000Z-bbbb", "20250301T000000Z-cccc"}
+	for _, name := range names {
+		os.WriteFile(filepath.Join(dir, name+".pem"), []byte("x"), 0o600)
+	}
+
+	removed, err := PruneSigningKeys(dir, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(removed) != 1 || removed[0] != names[0] {
+		t.Errorf("Expected oldest key removed, got %v\n", removed)
+	}
+}
+
+func TestPruneSigningKeysSkipsHandPlacedKeys(t *testing.T) {
+	dir := t.TempDir()
+	names := []string{"mykey", "20250101T000000Z-aaaa", "20250201T000000Z-bbbb", "20250301T000000Z-cccc"}
+	for _, name := range names {
+		os.WriteFile(filepath.Join(dir, name+".pem"), []byte("x"), 0o600)
+	}
+
+	removed, err := PruneSigningKeys(dir, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(removed) != 1 || removed[0] != "20250101T000000Z-aaaa" {
+		t.Errorf("Expected oldest generated key removed, got %v\n", removed)
+	}
+	_, err = os.Stat(filepath.Join(dir, "mykey.pem"))
+	if err != nil {
+		t.Errorf("Hand-placed key should be kept: %v\n", err)
+	}
+}
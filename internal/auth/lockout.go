@@ -0,0 +1,38 @@
+package auth
+
+import "time"
+
+// Exponential backoff for failed logins. The first FreeAttempts failures are
+// not delayed, then every failure doubles the wait starting at BaseDelay, up
+// to MaxDelay. Reaching LockoutAfter failures locks the key for LockoutFor.
+type LockoutPolicy struct {
+	FreeAttempts int
+	BaseDelay    time.Duration
+	MaxDelay     time.Duration
+	LockoutAfter int
+	LockoutFor   time.Duration
+}
+
+// How long logins are blocked after the given number of consecutive failures
+func (p LockoutPolicy) Delay(failures int) time.Duration {
+	if p.IsLockout(failures) {
+		return p.LockoutFor
+	}
+	if failures <= p.FreeAttempts {
+		return 0
+	}
+
+	delay := p.BaseDelay
+	for i := p.FreeAttempts + 1; i < failures; i++ {
+		delay *= 2
+		if delay >= p.MaxDelay {
+			return p.MaxDelay
+		}
+	}
+	return min(delay, p.MaxDelay)
+}
+
+// Reports whether the failures reached the lockout threshold
+func (p LockoutPolicy) IsLockout(failures int) bool {
+	return p.LockoutAfter > 0 && failures >= p.LockoutAfter
+}
@@ -0,0 +1,42 @@
+package auth
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLockoutDelay(t *testing.T) {
+	policy := LockoutPolicy{
+		FreeAttempts: 3,
+		BaseDelay:    time.Second,
+		MaxDelay:     10 * time.Second,
+		LockoutAfter: 10,
+		LockoutFor:   time.Hour,
+	}
+
+	cases := []struct {
+		failures int
+		delay    time.Duration
+	}{
+		{1, 0},
+		{3, 0},
+		{4, time.Second},
+		{5, 2 * time.Second},
+		{7, 8 * time.Second},
+		{8, 10 * time.Second},
+		{9, 10 * time.Second},
+		{10, time.Hour},
+		{25, time.Hour},
+	}
+
+	for _, c := range cases {
+		delay := policy.Delay(c.failures)
+		if delay != c.delay {
+			t.Errorf("%d failures: expected %s, got %s\n", c.failures, c.delay, delay)
+		}
+	}
+
+	if policy.IsLockout(9) || !policy.IsLockout(10) {
+		t.Errorf("Lockout threshold is off\n")
+	}
+}
@@ -0,0 +1,135 @@
+package auth
+
+import (
+	"bufio"
+	"crypto/sha1"
+	_ "embed"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+)
+
+// Error codes returned to clients when a password is rejected
+type PasswordErrorCode string
+
+const (
+	PasswordTooShort PasswordErrorCode = "password_too_short"
+	PasswordTooLong  PasswordErrorCode = "password_too_long"
+	PasswordCommon   PasswordErrorCode = "password_common"
+	PasswordBreached PasswordErrorCode = "password_breached"
+)
+
+type PasswordError struct {
+	Code    PasswordErrorCode
+	Message string
+}
+
+func (e *PasswordError) Error() string {
+	return e.Message
+}
+
+//go:embed common_passwords.txt
+var commonPasswords string
+
+type PasswordPolicy struct {
+	MinLength int
+	MaxLength int
+	// Lowercased passwords that are always rejected
+	Banned map[string]struct{}
+	// Optional, nil skips the breach check
+	Breached BreachChecker
+}
+
+// Minimum of 8 characters and the bundled list of common passwords
+func DefaultPasswordPolicy() *PasswordPolicy {
+	banned := map[string]struct{}{}
+	for _, line := range strings.Split(commonPasswords, "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" {
+			banned[strings.ToLower(line)] = struct{}{}
+		}
+	}
+	return &PasswordPolicy{
+		MinLength: 8,
+		MaxLength: 256,
+		Banned:    banned,
+	}
+}
+
+// Returns a *PasswordError if the password is not allowed by the policy
+func (p *PasswordPolicy) Check(password string) error {
+	length := utf8.RuneCountInString(password)
+	if length < p.MinLength {
+		return &PasswordError{
+			Code:    PasswordTooShort,
+			Message: fmt.Sprintf("Password must be at least %d characters long", p.MinLength),
+		}
+	}
+	if p.MaxLength > 0 && length > p.MaxLength {
+		return &PasswordError{
+			Code:    PasswordTooLong,
+			Message: fmt.Sprintf("Password must be at most %d characters long", p.MaxLength),
+		}
+	}
+	if _, ok := p.Banned[strings.ToLower(password)]; ok {
+		return &PasswordError{
+			Code:    PasswordCommon,
+			Message: "Password is too common",
+		}
+	}
+	if p.Breached != nil {
+		breached, err := p.Breached.IsBreached(password)
+		if err != nil {
+			return err
+		}
+		if breached {
+			return &PasswordError{
+				Code:    PasswordBreached,
+				Message: "Password has appeared in a data breach",
+			}
+		}
+	}
+	return nil
+}
+
+// Breached password check
+
+type BreachChecker interface {
+	IsBreached(password string) (bool, error)
+}
+
+// Checks passwords against a local copy of the Have I Been Pwned range files.
+// Dir holds one file per 5 character SHA-1 prefix (e.g. "21BD1.txt") with
+// "SUFFIX:COUNT" lines, so only the bucket for the prefix is ever read.
+type HashPrefixDir struct {
+	Dir string
+}
+
+func (h *HashPrefixDir) IsBreached(password string) (bool, error) {
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	prefix, suffix := hash[:5], hash[5:]
+
+	f, err := os.Open(filepath.Join(h.Dir, prefix+".txt"))
+	if err != nil {
+		// No bucket for this prefix means no known breach
+		if errors.Is(err, os.ErrNotExist) {
+			return false, nil
+		}
+		return false, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(strings.TrimSpace(scanner.Text()), ":")
+		if strings.EqualFold(line, suffix) {
+			return true, nil
+		}
+	}
+	return false, scanner.Err()
+}
@@ -0,0 +1,60 @@
+package auth
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPasswordPolicy(t *testing.T) {
+	policy := DefaultPasswordPolicy()
+
+	cases := []struct {
+		password string
+		code     PasswordErrorCode
+	}{
+		{"", PasswordTooShort},
+		{"short", PasswordTooShort},
+		{"password123", PasswordCommon},
+		{"PassWord123", PasswordCommon},
+		{"correct horse battery staple", ""},
+	}
+
+	for _, c := range cases {
+		err := policy.Check(c.password)
+		if c.code == "" {
+			if err != nil {
+				t.Errorf("%q rejected: %s\n", c.password, err)
+			}
+			continue
+		}
+		var pErr *PasswordError
+		if !errors.As(err, &pErr) || pErr.Code != c.code {
+			t.Errorf("%q: expected %s, got %v\n", c.password, c.code, err)
+		}
+	}
+}
+
+func TestHashPrefixDir(t *testing.T) {
+	dir := t.TempDir()
+	// SHA-1 of "hunter2" is F3BBBD66A63D4BF1747940578EC3D0103530E21D
+	bucket := "0018A45C4D1DEF81644B54AB7F969B88D65:1\nD66A63D4BF1747940578EC3D0103530E21D:17043\n"
+	err := os.WriteFile(filepath.Join(dir, "F3BBB.txt"), []byte(bucket), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	policy := &PasswordPolicy{MinLength: 1, Breached: &HashPrefixDir{Dir: dir}}
+
+	var pErr *PasswordError
+	err = policy.Check("hunter2")
+	if !errors.As(err, &pErr) || pErr.Code != PasswordBreached {
+		t.Errorf("Expected breached password, got %v\n", err)
+	}
+
+	err = policy.Check("not in any bucket")
+	if err != nil {
+		t.Errorf("Unexpected error: %s\n", err)
+	}
+}
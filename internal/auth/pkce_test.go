@@ -0,0 +1,31 @@
+package auth
+
+import "testing"
+
+func TestPKCE(t *testing.T) {
+	verifier, err := MakePKCEVerifier()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(verifier) != 43 {
+		t.Errorf("Verifier has %d characters, want 43\n", len(verifier))
+	}
+
+	challenge := PKCEChallenge(verifier)
+	if !VerifyPKCE(verifier, challenge) {
+		t.Errorf("Verifier doesn't match its own challenge\n")
+	}
+
+	other, _ := MakePKCEVerifier()
+	if VerifyPKCE(other, challenge) {
+		t.Errorf("Wrong verifier accepted\n")
+	}
+	if VerifyPKCE("short", PKCEChallenge("short")) {
+		t.Errorf("Too short verifier accepted\n")
+	}
+
+	// Example from RFC 7636 appendix B
+	if PKCEChallenge("dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk") != "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM" {
+		t.Errorf("Challenge doesn't match RFC 7636\n")
+	}
+}
@@ -0,0 +1,24 @@
+package auth
+
+// Roles are ordered, each one can do everything the ones before it can
+const (
+	RoleUser      = "user"
+	RoleModerator = "moderator"
+	RoleAdmin     = "admin"
+)
+
+var roleRank = map[string]int{
+	RoleUser:      1,
+	RoleModerator: 2,
+	RoleAdmin:     3,
+}
+
+func ValidRole(role string) bool {
+	_, ok := roleRank[role]
+	return ok
+}
+
+// Unknown roles rank below every known one
+func RoleAtLeast(role, minimum string) bool {
+	return roleRank[role] >= roleRank[minimum] && ValidRole(role)
+}
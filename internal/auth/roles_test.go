@@ -0,0 +1,22 @@
+package auth
+
+import "testing"
+
+func TestRoleAtLeast(t *testing.T) {
+	cases := []struct {
+		role, minimum string
+		want          bool
+	}{
+		{RoleAdmin, RoleModerator, true},
+		{RoleModerator, RoleModerator, true},
+		{RoleUser, RoleModerator, false},
+		{RoleModerator, RoleAdmin, false},
+		{"", RoleUser, false},
+		{"root", RoleUser, false},
+	}
+	for _, c := range cases {
+		if got := RoleAtLeast(c.role, c.minimum); got != c.want {
+			t.Errorf("RoleAtLeast(%q, %q) = %v, want %v\n", c.role, c.minimum, got, c.want)
+		}
+	}
+}
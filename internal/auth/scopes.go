@@ -0,0 +1,45 @@
+package auth
+
+import "strings"
+
+// Scopes limit what a personal access token can do. Logged in users (JWT) are not limited.
+const (
+	ScopeChirpsWrite = "chirps:write"
+	ScopeProfileRead = "profile:read"
+)
+
+var knownScopes = map[string]struct{}{
+	ScopeChirpsWrite: {},
+	ScopeProfileRead: {},
+}
+
+func ValidScope(scope string) bool {
+	_, ok := knownScopes[scope]
+	return ok
+}
+
+func HasScope(granted []string, scope string) bool {
+	for _, g := range granted {
+		if g == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// Personal access tokens
+
+// Prefix makes tokens recognizable, both for the auth middleware and for secret scanners
+const personalAccessTokenPrefix = "chirpy_pat_"
+
+func MakePersonalAccessToken() (string, error) {
+	token, err := MakeOpaqueToken()
+	if err != nil {
+		return "", err
+	}
+	return personalAccessTokenPrefix + token, nil
+}
+
+func IsPersonalAccessToken(token string) bool {
+	return strings.HasPrefix(token, personalAccessTokenPrefix)
+}
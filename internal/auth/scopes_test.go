@@ -0,0 +1,29 @@
+package auth
+
+import "testing"
+
+func TestScopes(t *testing.T) {
+	if !ValidScope(ScopeChirpsWrite) || ValidScope("chirps:everything") {
+		t.Errorf("Scope validation is off\n")
+	}
+
+	granted := []string{ScopeProfileRead}
+	if !HasScope(granted, ScopeProfileRead) || HasScope(granted, ScopeChirpsWrite) {
+		t.Errorf("Scope check is off\n")
+	}
+}
+
+func TestPersonalAccessToken(t *testing.T) {
+	token, err := MakePersonalAccessToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsPersonalAccessToken(token) {
+		t.Errorf("Token not recognized: %s\n", token)
+	}
+
+	refresh, _ := MakeRefreshToken()
+	if IsPersonalAccessToken(refresh) {
+		t.Errorf("Refresh token taken for a personal access token\n")
+	}
+}
@@ -0,0 +1,54 @@
+package auth
+
+import "time"
+
+// Who a token is issued to, each kind can get its own lifetimes
+type ClientType string
+
+const (
+	// Chirpy's own login and refresh
+	ClientFirstParty ClientType = "first_party"
+	// OAuth apps that authenticate with a client secret
+	ClientConfidential ClientType = "confidential"
+	// OAuth apps that can't keep a secret (mobile, single page)
+	ClientPublic ClientType = "public"
+)
+
+var ClientTypes = []ClientType{ClientFirstParty, ClientConfidential, ClientPublic}
+
+type TokenLifetime struct {
+	Access  time.Duration
+	Refresh time.Duration
+}
+
+// How access tokens are issued and validated
+type TokenPolicy struct {
+	// Put in the aud claim of new tokens and required when validating, so a
+	// token minted by one deployment is rejected by another. Empty skips both.
+	Audience string
+	// Clock skew tolerated on exp, iat and nbf when validating
+	Leeway time.Duration
+	// Client types without an entry use the first party lifetimes
+	Lifetimes map[ClientType]TokenLifetime
+}
+
+// One hour access tokens and 60 day refresh tokens for every client type, one minute of leeway
+func DefaultTokenPolicy() *TokenPolicy {
+	lifetime := TokenLifetime{Access: time.Hour, Refresh: 60 * 24 * time.Hour}
+	return &TokenPolicy{
+		Leeway: time.Minute,
+		Lifetimes: map[ClientType]TokenLifetime{
+			ClientFirstParty:   lifetime,
+			ClientConfidential: lifetime,
+			ClientPublic:       lifetime,
+		},
+	}
+}
+
+func (p *TokenPolicy) Lifetime(clientType ClientType) TokenLifetime {
+	lifetime, ok := p.Lifetimes[clientType]
+	if !ok {
+		return p.Lifetimes[ClientFirstParty]
+	}
+	return lifetime
+}
@@ -2,8 +2,10 @@ package auth
 
 import (
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/hex"
 	"errors"
+	"strings"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
@@ -14,21 +16,103 @@ type TokenType string
 
 const (
 	TokenTypeAccess TokenType = "chirpy-access"
+	// Proves the password step of a two-step login, not valid as an access token
+	TokenTypeMFA TokenType = "chirpy-mfa"
 )
 
+const mfaTokenTTL = 5 * time.Minute
+
 // JSON Web Token
 
-func MakeJWT(userID uuid.UUID, tokenSecret string) (string, error) {
-	utcTime := time.Now().UTC()
-	claims := jwt.RegisteredClaims{
-		Issuer:    string(TokenTypeAccess),
-		IssuedAt:  jwt.NewNumericDate(utcTime),
-		ExpiresAt: jwt.NewNumericDate(utcTime.Add(time.Hour)),
-		Subject:   userID.String(),
+type Claims struct {
+	jwt.RegisteredClaims
+	// Role of the user when the token was issued, changes apply on the next refresh
+	Role string `json:"role,omitempty"`
+	// Set on tokens issued to third-party apps through OAuth, which only get the
+	// space separated scopes the user consented to
+	ClientID string `json:"client_id,omitempty"`
+	Scope    string `json:"scope,omitempty"`
+}
+
+// Verified content of an access token
+type AccessToken struct {
+	ID        uuid.UUID
+	UserID    uuid.UUID
+	Role      string
+	ClientID  string
+	Scopes    []string
+	IssuedAt  time.Time
+	ExpiresAt time.Time
+}
+
+func MakeJWT(userID uuid.UUID, role string, keys *Keyring, policy *TokenPolicy) (string, error) {
+	access := AccessToken{UserID: userID, Role: role}
+	return makeToken(&access, keys, policy, TokenTypeAccess, policy.Lifetime(ClientFirstParty).Access)
+}
+
+// Access token for a third-party app acting for the user, limited to scopes.
+// Returns the token's content as well, its ID is needed to revoke it.
+func MakeClientJWT(userID uuid.UUID, clientID string, clientType ClientType, scopes []string, keys *Keyring, policy *TokenPolicy) (string, AccessToken, error) {
+	access := AccessToken{UserID: userID, Role: RoleUser, ClientID: clientID, Scopes: scopes}
+	signed, err := makeToken(&access, keys, policy, TokenTypeAccess, policy.Lifetime(clientType).Access)
+	return signed, access, err
+}
+
+func ValidateJWT(tokenString string, keys *Keyring, policy *TokenPolicy) (uuid.UUID, error) {
+	claims, err := validateToken(tokenString, keys, policy, TokenTypeAccess)
+	if err != nil {
+		return uuid.Nil, err
 	}
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	return claims.UserID, nil
+}
 
-	signed, err := token.SignedString([]byte(tokenSecret))
+// Like ValidateJWT, with the role and OAuth claims. Tokens issued before roles existed count as RoleUser.
+func ValidateAccessToken(tokenString string, keys *Keyring, policy *TokenPolicy) (AccessToken, error) {
+	claims, err := validateToken(tokenString, keys, policy, TokenTypeAccess)
+	if err != nil {
+		return AccessToken{}, err
+	}
+	if claims.Role == "" {
+		claims.Role = RoleUser
+	}
+	return claims, nil
+}
+
+// Short-lived challenge handed out after the password step when 2FA is enabled
+func MakeMFAToken(userID uuid.UUID, keys *Keyring, policy *TokenPolicy) (string, error) {
+	return makeToken(&AccessToken{UserID: userID}, keys, policy, TokenTypeMFA, mfaTokenTTL)
+}
+
+func ValidateMFAToken(tokenString string, keys *Keyring, policy *TokenPolicy) (uuid.UUID, error) {
+	claims, err := validateToken(tokenString, keys, policy, TokenTypeMFA)
+	if err != nil {
+		return uuid.Nil, err
+	}
+	return claims.UserID, nil
+}
+
+// Signs the token and fills in its ID and times
+func makeToken(access *AccessToken, keys *Keyring, policy *TokenPolicy, tokenType TokenType, expiresIn time.Duration) (string, error) {
+	utcTime := time.Now().UTC()
+	access.ID = uuid.New()
+	access.IssuedAt = utcTime.Truncate(time.Second)
+	access.ExpiresAt = utcTime.Add(expiresIn).Truncate(time.Second)
+	claims := Claims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        access.ID.String(),
+			Issuer:    string(tokenType),
+			IssuedAt:  jwt.NewNumericDate(utcTime),
+			ExpiresAt: jwt.NewNumericDate(utcTime.Add(expiresIn)),
+			Subject:   access.UserID.String(),
+		},
+		Role:     access.Role,
+		ClientID: access.ClientID,
+		Scope:    strings.Join(access.Scopes, " "),
+	}
+	if policy.Audience != "" {
+		claims.Audience = jwt.ClaimStrings{policy.Audience}
+	}
+	signed, err := keys.Sign(claims)
 	if err != nil {
 		return "", err
 	}
@@ -36,33 +120,49 @@ func MakeJWT(userID uuid.UUID, tokenSecret string) (string, error) {
 	return signed, nil
 }
 
-func ValidateJWT(tokenString, tokenSecret string) (uuid.UUID, error) {
-	claimsStruct := jwt.RegisteredClaims{}
-	token, err := jwt.ParseWithClaims(tokenString, &claimsStruct, func(token *jwt.Token) (any, error) {
-		return []byte(tokenSecret), nil
-	})
+func validateToken(tokenString string, keys *Keyring, policy *TokenPolicy, tokenType TokenType) (AccessToken, error) {
+	options := []jwt.ParserOption{jwt.WithExpirationRequired(), jwt.WithLeeway(policy.Leeway)}
+	if policy.Audience != "" {
+		options = append(options, jwt.WithAudience(policy.Audience))
+	}
+	claimsStruct := Claims{}
+	token, err := jwt.ParseWithClaims(tokenString, &claimsStruct, keys.Keyfunc, options...)
 	if err != nil {
-		return uuid.Nil, err
+		return AccessToken{}, err
 	}
 
 	if !token.Valid {
-		return uuid.Nil, errors.New("Invalid token")
+		return AccessToken{}, errors.New("Invalid token")
 	}
 
 	userID := claimsStruct.Subject
 	issuer := claimsStruct.Issuer
 
-	if issuer != string(TokenTypeAccess) {
-		return uuid.Nil, errors.New("Invalid issuer")
+	if issuer != string(tokenType) {
+		return AccessToken{}, errors.New("Invalid issuer")
 	}
 
 	id, err := uuid.Parse(userID)
 
 	if err != nil {
-		return uuid.Nil, err
+		return AccessToken{}, err
 	}
 
-	return id, nil
+	access := AccessToken{
+		UserID:   id,
+		Role:     claimsStruct.Role,
+		ClientID: claimsStruct.ClientID,
+		Scopes:   strings.Fields(claimsStruct.Scope),
+	}
+	// Tokens from before token IDs existed have none
+	access.ID, _ = uuid.Parse(claimsStruct.ID)
+	if claimsStruct.IssuedAt != nil {
+		access.IssuedAt = claimsStruct.IssuedAt.Time
+	}
+	if claimsStruct.ExpiresAt != nil {
+		access.ExpiresAt = claimsStruct.ExpiresAt.Time
+	}
+	return access, nil
 }
 
 // Refresh token
@@ -74,3 +174,20 @@ func MakeRefreshToken() (string, error) {
 	encKey := hex.EncodeToString(key)
 	return encKey, nil
 }
+
+// Single-use tokens (password reset, email confirmation)
+
+func MakeOpaqueToken() (string, error) {
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(key), nil
+}
+
+// Only the hash of an opaque token is stored, so a leaked table can't be replayed
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
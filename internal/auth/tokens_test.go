@@ -1,18 +1,21 @@
 package auth
 
 import (
+	"errors"
 	"fmt"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/golang-jwt/jwt/v5"
 	"github.com/google/uuid"
 )
 
 func TestJWT(t *testing.T) {
 	id, _ := uuid.Parse("52ad359f-88b7-419f-9be0-6632062d5e3e")
-	secret := "TokenSecret"
+	secret := NewHMACKeyring("TokenSecret")
 
-	jwtStr, err := MakeJWT(id, secret)
+	jwtStr, err := MakeJWT(id, RoleUser, secret, DefaultTokenPolicy())
 	if err != nil {
 		fmt.Println(err)
 		t.Fail()
@@ -23,7 +26,7 @@ func TestJWT(t *testing.T) {
 		t.Fail()
 	}
 
-	id2, err := ValidateJWT(jwtStr, secret)
+	id2, err := ValidateJWT(jwtStr, secret, DefaultTokenPolicy())
 	if err != nil {
 		fmt.Println(err)
 		t.Fail()
@@ -34,3 +37,171 @@ func TestJWT(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestHashToken(t *testing.T) {
+	token, err := MakeOpaqueToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if HashToken(token) != HashToken(token) {
+		t.Errorf("Hash is not deterministic\n")
+	}
+	if HashToken(token) == token {
+		t.Errorf("Hash equals the token\n")
+	}
+
+	other, _ := MakeOpaqueToken()
+	if HashToken(token) == HashToken(other) {
+		t.Errorf("Different tokens produced the same hash\n")
+	}
+}
+
+func TestMFAToken(t *testing.T) {
+	id := uuid.New()
+	secret := NewHMACKeyring("TokenSecret")
+
+	mfaStr, err := MakeMFAToken(id, secret, DefaultTokenPolicy())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A challenge token must not work as an access token
+	if _, err := ValidateJWT(mfaStr, secret, DefaultTokenPolicy()); err == nil {
+		t.Errorf("MFA token accepted as access token\n")
+	}
+
+	id2, err := ValidateMFAToken(mfaStr, secret, DefaultTokenPolicy())
+	if err != nil || id2 != id {
+		t.Errorf("Validation failed: %v vs %v (%v)\n", id, id2, err)
+	}
+}
+
+func TestAccessTokenRole(t *testing.T) {
+	id := uuid.New()
+	secret := NewHMACKeyring("TokenSecret")
+
+	jwtStr, err := MakeJWT(id, RoleAdmin, secret, DefaultTokenPolicy())
+	if err != nil {
+		t.Fatal(err)
+	}
+	access, err := ValidateAccessToken(jwtStr, secret, DefaultTokenPolicy())
+	if err != nil || access.UserID != id || access.Role != RoleAdmin {
+		t.Errorf("Validation failed: %+v (%v)\n", access, err)
+	}
+
+	// Tokens from before roles carry no claim
+	jwtStr, _ = MakeJWT(id, "", secret, DefaultTokenPolicy())
+	access, err = ValidateAccessToken(jwtStr, secret, DefaultTokenPolicy())
+	if err != nil || access.Role != RoleUser {
+		t.Errorf("Missing role should default to %s, got %q (%v)\n", RoleUser, access.Role, err)
+	}
+}
+
+func TestClientJWT(t *testing.T) {
+	id := uuid.New()
+	secret := NewHMACKeyring("TokenSecret")
+
+	jwtStr, issued, err := MakeClientJWT(id, "client-1", ClientConfidential, []string{ScopeChirpsWrite, ScopeProfileRead}, secret, DefaultTokenPolicy())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	access, err := ValidateAccessToken(jwtStr, secret, DefaultTokenPolicy())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if access.ID != issued.ID || access.ClientID != "client-1" || access.Role != RoleUser {
+		t.Errorf("Claims don't round trip: %+v vs %+v\n", access, issued)
+	}
+	if !HasScope(access.Scopes, ScopeChirpsWrite) || !HasScope(access.Scopes, ScopeProfileRead) {
+		t.Errorf("Scopes lost: %v\n", access.Scopes)
+	}
+	if !access.ExpiresAt.Equal(issued.ExpiresAt) {
+		t.Errorf("Expiry differs: %v vs %v\n", access.ExpiresAt, issued.ExpiresAt)
+	}
+}
+
+func TestJWTExpiry(t *testing.T) {
+	id := uuid.New()
+	secret := NewHMACKeyring("TokenSecret")
+
+	// Expired 30 seconds ago
+	expired := DefaultTokenPolicy()
+	expired.Lifetimes[ClientFirstParty] = TokenLifetime{Access: -30 * time.Second, Refresh: time.Hour}
+	jwtStr, err := MakeJWT(id, RoleUser, secret, expired)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Within the default minute of leeway
+	if _, err := ValidateJWT(jwtStr, secret, DefaultTokenPolicy()); err != nil {
+		t.Errorf("Token within leeway rejected: %v\n", err)
+	}
+
+	strict := DefaultTokenPolicy()
+	strict.Leeway = 0
+	if _, err := ValidateJWT(jwtStr, secret, strict); !errors.Is(err, jwt.ErrTokenExpired) {
+		t.Errorf("Expired token accepted without leeway: %v\n", err)
+	}
+
+	expired.Lifetimes[ClientFirstParty] = TokenLifetime{Access: -2 * time.Minute, Refresh: time.Hour}
+	jwtStr, _ = MakeJWT(id, RoleUser, secret, expired)
+	if _, err := ValidateJWT(jwtStr, secret, DefaultTokenPolicy()); !errors.Is(err, jwt.ErrTokenExpired) {
+		t.Errorf("Token expired past the leeway accepted: %v\n", err)
+	}
+}
+
+func TestJWTAudience(t *testing.T) {
+	id := uuid.New()
+	secret := NewHMACKeyring("TokenSecret")
+
+	staging := DefaultTokenPolicy()
+	staging.Audience = "https://staging.chirpy.example"
+	production := DefaultTokenPolicy()
+	production.Audience = "https://chirpy.example"
+
+	jwtStr, err := MakeJWT(id, RoleUser, secret, staging)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ValidateJWT(jwtStr, secret, staging); err != nil {
+		t.Errorf("Token rejected by its own deployment: %v\n", err)
+	}
+	// Same signing secret, another deployment
+	if _, err := ValidateJWT(jwtStr, secret, production); !errors.Is(err, jwt.ErrTokenInvalidAudience) {
+		t.Errorf("Token for another audience accepted: %v\n", err)
+	}
+
+	// Tokens without an audience don't pass a deployment that requires one
+	jwtStr, _ = MakeJWT(id, RoleUser, secret, DefaultTokenPolicy())
+	if _, err := ValidateJWT(jwtStr, secret, production); err == nil {
+		t.Errorf("Token without audience accepted\n")
+	}
+}
+
+func TestClientTypeLifetime(t *testing.T) {
+	id := uuid.New()
+	secret := NewHMACKeyring("TokenSecret")
+	policy := DefaultTokenPolicy()
+	policy.Lifetimes[ClientPublic] = TokenLifetime{Access: 5 * time.Minute, Refresh: 24 * time.Hour}
+
+	_, public, err := MakeClientJWT(id, "spa", ClientPublic, []string{ScopeProfileRead}, secret, policy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := public.ExpiresAt.Sub(public.IssuedAt); got > 5*time.Minute+time.Second {
+		t.Errorf("Public client token lives %v\n", got)
+	}
+
+	_, confidential, _ := MakeClientJWT(id, "server", ClientConfidential, []string{ScopeProfileRead}, secret, policy)
+	if got := confidential.ExpiresAt.Sub(confidential.IssuedAt); got < time.Hour-time.Second {
+		t.Errorf("Confidential client token lives %v\n", got)
+	}
+
+	// Client types without lifetimes use the first party ones
+	delete(policy.Lifetimes, ClientConfidential)
+	if policy.Lifetime(ClientConfidential) != policy.Lifetime(ClientFirstParty) {
+		t.Errorf("No fallback to first party lifetimes\n")
+	}
+}
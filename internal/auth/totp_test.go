@@ -0,0 +1,78 @@
+package auth
+
+import (
+	"encoding/base32"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTOTPCode(t *testing.T) {
+	// RFC 6238 appendix B test vectors for SHA-1, last 6 digits
+	secret := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString([]byte("12345678901234567890"))
+
+	cases := []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+	}
+
+	for _, c := range cases {
+		code, err := TOTPCode(secret, TOTPStep(time.Unix(c.unix, 0)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code != c.code {
+			t.Errorf("At %d: expected %s, got %s\n", c.unix, c.code, code)
+		}
+	}
+}
+
+func TestValidateTOTP(t *testing.T) {
+	secret, err := MakeTOTPSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+
+	// Previous step is still accepted
+	code, _ := TOTPCode(secret, TOTPStep(now)-1)
+	step, ok := ValidateTOTP(secret, code, now)
+	if !ok || step != TOTPStep(now)-1 {
+		t.Errorf("Code from previous step rejected\n")
+	}
+
+	code, _ = TOTPCode(secret, TOTPStep(now)-5)
+	if _, ok := ValidateTOTP(secret, code, now); ok {
+		t.Errorf("Old code accepted\n")
+	}
+
+	uri := TOTPURI("Chirpy", "user@example.com", secret)
+	if !strings.HasPrefix(uri, "otpauth://totp/Chirpy:user@example.com?") || !strings.Contains(uri, "secret="+secret) {
+		t.Errorf("Bad URI: %s\n", uri)
+	}
+}
+
+func TestRecoveryCodes(t *testing.T) {
+	codes, err := MakeRecoveryCodes(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := map[string]bool{}
+	for _, code := range codes {
+		if len(code) != 11 || code[5] != '-' {
+			t.Errorf("Bad code format: %s\n", code)
+		}
+		if seen[code] {
+			t.Errorf("Duplicate code: %s\n", code)
+		}
+		seen[code] = true
+		if NormalizeRecoveryCode(strings.ToUpper(strings.ReplaceAll(code, "-", ""))) != code {
+			t.Errorf("Normalize failed for %s\n", code)
+		}
+	}
+}
@@ -7,10 +7,29 @@ package database
 
 import (
 	"context"
+	"time"
 
 	"github.com/google/uuid"
 )
 
+const countUserChirpsSince = `-- name: CountUserChirpsSince :one
+SELECT COUNT(*)
+FROM chirps
+WHERE user_id = $1 AND created_at > $2
+`
+
+type CountUserChirpsSinceParams struct {
+	UserID    uuid.UUID
+	CreatedAt time.Time
+}
+
+func (q *Queries) CountUserChirpsSince(ctx context.Context, arg CountUserChirpsSinceParams) (int64, error) {
+	row := q.db.QueryRowContext(ctx, countUserChirpsSince, arg.UserID, arg.CreatedAt)
+	var count int64
+	err := row.Scan(&count)
+	return count, err
+}
+
 const createChirp = `-- name: CreateChirp :one
 INSERT INTO chirps (id, created_at, updated_at, body, user_id)
 VALUES (
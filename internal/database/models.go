@@ -19,13 +19,137 @@ type Chirp struct {
 	UserID    uuid.UUID
 }
 
-type RefreshToken struct {
-	Token     string
+type EmailChangeToken struct {
+	TokenHash string
+	CreatedAt time.Time
+	UserID    uuid.UUID
+	NewEmail  string
+	ExpiresAt time.Time
+	UsedAt    sql.NullTime
+}
+
+type LoginThrottle struct {
+	Key           string
+	Failures      int32
+	LastFailureAt time.Time
+	LockedUntil   sql.NullTime
+}
+
+type OauthAuthorizationCode struct {
+	CodeHash      string
+	ClientID      uuid.UUID
+	UserID        uuid.UUID
+	RedirectUri   string
+	Scopes        []string
+	CodeChallenge string
+	ExpiresAt     time.Time
+}
+
+type OauthClient struct {
+	ID           uuid.UUID
+	UserID       uuid.UUID
+	Name         string
+	SecretHash   sql.NullString
+	RedirectUris []string
+	Scopes       []string
+	CreatedAt    time.Time
+}
+
+type OauthRefreshToken struct {
+	TokenHash       string
+	ClientID        uuid.UUID
+	UserID          uuid.UUID
+	Scopes          []string
+	CreatedAt       time.Time
+	ExpiresAt       time.Time
+	RevokedAt       sql.NullTime
+	AccessJti       uuid.UUID
+	AccessExpiresAt time.Time
+}
+
+type OauthRevokedAccessToken struct {
+	Jti       uuid.UUID
+	ExpiresAt time.Time
+}
+
+type OidcLoginState struct {
+	StateHash    string
+	Provider     string
+	CodeVerifier string
+	Nonce        string
+	ExpiresAt    time.Time
+}
+
+type PasswordResetToken struct {
+	TokenHash string
 	CreatedAt time.Time
-	UpdatedAt time.Time
 	UserID    uuid.UUID
 	ExpiresAt time.Time
-	RevokedAt sql.NullTime
+	UsedAt    sql.NullTime
+}
+
+type PersonalAccessToken struct {
+	ID         uuid.UUID
+	UserID     uuid.UUID
+	Name       string
+	TokenHash  string
+	Scopes     []string
+	CreatedAt  time.Time
+	LastUsedAt sql.NullTime
+	ExpiresAt  sql.NullTime
+	RevokedAt  sql.NullTime
+}
+
+type RecoveryCode struct {
+	ID        uuid.UUID
+	UserID    uuid.UUID
+	CodeHash  string
+	CreatedAt time.Time
+	UsedAt    sql.NullTime
+}
+
+type RefreshToken struct {
+	TokenHash        string
+	CreatedAt        time.Time
+	UpdatedAt        time.Time
+	UserID           uuid.UUID
+	ExpiresAt        time.Time
+	RevokedAt        sql.NullTime
+	FamilyID         uuid.UUID
+	RotatedAt        sql.NullTime
+	SessionStartedAt time.Time
+	LastUsedAt       time.Time
+	UserAgent        string
+	Ip               string
+}
+
+type SecurityEvent struct {
+	ID        uuid.UUID
+	CreatedAt time.Time
+	UserID    uuid.UUID
+	Event     string
+	Ip        string
+	Details   string
+}
+
+type Subscription struct {
+	ID                 uuid.UUID
+	UserID             uuid.UUID
+	Status             string
+	CurrentPeriodStart time.Time
+	CurrentPeriodEnd   time.Time
+	CreatedAt          time.Time
+	UpdatedAt          time.Time
+	EndedAt            sql.NullTime
+	Source             string
+}
+
+type TotpCredential struct {
+	UserID       uuid.UUID
+	Secret       string
+	CreatedAt    time.Time
+	ConfirmedAt  sql.NullTime
+	LastUsedStep int64
 }
 
 type User struct {
@@ -35,4 +159,73 @@ type User struct {
 	Email          string
 	HashedPassword string
 	IsChirpyRed    bool
+	Role           string
+}
+
+type UserEntitlement struct {
+	UserID    uuid.UUID
+	Name      string
+	Value     string
+	Reason    string
+	GrantedBy uuid.NullUUID
+	ExpiresAt sql.NullTime
+	CreatedAt time.Time
+}
+
+type UserIdentity struct {
+	ID          uuid.UUID
+	UserID      uuid.UUID
+	Provider    string
+	Subject     string
+	Email       string
+	CreatedAt   time.Time
+	LastLoginAt time.Time
+}
+
+type WebhookDelivery struct {
+	ID            uuid.UUID
+	EndpointID    uuid.UUID
+	EventID       uuid.UUID
+	Event         string
+	Payload       string
+	Status        string
+	Attempts      int32
+	NextAttemptAt time.Time
+	CreatedAt     time.Time
+	DeliveredAt   sql.NullTime
+	Traceparent   string
+}
+
+type WebhookDeliveryAttempt struct {
+	ID             uuid.UUID
+	DeliveryID     uuid.UUID
+	AttemptedAt    time.Time
+	DurationMs     int32
+	ResponseStatus sql.NullInt32
+	Error          sql.NullString
+}
+
+type WebhookEndpoint struct {
+	ID        uuid.UUID
+	ClientID  uuid.UUID
+	Url       string
+	Secret    string
+	Events    []string
+	CreatedAt time.Time
+}
+
+type WebhookEvent struct {
+	ID            uuid.UUID
+	Source        string
+	EventID       string
+	Event         string
+	Payload       string
+	Status        string
+	Attempts      int32
+	LastError     sql.NullString
+	NextAttemptAt time.Time
+	ReceivedAt    time.Time
+	ProcessedAt   sql.NullTime
+	Traceparent   string
+	Subject       string
 }
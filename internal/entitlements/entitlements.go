@@ -0,0 +1,129 @@
+package entitlements
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// Plans a user can be on, Chirpy Red members are on PlanRed
+const (
+	PlanFree = "free"
+	PlanRed  = "red"
+)
+
+// Names of the entitlements, also used by admins to grant them
+const (
+	ChirpLength   = "chirp_length"
+	EditWindow    = "edit_window"
+	MediaPerChirp = "media_per_chirp"
+	ChirpsPerHour = "chirps_per_hour"
+	Analytics     = "analytics"
+)
+
+// What a user may do, handlers check these instead of the plan
+type Set struct {
+	// Characters per chirp
+	ChirpLength int
+	// How long after posting a chirp can be edited, zero means never
+	EditWindow time.Duration
+	// Images or videos attached to one chirp
+	MediaPerChirp int
+	// Chirps posted in any hour, zero means unlimited
+	ChirpsPerHour int
+	// Access to statistics on the user's own chirps
+	Analytics bool
+}
+
+var plans = map[string]Set{
+	// Chirp length and the missing hourly limit are what everyone had before plans
+	PlanFree: {
+		ChirpLength:   140,
+		EditWindow:    0,
+		MediaPerChirp: 1,
+		ChirpsPerHour: 0,
+		Analytics:     false,
+	},
+	PlanRed: {
+		ChirpLength:   280,
+		EditWindow:    30 * time.Minute,
+		MediaPerChirp: 4,
+		ChirpsPerHour: 0,
+		Analytics:     true,
+	},
+}
+
+// Unknown plans get the free one
+func ForPlan(plan string) Set {
+	set, ok := plans[plan]
+	if !ok {
+		return plans[PlanFree]
+	}
+	return set
+}
+
+// An individual entitlement overriding the plan, values are in the text form
+// of their type: "280", "15m", "true"
+type Grant struct {
+	Name  string
+	Value string
+}
+
+var ErrUnknownEntitlement = errors.New("unknown entitlement")
+
+// Sets one entitlement from its text value
+func (s *Set) apply(name, value string) error {
+	var err error
+	switch name {
+	case ChirpLength:
+		s.ChirpLength, err = parseCount(value)
+	case EditWindow:
+		s.EditWindow, err = time.ParseDuration(value)
+		if err == nil && s.EditWindow < 0 {
+			err = errors.New("must not be negative")
+		}
+	case MediaPerChirp:
+		s.MediaPerChirp, err = parseCount(value)
+	case ChirpsPerHour:
+		s.ChirpsPerHour, err = parseCount(value)
+	case Analytics:
+		s.Analytics, err = strconv.ParseBool(value)
+	default:
+		return ErrUnknownEntitlement
+	}
+	if err != nil {
+		return fmt.Errorf("invalid value %q for %s: %w", value, name, err)
+	}
+	return nil
+}
+
+func parseCount(value string) (int, error) {
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, err
+	}
+	if n < 0 {
+		return 0, errors.New("must not be negative")
+	}
+	return n, nil
+}
+
+// Checks a grant before it's stored
+func Validate(name, value string) error {
+	var s Set
+	return s.apply(name, value)
+}
+
+// The plan's entitlements with the grants on top. Grants that don't validate,
+// e.g. for an entitlement that was removed, are skipped.
+func Resolve(plan string, grants []Grant) Set {
+	set := ForPlan(plan)
+	for _, grant := range grants {
+		next := set
+		if next.apply(grant.Name, grant.Value) == nil {
+			set = next
+		}
+	}
+	return set
+}
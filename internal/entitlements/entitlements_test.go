@@ -0,0 +1,65 @@
+package entitlements
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestForPlan(t *testing.T) {
+	free := ForPlan(PlanFree)
+	red := ForPlan(PlanRed)
+	if red.ChirpLength <= free.ChirpLength || !red.Analytics || free.Analytics {
+		t.Errorf("Red isn't above free: %+v vs %+v\n", red, free)
+	}
+	if ForPlan("platinum") != free {
+		t.Errorf("Unknown plan should get the free entitlements\n")
+	}
+}
+
+func TestResolve(t *testing.T) {
+	grants := []Grant{
+		{Name: ChirpLength, Value: "500"},
+		{Name: EditWindow, Value: "1h"},
+		{Name: Analytics, Value: "true"},
+		// Skipped, the plan's value stays
+		{Name: MediaPerChirp, Value: "lots"},
+		{Name: "teleport", Value: "true"},
+	}
+	set := Resolve(PlanFree, grants)
+	want := ForPlan(PlanFree)
+	want.ChirpLength = 500
+	want.EditWindow = time.Hour
+	want.Analytics = true
+	if set != want {
+		t.Errorf("Resolve = %+v, want %+v\n", set, want)
+	}
+
+	// Grants can take away too
+	set = Resolve(PlanRed, []Grant{{Name: Analytics, Value: "false"}})
+	if set.Analytics {
+		t.Errorf("Revoking grant not applied\n")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	cases := []struct {
+		name, value string
+		ok          bool
+	}{
+		{ChirpLength, "280", true},
+		{ChirpLength, "-1", false},
+		{EditWindow, "15m", true},
+		{EditWindow, "15", false},
+		{ChirpsPerHour, "0", true},
+		{Analytics, "yes", false},
+	}
+	for _, c := range cases {
+		if err := Validate(c.name, c.value); (err == nil) != c.ok {
+			t.Errorf("Validate(%q, %q) = %v\n", c.name, c.value, err)
+		}
+	}
+	if err := Validate("teleport", "true"); !errors.Is(err, ErrUnknownEntitlement) {
+		t.Errorf("Unknown entitlement: %v\n", err)
+	}
+}
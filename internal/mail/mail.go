@@ -0,0 +1,75 @@
+package mail
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/smtp"
+	"strings"
+
+	"github.com/pauslik/chirpy/internal/tracing"
+	semconv "go.opentelemetry.io/otel/semconv/v1.41.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+type Mailer interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+// SMTP
+
+type SMTPMailer struct {
+	Addr     string
+	From     string
+	Username string
+	Password string
+}
+
+func (m *SMTPMailer) Send(ctx context.Context, msg Message) (err error) {
+	ctx, span := tracing.Start(ctx, "mail.send", trace.SpanKindClient, semconv.ServerAddress(m.Addr))
+	defer func() { tracing.End(span, err) }()
+
+	var auth smtp.Auth
+	if m.Username != "" {
+		host, _, err := net.SplitHostPort(m.Addr)
+		if err != nil {
+			return err
+		}
+		auth = smtp.PlainAuth("", m.Username, m.Password, host)
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "From: %s\r\n", m.From)
+	fmt.Fprintf(&sb, "To: %s\r\n", msg.To)
+	fmt.Fprintf(&sb, "Subject: %s\r\n", msg.Subject)
+	// traceparent of the request that sent the mail, for the mail server's logs
+	traceHeader := http.Header{}
+	tracing.Inject(ctx, traceHeader)
+	for name := range traceHeader {
+		fmt.Fprintf(&sb, "%s: %s\r\n", name, traceHeader.Get(name))
+	}
+	sb.WriteString("MIME-Version: 1.0\r\n")
+	sb.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	sb.WriteString(msg.Body)
+
+	return smtp.SendMail(m.Addr, auth, m.From, []string{msg.To}, []byte(sb.String()))
+}
+
+// Log mailer, used for local development when no SMTP server is configured
+
+type LogMailer struct {
+	W io.Writer
+}
+
+func (m *LogMailer) Send(ctx context.Context, msg Message) error {
+	_, err := fmt.Fprintf(m.W, "--- mail to %s ---\nSubject: %s\n\n%s\n---\n", msg.To, msg.Subject, msg.Body)
+	return err
+}
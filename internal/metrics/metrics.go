@@ -0,0 +1,208 @@
+package metrics
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/pauslik/chirpy/internal/database"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Prometheus metrics of the server, kept in their own registry so tests can
+// create as many as they like
+type Metrics struct {
+	Registry        *prometheus.Registry
+	requests        *prometheus.CounterVec
+	requestDuration *prometheus.HistogramVec
+	responseSize    *prometheus.HistogramVec
+	queryDuration   *prometheus.HistogramVec
+}
+
+// Route label of requests no route matched, so scanners probing random paths
+// don't create a series per path
+const unmatchedRoute = "unmatched"
+
+// Method label of requests with a method outside the standard ones, clients
+// can send any token as method. Named like in the OpenTelemetry conventions.
+const otherMethod = "_OTHER"
+
+// Methods of RFC 9110 and PATCH, recorded as they are
+var knownMethods = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodPost:    true,
+	http.MethodPut:     true,
+	http.MethodPatch:   true,
+	http.MethodDelete:  true,
+	http.MethodConnect: true,
+	http.MethodOptions: true,
+	http.MethodTrace:   true,
+}
+
+// Registers the HTTP and database metrics along with Go runtime and process stats
+func New() *Metrics {
+	m := &Metrics{Registry: prometheus.NewRegistry()}
+	m.requests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "chirpy_http_requests_total",
+		Help: "HTTP requests by method, route pattern and status.",
+	}, []string{"method", "route", "status"})
+	m.requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "chirpy_http_request_duration_seconds",
+		Help:    "Time to serve HTTP requests by method, route pattern and status.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "route", "status"})
+	m.responseSize = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "chirpy_http_response_size_bytes",
+		Help:    "Size of HTTP response bodies by method, route pattern and status.",
+		Buckets: prometheus.ExponentialBuckets(64, 4, 8),
+	}, []string{"method", "route", "status"})
+	m.queryDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "chirpy_db_query_duration_seconds",
+		Help:    "Time to run database queries by sqlc query name and outcome.",
+		Buckets: []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5},
+	}, []string{"query", "outcome"})
+
+	m.Registry.MustRegister(
+		m.requests,
+		m.requestDuration,
+		m.responseSize,
+		m.queryDuration,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	return m
+}
+
+// Exposes a counter kept elsewhere, read on every scrape
+func (m *Metrics) CounterFunc(name, help string, value func() float64) {
+	m.Registry.MustRegister(prometheus.NewCounterFunc(prometheus.CounterOpts{Name: name, Help: help}, value))
+}
+
+// Serves the registry in the Prometheus text format
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.Registry, promhttp.HandlerOpts{Registry: m.Registry})
+}
+
+// Records every request under the pattern of the route that served it. Must
+// wrap the ServeMux, which sets the pattern on the request.
+func (m *Metrics) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		rw := &ResponseWriter{ResponseWriter: w}
+		next.ServeHTTP(rw, req)
+
+		route := req.Pattern
+		if route == "" {
+			route = unmatchedRoute
+		}
+		method := req.Method
+		if !knownMethods[method] {
+			method = otherMethod
+		}
+		labels := prometheus.Labels{
+			"method": method,
+			"route":  route,
+			"status": strconv.Itoa(rw.Status()),
+		}
+		m.requests.With(labels).Inc()
+		m.requestDuration.With(labels).Observe(time.Since(start).Seconds())
+		m.responseSize.With(labels).Observe(float64(rw.Bytes))
+	})
+}
+
+// Remembers the status and body size a handler wrote
+type ResponseWriter struct {
+	http.ResponseWriter
+	status int
+	Bytes  int
+}
+
+func (rw *ResponseWriter) WriteHeader(code int) {
+	if rw.status == 0 {
+		rw.status = code
+	}
+	rw.ResponseWriter.WriteHeader(code)
+}
+
+func (rw *ResponseWriter) Write(b []byte) (int, error) {
+	if rw.status == 0 {
+		rw.status = http.StatusOK
+	}
+	n, err := rw.ResponseWriter.Write(b)
+	rw.Bytes += n
+	return n, err
+}
+
+// 200 when the handler wrote nothing at all, as net/http does
+func (rw *ResponseWriter) Status() int {
+	if rw.status == 0 {
+		return http.StatusOK
+	}
+	return rw.status
+}
+
+// Lets http.ResponseController reach Flush and deadlines of the wrapped writer
+func (rw *ResponseWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
+
+// Times every query run through db, see QueryName
+func (m *Metrics) DB(db database.DBTX) database.DBTX {
+	return &instrumentedDB{db: db, duration: m.queryDuration}
+}
+
+type instrumentedDB struct {
+	db       database.DBTX
+	duration *prometheus.HistogramVec
+}
+
+var queryNameRe = regexp.MustCompile(`^-- name: (\w+)`)
+
+// Name of a sqlc query from the comment sqlc starts it with, "other" for hand-written SQL
+func QueryName(query string) string {
+	match := queryNameRe.FindStringSubmatch(query)
+	if match == nil {
+		return "other"
+	}
+	return match[1]
+}
+
+func (db *instrumentedDB) observe(query string, start time.Time, err error) {
+	outcome := "ok"
+	if err != nil && err != sql.ErrNoRows {
+		outcome = "error"
+	}
+	db.duration.WithLabelValues(QueryName(query), outcome).Observe(time.Since(start).Seconds())
+}
+
+func (db *instrumentedDB) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	start := time.Now()
+	result, err := db.db.ExecContext(ctx, query, args...)
+	db.observe(query, start, err)
+	return result, err
+}
+
+func (db *instrumentedDB) PrepareContext(ctx context.Context, query string) (*sql.Stmt, error) {
+	return db.db.PrepareContext(ctx, query)
+}
+
+func (db *instrumentedDB) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	start := time.Now()
+	rows, err := db.db.QueryContext(ctx, query, args...)
+	db.observe(query, start, err)
+	return rows, err
+}
+
+// Only times the round trip, the row is scanned by the caller
+func (db *instrumentedDB) QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	start := time.Now()
+	row := db.db.QueryRowContext(ctx, query, args...)
+	db.observe(query, start, row.Err())
+	return row
+}
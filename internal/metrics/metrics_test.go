@@ -0,0 +1,91 @@
+package metrics
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func scrape(t *testing.T, m *Metrics) string {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	m.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body, _ := io.ReadAll(rec.Body)
+	return string(body)
+}
+
+func TestMiddlewareRoutePattern(t *testing.T) {
+	m := New()
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/chirps/{chirpID}", func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(404)
+		w.Write([]byte("Chirp not found"))
+	})
+	handler := m.Middleware(mux)
+
+	for _, path := range []string{"/api/chirps/1", "/api/chirps/2", "/wp-login.php"} {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+
+	out := scrape(t, m)
+	// Both chirps under one pattern, not a series per ID
+	want := `chirpy_http_requests_total{method="GET",route="GET /api/chirps/{chirpID}",status="404"} 2`
+	if !strings.Contains(out, want) {
+		t.Errorf("Missing %s in\n%s\n", want, out)
+	}
+	if !strings.Contains(out, `route="unmatched"`) || strings.Contains(out, "wp-login") {
+		t.Errorf("Unmatched path not folded into one route\n")
+	}
+	if !strings.Contains(out, `chirpy_http_response_size_bytes_sum{method="GET",route="GET /api/chirps/{chirpID}",status="404"} 30`) {
+		t.Errorf("Response size not recorded\n")
+	}
+	if !strings.Contains(out, "go_goroutines") {
+		t.Errorf("Go runtime metrics missing\n")
+	}
+}
+
+func TestMiddlewareOtherMethod(t *testing.T) {
+	m := New()
+	handler := m.Middleware(http.NewServeMux())
+
+	for _, method := range []string{"GET", "FOO", "BAR"} {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(method, "/", nil))
+	}
+
+	out := scrape(t, m)
+	// Made up methods share one series
+	want := `chirpy_http_requests_total{method="_OTHER",route="unmatched",status="404"} 2`
+	if !strings.Contains(out, want) {
+		t.Errorf("Missing %s in\n%s\n", want, out)
+	}
+	if !strings.Contains(out, `method="GET"`) || strings.Contains(out, `method="FOO"`) {
+		t.Errorf("Methods not labeled as expected\n")
+	}
+}
+
+func TestResponseWriterDefaultStatus(t *testing.T) {
+	rw := &ResponseWriter{ResponseWriter: httptest.NewRecorder()}
+	if rw.Status() != 200 {
+		t.Errorf("Status without a write %d\n", rw.Status())
+	}
+	rw.Write([]byte("hi"))
+	rw.WriteHeader(500)
+	if rw.Status() != 200 || rw.Bytes != 2 {
+		t.Errorf("Status %d, bytes %d\n", rw.Status(), rw.Bytes)
+	}
+}
+
+func TestQueryName(t *testing.T) {
+	cases := map[string]string{
+		"-- name: CreateChirp :one\nINSERT INTO chirps": "CreateChirp",
+		"-- name: GetUserEntitlements :many\n-- Grants": "GetUserEntitlements",
+		"SELECT 1": "other",
+	}
+	for query, want := range cases {
+		if got := QueryName(query); got != want {
+			t.Errorf("QueryName(%q) = %q, want %q\n", query, got, want)
+		}
+	}
+}
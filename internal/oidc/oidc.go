@@ -0,0 +1,224 @@
+// Package oidc is a small OpenID Connect relying party: discovery, the
+// authorization code flow with PKCE and ID token verification.
+package oidc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/pauslik/chirpy/internal/auth"
+)
+
+// How often the provider metadata and keys are fetched again
+const metadataTTL = time.Hour
+
+type Config struct {
+	// Short name used in URLs, e.g. "google"
+	Name         string
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	// Defaults to openid, email and profile
+	Scopes []string
+}
+
+type metadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// An external identity provider. Metadata is discovered on first use, so a
+// provider being down doesn't keep Chirpy from starting.
+type Provider struct {
+	Config
+	HTTPClient *http.Client
+
+	mu        sync.Mutex
+	meta      *metadata
+	keys      map[string]any
+	fetchedAt time.Time
+}
+
+func NewProvider(cfg Config) *Provider {
+	if len(cfg.Scopes) == 0 {
+		cfg.Scopes = []string{"openid", "email", "profile"}
+	}
+	return &Provider{
+		Config:     cfg,
+		HTTPClient: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Identity from a verified ID token
+type Claims struct {
+	jwt.RegisteredClaims
+	Nonce         string   `json:"nonce"`
+	Email         string   `json:"email"`
+	EmailVerified flexBool `json:"email_verified"`
+}
+
+// Some providers send email_verified as the string "true"
+type flexBool bool
+
+func (b *flexBool) UnmarshalJSON(data []byte) error {
+	*b = flexBool(strings.Trim(string(data), `"`) == "true")
+	return nil
+}
+
+func (c *Claims) Verified() bool {
+	return bool(c.EmailVerified)
+}
+
+func (p *Provider) metadata(ctx context.Context) (*metadata, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.meta != nil && time.Since(p.fetchedAt) < metadataTTL {
+		return p.meta, nil
+	}
+
+	meta := &metadata{}
+	err := p.getJSON(ctx, strings.TrimSuffix(p.Issuer, "/")+"/.well-known/openid-configuration", meta)
+	if err != nil {
+		return nil, fmt.Errorf("discovery: %w", err)
+	}
+	if meta.Issuer != p.Issuer {
+		return nil, fmt.Errorf("discovery: issuer %q doesn't match %q", meta.Issuer, p.Issuer)
+	}
+	keys, err := p.fetchKeys(ctx, meta.JWKSURI)
+	if err != nil {
+		return nil, err
+	}
+
+	p.meta = meta
+	p.keys = keys
+	p.fetchedAt = time.Now()
+	return meta, nil
+}
+
+// URL to send the user to. state and nonce are stored by the caller and
+// checked on the callback, the PKCE verifier stays on our side.
+func (p *Provider) AuthCodeURL(ctx context.Context, redirectURI, state, nonce, verifier string) (string, error) {
+	meta, err := p.metadata(ctx)
+	if err != nil {
+		return "", err
+	}
+	u, err := url.Parse(meta.AuthorizationEndpoint)
+	if err != nil {
+		return "", err
+	}
+	q := u.Query()
+	q.Set("response_type", "code")
+	q.Set("client_id", p.ClientID)
+	q.Set("redirect_uri", redirectURI)
+	q.Set("scope", strings.Join(p.Scopes, " "))
+	q.Set("state", state)
+	q.Set("nonce", nonce)
+	q.Set("code_challenge", auth.PKCEChallenge(verifier))
+	q.Set("code_challenge_method", auth.PKCEMethodS256)
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+type tokenResponse struct {
+	AccessToken string `json:"access_token"`
+	IDToken     string `json:"id_token"`
+	Error       string `json:"error"`
+	Description string `json:"error_description"`
+}
+
+// Trades the code from the callback for tokens and returns the verified ID token claims
+func (p *Provider) Exchange(ctx context.Context, redirectURI, code, verifier, nonce string) (*Claims, error) {
+	meta, err := p.metadata(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", redirectURI)
+	form.Set("code_verifier", verifier)
+	req, err := http.NewRequestWithContext(ctx, "POST", meta.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(p.ClientID), url.QueryEscape(p.ClientSecret))
+
+	resp, err := p.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	tokens := tokenResponse{}
+	err = json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&tokens)
+	if err != nil {
+		return nil, fmt.Errorf("token response: %w", err)
+	}
+	if resp.StatusCode != 200 || tokens.Error != "" {
+		return nil, fmt.Errorf("token endpoint returned %d: %s %s", resp.StatusCode, tokens.Error, tokens.Description)
+	}
+	if tokens.IDToken == "" {
+		return nil, errors.New("token response has no id_token")
+	}
+
+	return p.VerifyIDToken(ctx, tokens.IDToken, nonce)
+}
+
+// Checks signature, issuer, audience, expiry and nonce of an ID token
+func (p *Provider) VerifyIDToken(ctx context.Context, raw, nonce string) (*Claims, error) {
+	_, err := p.metadata(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	claims := &Claims{}
+	_, err = jwt.ParseWithClaims(raw, claims, func(token *jwt.Token) (any, error) {
+		return p.key(ctx, token)
+	},
+		jwt.WithIssuer(p.Issuer),
+		jwt.WithAudience(p.ClientID),
+		jwt.WithExpirationRequired(),
+		jwt.WithValidMethods([]string{"RS256", "ES256", "EdDSA"}),
+		jwt.WithLeeway(time.Minute),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("id token: %w", err)
+	}
+	if claims.Nonce != nonce {
+		return nil, errors.New("id token: nonce mismatch")
+	}
+	if claims.Subject == "" {
+		return nil, errors.New("id token: no subject")
+	}
+	return claims, nil
+}
+
+func (p *Provider) getJSON(ctx context.Context, url string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := p.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("GET %s returned %d", url, resp.StatusCode)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v)
+}
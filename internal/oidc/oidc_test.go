@@ -0,0 +1,105 @@
+package oidc
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/pauslik/chirpy/internal/auth"
+	"github.com/pauslik/chirpy/internal/oidc/oidctest"
+)
+
+const redirectURI = "http://chirpy.test/api/auth/mock/callback"
+
+// Follows the authorization URL like a browser would and returns the code
+func authorize(t *testing.T, authURL, state string) string {
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	resp, err := client.Get(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("Authorize returned %d\n", resp.StatusCode)
+	}
+
+	back, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if back.Query().Get("state") != state {
+		t.Fatalf("State not passed back: %s\n", back)
+	}
+	return back.Query().Get("code")
+}
+
+func TestAuthorizationCodeFlow(t *testing.T) {
+	mock := oidctest.NewProvider("chirpy", "secret")
+	defer mock.Close()
+	mock.User = oidctest.User{Subject: "1234", Email: "user@example.com", EmailVerified: true}
+
+	provider := NewProvider(Config{Name: "mock", Issuer: mock.Issuer(), ClientID: "chirpy", ClientSecret: "secret"})
+	ctx := context.Background()
+
+	verifier, _ := auth.MakePKCEVerifier()
+	authURL, err := provider.AuthCodeURL(ctx, redirectURI, "state1", "nonce1", verifier)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code := authorize(t, authURL, "state1")
+
+	claims, err := provider.Exchange(ctx, redirectURI, code, verifier, "nonce1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.Subject != "1234" || claims.Email != "user@example.com" || !claims.Verified() {
+		t.Errorf("Wrong claims: %+v\n", claims)
+	}
+
+	// Codes work once
+	_, err = provider.Exchange(ctx, redirectURI, code, verifier, "nonce1")
+	if err == nil {
+		t.Errorf("Code accepted twice\n")
+	}
+}
+
+func TestExchangeRejects(t *testing.T) {
+	mock := oidctest.NewProvider("chirpy", "secret")
+	defer mock.Close()
+	mock.User = oidctest.User{Subject: "1234", Email: "user@example.com"}
+
+	provider := NewProvider(Config{Name: "mock", Issuer: mock.Issuer(), ClientID: "chirpy", ClientSecret: "secret"})
+	ctx := context.Background()
+	verifier, _ := auth.MakePKCEVerifier()
+
+	// Another verifier than the one the challenge was made from
+	authURL, _ := provider.AuthCodeURL(ctx, redirectURI, "s", "n", verifier)
+	other, _ := auth.MakePKCEVerifier()
+	if _, err := provider.Exchange(ctx, redirectURI, authorize(t, authURL, "s"), other, "n"); err == nil {
+		t.Errorf("Wrong PKCE verifier accepted\n")
+	}
+
+	// A token minted for another login
+	authURL, _ = provider.AuthCodeURL(ctx, redirectURI, "s", "n", verifier)
+	if _, err := provider.Exchange(ctx, redirectURI, authorize(t, authURL, "s"), verifier, "other nonce"); err == nil {
+		t.Errorf("Wrong nonce accepted\n")
+	}
+
+	// A token for another client
+	foreign := oidctest.NewProvider("someone-else", "secret")
+	defer foreign.Close()
+	idToken, _ := mock.IDToken(mock.User, "n")
+	wrongAudience := NewProvider(Config{Name: "mock", Issuer: mock.Issuer(), ClientID: "someone-else"})
+	if _, err := wrongAudience.VerifyIDToken(ctx, idToken, "n"); err == nil {
+		t.Errorf("Token for another audience accepted\n")
+	}
+
+	// Issued by another provider
+	forged, _ := foreign.IDToken(mock.User, "n")
+	if _, err := provider.VerifyIDToken(ctx, forged, "n"); err == nil {
+		t.Errorf("Token from another provider accepted\n")
+	}
+}
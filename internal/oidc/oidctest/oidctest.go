@@ -0,0 +1,193 @@
+// Package oidctest runs an in-process OpenID Connect provider for tests.
+// The authorize endpoint logs in the configured user without a login page
+// and redirects straight back with a code.
+package oidctest
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/pauslik/chirpy/internal/auth"
+)
+
+const keyID = "oidctest"
+
+// Who the provider says is logging in
+type User struct {
+	Subject       string
+	Email         string
+	EmailVerified bool
+}
+
+type grant struct {
+	user        User
+	redirectURI string
+	challenge   string
+	nonce       string
+}
+
+type Provider struct {
+	ClientID     string
+	ClientSecret string
+	// Returned by the next authorization
+	User User
+
+	server *httptest.Server
+	key    ed25519.PrivateKey
+	mu     sync.Mutex
+	codes  map[string]grant
+}
+
+func NewProvider(clientID, clientSecret string) *Provider {
+	_, key, _ := ed25519.GenerateKey(rand.Reader)
+	p := &Provider{
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		key:          key,
+		codes:        map[string]grant{},
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", p.discovery)
+	mux.HandleFunc("GET /authorize", p.authorize)
+	mux.HandleFunc("POST /token", p.token)
+	mux.HandleFunc("GET /jwks", p.jwks)
+	p.server = httptest.NewServer(mux)
+	return p
+}
+
+func (p *Provider) Issuer() string {
+	return p.server.URL
+}
+
+func (p *Provider) Close() {
+	p.server.Close()
+}
+
+func (p *Provider) discovery(w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, 200, map[string]string{
+		"issuer":                 p.Issuer(),
+		"authorization_endpoint": p.Issuer() + "/authorize",
+		"token_endpoint":         p.Issuer() + "/token",
+		"jwks_uri":               p.Issuer() + "/jwks",
+	})
+}
+
+func (p *Provider) authorize(w http.ResponseWriter, req *http.Request) {
+	q := req.URL.Query()
+	if q.Get("client_id") != p.ClientID || q.Get("response_type") != "code" {
+		http.Error(w, "bad client or response type", 400)
+		return
+	}
+	if q.Get("code_challenge") == "" || q.Get("code_challenge_method") != auth.PKCEMethodS256 {
+		http.Error(w, "PKCE S256 required", 400)
+		return
+	}
+	redirect, err := url.Parse(q.Get("redirect_uri"))
+	if err != nil {
+		http.Error(w, "bad redirect_uri", 400)
+		return
+	}
+
+	code := randomString()
+	p.mu.Lock()
+	p.codes[code] = grant{
+		user:        p.User,
+		redirectURI: q.Get("redirect_uri"),
+		challenge:   q.Get("code_challenge"),
+		nonce:       q.Get("nonce"),
+	}
+	p.mu.Unlock()
+
+	back := redirect.Query()
+	back.Set("code", code)
+	back.Set("state", q.Get("state"))
+	redirect.RawQuery = back.Encode()
+	http.Redirect(w, req, redirect.String(), http.StatusFound)
+}
+
+func (p *Provider) token(w http.ResponseWriter, req *http.Request) {
+	id, secret, ok := req.BasicAuth()
+	if !ok || id != p.ClientID || secret != p.ClientSecret {
+		writeJSON(w, 401, map[string]string{"error": "invalid_client"})
+		return
+	}
+
+	code := req.PostFormValue("code")
+	p.mu.Lock()
+	g, ok := p.codes[code]
+	delete(p.codes, code)
+	p.mu.Unlock()
+	if !ok || req.PostFormValue("grant_type") != "authorization_code" || req.PostFormValue("redirect_uri") != g.redirectURI {
+		writeJSON(w, 400, map[string]string{"error": "invalid_grant"})
+		return
+	}
+	if !auth.VerifyPKCE(req.PostFormValue("code_verifier"), g.challenge) {
+		writeJSON(w, 400, map[string]string{"error": "invalid_grant", "error_description": "PKCE verification failed"})
+		return
+	}
+
+	idToken, err := p.IDToken(g.user, g.nonce)
+	if err != nil {
+		writeJSON(w, 500, map[string]string{"error": "server_error"})
+		return
+	}
+	writeJSON(w, 200, map[string]string{
+		"access_token": randomString(),
+		"token_type":   "Bearer",
+		"id_token":     idToken,
+	})
+}
+
+// Signed ID token for user, exported so tests can craft their own
+func (p *Provider) IDToken(user User, nonce string) (string, error) {
+	now := time.Now()
+	claims := jwt.MapClaims{
+		"iss":            p.Issuer(),
+		"sub":            user.Subject,
+		"aud":            p.ClientID,
+		"iat":            now.Unix(),
+		"exp":            now.Add(5 * time.Minute).Unix(),
+		"nonce":          nonce,
+		"email":          user.Email,
+		"email_verified": user.EmailVerified,
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodEdDSA, claims)
+	token.Header["kid"] = keyID
+	return token.SignedString(p.key)
+}
+
+func (p *Provider) jwks(w http.ResponseWriter, req *http.Request) {
+	pub := p.key.Public().(ed25519.PublicKey)
+	writeJSON(w, 200, map[string]any{
+		"keys": []map[string]string{{
+			"kty": "OKP",
+			"crv": "Ed25519",
+			"kid": keyID,
+			"use": "sig",
+			"alg": "EdDSA",
+			"x":   base64.RawURLEncoding.EncodeToString(pub),
+		}},
+	})
+}
+
+func randomString() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
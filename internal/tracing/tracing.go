@@ -0,0 +1,230 @@
+package tracing
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+
+	"github.com/pauslik/chirpy/internal/database"
+	"github.com/pauslik/chirpy/internal/metrics"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.41.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Instrumentation scope of Chirpy's own spans
+const scope = "github.com/pauslik/chirpy"
+
+// Where spans go
+const (
+	ExporterNone   = "none"
+	ExporterOTLP   = "otlp"
+	ExporterStdout = "stdout"
+	ExporterFile   = "file"
+)
+
+type Config struct {
+	// One of the Exporter constants, empty is ExporterNone
+	Exporter string
+	// Path spans are appended to for ExporterFile, one JSON object per span
+	File string
+	// service.name of the spans unless OTEL_SERVICE_NAME overrides it
+	ServiceName string
+}
+
+// Installs the W3C trace context propagator and, unless the exporter is none,
+// a tracer provider exporting to it. The OTLP exporter is configured with the
+// standard OTEL_EXPORTER_OTLP_* variables and the sampler with OTEL_TRACES_SAMPLER.
+// The returned function flushes pending spans and must be called on shutdown.
+func Setup(ctx context.Context, cfg Config) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	var exporter sdktrace.SpanExporter
+	var closer io.Closer
+	var err error
+	switch cfg.Exporter {
+	case "", ExporterNone:
+		return func(context.Context) error { return nil }, nil
+	case ExporterOTLP:
+		exporter, err = otlptracehttp.New(ctx)
+	case ExporterStdout:
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	case ExporterFile:
+		if cfg.File == "" {
+			return nil, errors.New("tracing: the file exporter needs a file")
+		}
+		var f *os.File
+		f, err = os.OpenFile(cfg.File, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+		if err != nil {
+			return nil, err
+		}
+		closer = f
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(f))
+	default:
+		return nil, fmt.Errorf("tracing: unknown exporter %q", cfg.Exporter)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(semconv.ServiceName(cfg.ServiceName)))
+	if err != nil {
+		return nil, err
+	}
+	// OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES win over the default name
+	res, err = resource.Merge(res, resource.Environment())
+	if err != nil {
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res))
+	otel.SetTracerProvider(provider)
+
+	return func(ctx context.Context) error {
+		err := provider.Shutdown(ctx)
+		if closer != nil {
+			err = errors.Join(err, closer.Close())
+		}
+		return err
+	}, nil
+}
+
+func tracer() trace.Tracer {
+	return otel.Tracer(scope)
+}
+
+// Starts a server span for every request, continuing the trace of an incoming
+// traceparent header. Like the ServeMux, it leaves the route pattern on the
+// request for the middleware around it.
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(req.Context(), propagation.HeaderCarrier(req.Header))
+		ctx, span := tracer().Start(ctx, req.Method, trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				semconv.HTTPRequestMethodKey.String(req.Method),
+				semconv.URLPath(req.URL.Path),
+			))
+		defer span.End()
+
+		rw := &metrics.ResponseWriter{ResponseWriter: w}
+		inner := req.WithContext(ctx)
+		next.ServeHTTP(rw, inner)
+		req.Pattern = inner.Pattern
+
+		// Named after the route, not the path, so spans of one endpoint group together
+		if inner.Pattern != "" {
+			span.SetName(inner.Pattern)
+			span.SetAttributes(semconv.HTTPRoute(inner.Pattern))
+		}
+		span.SetAttributes(semconv.HTTPResponseStatusCode(rw.Status()))
+		if rw.Status() >= 500 {
+			span.SetStatus(codes.Error, http.StatusText(rw.Status()))
+		}
+	})
+}
+
+// Writes the trace context of ctx into outgoing headers, e.g. of an HTTP
+// request or an email
+func Inject(ctx context.Context, header http.Header) {
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(header))
+}
+
+// The traceparent of ctx in text form for storing with queued work, empty
+// when ctx isn't part of a sampled trace
+func Traceparent(ctx context.Context) string {
+	carrier := propagation.MapCarrier{}
+	propagation.TraceContext{}.Inject(ctx, carrier)
+	return carrier.Get("traceparent")
+}
+
+// Continues the trace of a stored traceparent, ctx is returned as is when
+// there is none
+func WithTraceparent(ctx context.Context, traceparent string) context.Context {
+	if traceparent == "" {
+		return ctx
+	}
+	carrier := propagation.MapCarrier{"traceparent": traceparent}
+	return propagation.TraceContext{}.Extract(ctx, carrier)
+}
+
+// Starts a span of Chirpy's own, for background work and outgoing calls
+func Start(ctx context.Context, name string, kind trace.SpanKind, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return tracer().Start(ctx, name, trace.WithSpanKind(kind), trace.WithAttributes(attrs...))
+}
+
+// Ends span, recording err as its status
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// A client span for every query run through db, named after the sqlc query.
+// Only queries within a trace get one, the polling of the background workers
+// would otherwise start a trace every few seconds.
+func DB(db database.DBTX) database.DBTX {
+	return &tracedDB{db: db}
+}
+
+type tracedDB struct {
+	db database.DBTX
+}
+
+func (db *tracedDB) start(ctx context.Context, query string) (context.Context, trace.Span) {
+	if !trace.SpanContextFromContext(ctx).IsValid() {
+		return ctx, trace.SpanFromContext(ctx)
+	}
+	name := metrics.QueryName(query)
+	return tracer().Start(ctx, name, trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			semconv.DBSystemNamePostgreSQL,
+			semconv.DBOperationName(name),
+			// sqlc queries are static, the arguments are never part of the text
+			semconv.DBQueryText(query),
+		))
+}
+
+// sql.ErrNoRows is an answer, not a failure
+func endQuery(span trace.Span, err error) {
+	if errors.Is(err, sql.ErrNoRows) {
+		err = nil
+	}
+	End(span, err)
+}
+
+func (db *tracedDB) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	ctx, span := db.start(ctx, query)
+	result, err := db.db.ExecContext(ctx, query, args...)
+	endQuery(span, err)
+	return result, err
+}
+
+func (db *tracedDB) PrepareContext(ctx context.Context, query string) (*sql.Stmt, error) {
+	return db.db.PrepareContext(ctx, query)
+}
+
+func (db *tracedDB) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	ctx, span := db.start(ctx, query)
+	rows, err := db.db.QueryContext(ctx, query, args...)
+	endQuery(span, err)
+	return rows, err
+}
+
+func (db *tracedDB) QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	ctx, span := db.start(ctx, query)
+	row := db.db.QueryRowContext(ctx, query, args...)
+	endQuery(span, row.Err())
+	return row
+}
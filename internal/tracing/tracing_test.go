@@ -0,0 +1,113 @@
+package tracing
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func recordSpans(t *testing.T) *tracetest.SpanRecorder {
+	t.Helper()
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() { provider.Shutdown(context.Background()) })
+	return recorder
+}
+
+func TestMiddlewareContinuesTrace(t *testing.T) {
+	recorder := recordSpans(t)
+	mux := http.NewServeMux()
+	var handlerTrace trace.TraceID
+	mux.HandleFunc("GET /api/chirps/{chirpID}", func(w http.ResponseWriter, req *http.Request) {
+		handlerTrace = trace.SpanContextFromContext(req.Context()).TraceID()
+		w.WriteHeader(500)
+	})
+
+	req := httptest.NewRequest("GET", "/api/chirps/1", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	Middleware(mux).ServeHTTP(httptest.NewRecorder(), req)
+
+	spans := recorder.Ended()
+	if len(spans) != 1 {
+		t.Fatalf("%d spans\n", len(spans))
+	}
+	span := spans[0]
+	if span.SpanContext().TraceID().String() != "4bf92f3577b34da6a3ce929d0e0e4736" || handlerTrace != span.SpanContext().TraceID() {
+		t.Errorf("Incoming trace not continued: %s\n", span.SpanContext().TraceID())
+	}
+	if span.Parent().SpanID().String() != "00f067aa0ba902b7" {
+		t.Errorf("Parent %s\n", span.Parent().SpanID())
+	}
+	if span.Name() != "GET /api/chirps/{chirpID}" || req.Pattern != span.Name() {
+		t.Errorf("Span name %q, pattern left on the request %q\n", span.Name(), req.Pattern)
+	}
+	if span.Status().Code.String() != "Error" {
+		t.Errorf("5xx not marked as error: %v\n", span.Status())
+	}
+}
+
+func TestTraceparentRoundTrip(t *testing.T) {
+	recordSpans(t)
+	ctx, span := Start(context.Background(), "enqueue", trace.SpanKindInternal)
+	defer span.End()
+
+	stored := Traceparent(ctx)
+	if stored == "" {
+		t.Fatal("No traceparent for a sampled span")
+	}
+	resumed := WithTraceparent(context.Background(), stored)
+	if trace.SpanContextFromContext(resumed).TraceID() != span.SpanContext().TraceID() {
+		t.Errorf("Trace not resumed from %q\n", stored)
+	}
+	if Traceparent(context.Background()) != "" || WithTraceparent(ctx, "") != ctx {
+		t.Errorf("Untraced work should stay untraced\n")
+	}
+}
+
+type fakeDB struct{}
+
+func (fakeDB) ExecContext(context.Context, string, ...interface{}) (sql.Result, error) {
+	return nil, nil
+}
+func (fakeDB) PrepareContext(context.Context, string) (*sql.Stmt, error) { return nil, nil }
+func (fakeDB) QueryContext(context.Context, string, ...interface{}) (*sql.Rows, error) {
+	return nil, sql.ErrNoRows
+}
+func (fakeDB) QueryRowContext(context.Context, string, ...interface{}) *sql.Row { return nil }
+
+func TestDBSpans(t *testing.T) {
+	recorder := recordSpans(t)
+	db := DB(fakeDB{})
+
+	// Outside of a trace, like the workers' polling
+	db.ExecContext(context.Background(), "-- name: DeleteOldWebhookEvents :exec\nDELETE")
+	if n := len(recorder.Ended()); n != 0 {
+		t.Errorf("Untraced query got %d spans\n", n)
+	}
+
+	ctx, parent := Start(context.Background(), "request", trace.SpanKindServer)
+	db.ExecContext(ctx, "-- name: CreateChirp :one\nINSERT")
+	db.QueryContext(ctx, "-- name: GetChirp :one\nSELECT")
+	parent.End()
+
+	spans := recorder.Ended()
+	if len(spans) != 3 || spans[0].Name() != "CreateChirp" || spans[1].Name() != "GetChirp" {
+		t.Fatalf("Spans %v\n", spans)
+	}
+	if spans[0].Parent().SpanID() != parent.SpanContext().SpanID() {
+		t.Errorf("Query span not a child of the request\n")
+	}
+	if spans[1].Status().Code.String() == "Error" {
+		t.Errorf("No rows recorded as an error\n")
+	}
+}
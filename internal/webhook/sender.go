@@ -0,0 +1,114 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/pauslik/chirpy/internal/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.41.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var ErrPrivateAddress = errors.New("webhook: endpoint resolves to a private address")
+
+// Delivers signed webhooks to subscriber URLs. Unless AllowPrivate is set, the
+// connection is refused when the host resolves to a loopback, private or
+// link-local address, so a subscriber can't point Chirpy at internal services.
+type Sender struct {
+	// Prefix of the signature, event and delivery headers, e.g. "Chirpy"
+	HeaderPrefix string
+	Client       *http.Client
+}
+
+func NewSender(headerPrefix string, timeout time.Duration, allowPrivate bool) *Sender {
+	dialer := &net.Dialer{Timeout: timeout}
+	if !allowPrivate {
+		// Checked on the resolved address of every connection, a DNS answer
+		// can't slip past the check between lookup and dial
+		dialer.Control = func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			ip := net.ParseIP(host)
+			if ip == nil || !publicIP(ip) {
+				return ErrPrivateAddress
+			}
+			return nil
+		}
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = dialer.DialContext
+	transport.Proxy = nil
+	return &Sender{
+		HeaderPrefix: headerPrefix,
+		Client: &http.Client{
+			Timeout:   timeout,
+			Transport: transport,
+			// A redirect would be a way around the address check and the signature's target
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+	}
+}
+
+func publicIP(ip net.IP) bool {
+	return !(ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsUnspecified() || ip.IsMulticast() || ip.IsInterfaceLocalMulticast())
+}
+
+type Delivery struct {
+	URL        string
+	Secret     []byte
+	Event      string
+	DeliveryID string
+	Body       []byte
+}
+
+// Posts the delivery and returns the response status. Any status is returned
+// without error, the caller decides what counts as delivered.
+func (s *Sender) Send(ctx context.Context, d Delivery) (status int, err error) {
+	ctx, span := tracing.Start(ctx, "webhook.send", trace.SpanKindClient,
+		semconv.HTTPRequestMethodPost,
+		attribute.String("webhook.event", d.Event),
+		attribute.String("webhook.delivery_id", d.DeliveryID),
+	)
+	defer func() {
+		span.SetAttributes(semconv.HTTPResponseStatusCode(status))
+		tracing.End(span, err)
+	}()
+
+	req, err := http.NewRequestWithContext(ctx, "POST", d.URL, bytes.NewReader(d.Body))
+	if err != nil {
+		return 0, err
+	}
+	span.SetAttributes(semconv.ServerAddress(req.URL.Hostname()))
+	// Subscribers can continue the trace of the change that caused the event
+	tracing.Inject(ctx, req.Header)
+	now := time.Now()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", s.HeaderPrefix+"-Webhooks/1.0")
+	req.Header.Set(s.HeaderPrefix+"-Signature", SignatureHeader([][]byte{d.Secret}, now, d.Body))
+	req.Header.Set(s.HeaderPrefix+"-Event", d.Event)
+	req.Header.Set(s.HeaderPrefix+"-Delivery", d.DeliveryID)
+	req.Header.Set(s.HeaderPrefix+"-Timestamp", strconv.FormatInt(now.Unix(), 10))
+
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("POST %s: %w", d.URL, err)
+	}
+	defer resp.Body.Close()
+	// Drained so the connection can be reused, subscribers only need to answer 2xx
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	return resp.StatusCode, nil
+}
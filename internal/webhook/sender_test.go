@@ -0,0 +1,103 @@
+package webhook
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestSend(t *testing.T) {
+	secret := []byte("endpoint secret")
+	body := []byte(`{"event":"chirp.created"}`)
+
+	var verifyErr error
+	var gotEvent string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		received, _ := io.ReadAll(req.Body)
+		v := &Verifier{Secrets: [][]byte{secret}}
+		_, verifyErr = v.Verify(req.Header.Get("Chirpy-Signature"), received)
+		gotEvent = req.Header.Get("Chirpy-Event")
+		w.WriteHeader(202)
+	}))
+	defer server.Close()
+
+	sender := NewSender("Chirpy", 5*time.Second, true)
+	status, err := sender.Send(context.Background(), Delivery{URL: server.URL, Secret: secret, Event: "chirp.created", DeliveryID: "d1", Body: body})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != 202 {
+		t.Errorf("Status %d\n", status)
+	}
+	if verifyErr != nil {
+		t.Errorf("Subscriber couldn't verify the signature: %v\n", verifyErr)
+	}
+	if gotEvent != "chirp.created" {
+		t.Errorf("Event header %q\n", gotEvent)
+	}
+}
+
+func TestSendRefusesPrivateAddresses(t *testing.T) {
+	called := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		called = true
+	}))
+	defer server.Close()
+
+	sender := NewSender("Chirpy", 5*time.Second, false)
+	_, err := sender.Send(context.Background(), Delivery{URL: server.URL, Secret: []byte("s"), Body: []byte(`{}`)})
+	if !errors.Is(err, ErrPrivateAddress) {
+		t.Errorf("Loopback endpoint not refused: %v\n", err)
+	}
+	if called {
+		t.Errorf("Request reached the loopback server\n")
+	}
+}
+
+func TestSendDoesNotFollowRedirects(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		t.Errorf("Redirect followed\n")
+	}))
+	defer target.Close()
+	server := httptest.NewServer(http.RedirectHandler(target.URL, http.StatusTemporaryRedirect))
+	defer server.Close()
+
+	sender := NewSender("Chirpy", 5*time.Second, true)
+	status, err := sender.Send(context.Background(), Delivery{URL: server.URL, Secret: []byte("s"), Body: []byte(`{}`)})
+	if err != nil || status != http.StatusTemporaryRedirect {
+		t.Errorf("Got %d, %v\n", status, err)
+	}
+}
+
+func TestSendPropagatesTrace(t *testing.T) {
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	var traceparent string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		traceparent = req.Header.Get("traceparent")
+	}))
+	defer server.Close()
+
+	parent := trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    trace.TraceID{0x4b, 0xf9, 0x2f},
+		SpanID:     trace.SpanID{0x00, 0xf0, 0x67},
+		TraceFlags: trace.FlagsSampled,
+	})
+	ctx := trace.ContextWithSpanContext(context.Background(), parent)
+	sender := NewSender("Chirpy", 5*time.Second, true)
+	_, err := sender.Send(ctx, Delivery{URL: server.URL, Secret: []byte("s"), Event: "chirp.created", DeliveryID: "d1", Body: []byte("{}")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(traceparent, "00-"+parent.TraceID().String()+"-") {
+		t.Errorf("traceparent %q doesn't continue %s\n", traceparent, parent.TraceID())
+	}
+}
@@ -0,0 +1,72 @@
+package webhook
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVerify(t *testing.T) {
+	current, previous := []byte("current secret"), []byte("previous secret")
+	now := time.Unix(1700000000, 0)
+	v := &Verifier{Secrets: [][]byte{current, previous}, Now: func() time.Time { return now }}
+	body := []byte(`{"id":"evt_1","event":"user.upgraded"}`)
+
+	// Either active secret is accepted
+	for _, secret := range [][]byte{current, previous} {
+		header := SignatureHeader([][]byte{secret}, now, body)
+		if _, err := v.Verify(header, body); err != nil {
+			t.Errorf("Valid signature rejected: %v\n", err)
+		}
+	}
+
+	header := SignatureHeader([][]byte{current}, now, body)
+	if _, err := v.Verify(header, []byte(`{"id":"evt_1","event":"user.downgraded"}`)); !errors.Is(err, ErrBadSignature) {
+		t.Errorf("Tampered body accepted: %v\n", err)
+	}
+
+	// The timestamp is part of the signed content
+	forged := strings.Replace(header, "t=1700000000", "t=1700000060", 1)
+	if _, err := v.Verify(forged, body); !errors.Is(err, ErrBadSignature) {
+		t.Errorf("Changed timestamp accepted: %v\n", err)
+	}
+
+	retired := SignatureHeader([][]byte{[]byte("retired secret")}, now, body)
+	if _, err := v.Verify(retired, body); !errors.Is(err, ErrBadSignature) {
+		t.Errorf("Retired secret accepted: %v\n", err)
+	}
+
+	for _, bad := range []string{"", "v1=abcd", "t=1700000000", "t=soon,v1=abcd"} {
+		if _, err := v.Verify(bad, body); !errors.Is(err, ErrNoSignature) {
+			t.Errorf("Malformed header %q: %v\n", bad, err)
+		}
+	}
+}
+
+func TestVerifyStale(t *testing.T) {
+	secret := []byte("secret")
+	signedAt := time.Unix(1700000000, 0)
+	body := []byte(`{}`)
+	header := SignatureHeader([][]byte{secret}, signedAt, body)
+
+	for _, tc := range []struct {
+		delay time.Duration
+		ok    bool
+	}{
+		{4 * time.Minute, true},
+		{6 * time.Minute, false},
+		// Sender clock ahead of ours
+		{-4 * time.Minute, true},
+		{-6 * time.Minute, false},
+	} {
+		v := &Verifier{Secrets: [][]byte{secret}, Now: func() time.Time { return signedAt.Add(tc.delay) }}
+		_, err := v.Verify(header, body)
+		if tc.ok && err != nil {
+			t.Errorf("Delay %v rejected: %v\n", tc.delay, err)
+		}
+		if !tc.ok && !errors.Is(err, ErrStaleTimestamp) {
+			t.Errorf("Delay %v accepted: %v\n", tc.delay, err)
+		}
+	}
+}
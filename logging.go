@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pauslik/chirpy/internal/metrics"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Header carrying the request ID, taken from the client or a proxy in front
+// of Chirpy when it sends one and always returned
+const requestIDHeader = "X-Request-ID"
+
+// What the request log line needs from deeper in the handler chain
+type requestInfo struct {
+	ID string
+	// Set by middlewareAuth, uuid.Nil for anonymous requests
+	UserID uuid.UUID
+}
+
+func requestInfoFrom(ctx context.Context) *requestInfo {
+	info, _ := ctx.Value(requestInfoKey).(*requestInfo)
+	return info
+}
+
+// Request ID of the request ctx belongs to, empty outside of requests
+func requestID(ctx context.Context) string {
+	if info := requestInfoFrom(ctx); info != nil {
+		return info.ID
+	}
+	return ""
+}
+
+// JSON lines on w. Records logged with a request context get its request_id,
+// and its trace_id when it's traced.
+func newLogger(w io.Writer, level slog.Level) *slog.Logger {
+	handler := slog.NewJSONHandler(w, &slog.HandlerOptions{Level: level})
+	return slog.New(contextHandler{handler})
+}
+
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, record slog.Record) error {
+	if id := requestID(ctx); id != "" {
+		record.AddAttrs(slog.String("request_id", id))
+	}
+	// Jump from a log line to its trace
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		record.AddAttrs(slog.String("trace_id", sc.TraceID().String()), slog.String("span_id", sc.SpanID().String()))
+	}
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+// Incoming IDs are echoed into logs and responses, so only harmless ones are kept
+var requestIDRe = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+// Assigns every request an ID, or keeps the one it came with, and logs one
+// line per request once it's served. Must sit between the ServeMux, which sets
+// the route pattern on the request, and tracing.Middleware.
+func middlewareRequestLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		info := &requestInfo{ID: req.Header.Get(requestIDHeader)}
+		if !requestIDRe.MatchString(info.ID) {
+			info.ID = uuid.NewString()
+		}
+		// Set before the handler writes, the responders read it back from here
+		w.Header().Set(requestIDHeader, info.ID)
+
+		rw := &metrics.ResponseWriter{ResponseWriter: w}
+		outer := req
+		req = req.WithContext(context.WithValue(req.Context(), requestInfoKey, info))
+		next.ServeHTTP(rw, req)
+		// Like the ServeMux, for the tracing middleware around this one
+		outer.Pattern = req.Pattern
+
+		level := slog.LevelInfo
+		if rw.Status() >= 500 {
+			level = slog.LevelError
+		}
+		attrs := []slog.Attr{
+			slog.String("method", req.Method),
+			slog.String("route", req.Pattern),
+			slog.String("path", req.URL.Path),
+			slog.Int("status", rw.Status()),
+			slog.Float64("duration_ms", float64(time.Since(start).Microseconds())/1000),
+			slog.Int("bytes", rw.Bytes),
+			slog.String("ip", clientIP(req)),
+		}
+		if info.UserID != uuid.Nil {
+			attrs = append(attrs, slog.String("user_id", info.UserID.String()))
+		}
+		slog.LogAttrs(req.Context(), level, "Request", attrs...)
+	})
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pauslik/chirpy/internal/auth"
+	"github.com/pauslik/chirpy/internal/database"
+	"github.com/pauslik/chirpy/internal/mail"
+)
+
+// Failed logins are counted in Postgres, so every server instance sees the same counters
+
+var accountLockout = auth.LockoutPolicy{
+	FreeAttempts: 5,
+	BaseDelay:    time.Second,
+	MaxDelay:     15 * time.Minute,
+	LockoutAfter: 10,
+	LockoutFor:   time.Hour,
+}
+
+// Looser than the account policy, many users can share an address behind NAT
+var ipLockout = auth.LockoutPolicy{
+	FreeAttempts: 20,
+	BaseDelay:    time.Second,
+	MaxDelay:     15 * time.Minute,
+	LockoutAfter: 100,
+	LockoutFor:   time.Hour,
+}
+
+// Keyed by email rather than user ID, unknown emails are throttled the same way
+func accountThrottleKey(email string) string {
+	return "email:" + strings.ToLower(strings.TrimSpace(email))
+}
+
+func ipThrottleKey(req *http.Request) string {
+	return "ip:" + clientIP(req)
+}
+
+func clientIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+// Longest remaining lock of the keys, 0 if none of them is locked
+func (cfg *apiConfig) loginRetryAfter(ctx context.Context, keys ...string) (time.Duration, error) {
+	var wait time.Duration
+	for _, key := range keys {
+		throttle, err := cfg.db.GetLoginThrottle(ctx, key)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				continue
+			}
+			return 0, err
+		}
+		if !throttle.LockedUntil.Valid {
+			continue
+		}
+		wait = max(wait, time.Until(throttle.LockedUntil.Time))
+	}
+	return wait, nil
+}
+
+// Counts a failure for the key and locks it according to the policy.
+// Reports whether this failure triggered a full lockout.
+func (cfg *apiConfig) recordLoginFailure(ctx context.Context, key string, policy auth.LockoutPolicy) (bool, error) {
+	throttle, err := cfg.db.RecordLoginFailure(ctx, key)
+	if err != nil {
+		return false, err
+	}
+
+	delay := policy.Delay(int(throttle.Failures))
+	if delay == 0 {
+		return false, nil
+	}
+	llp := database.LockLoginParams{
+		Key:         key,
+		LockedUntil: sql.NullTime{Time: time.Now().UTC().Add(delay), Valid: true},
+	}
+	err = cfg.db.LockLogin(ctx, llp)
+	if err != nil {
+		return false, err
+	}
+	return policy.IsLockout(int(throttle.Failures)), nil
+}
+
+// Records the failed attempt for the account and the client IP, then answers 401.
+// dbUser is nil when no account exists for the email.
+func (cfg *apiConfig) loginFailed(w http.ResponseWriter, req *http.Request, email string, dbUser *database.User) {
+	err := cfg.recordFailedLogin(req, email, dbUser)
+	if err != nil {
+		respondWithInternalError(w, "Could not record failed login", err)
+		return
+	}
+
+	respondWithError(w, 401, "invalid_credentials", "Incorrect email or password")
+}
+
+// Counts the failure against the account and the client IP, and emails the
+// user when it locked the account
+func (cfg *apiConfig) recordFailedLogin(req *http.Request, email string, dbUser *database.User) error {
+	lockedOut, err := cfg.recordLoginFailure(req.Context(), accountThrottleKey(email), accountLockout)
+	if err != nil {
+		return err
+	}
+	_, err = cfg.recordLoginFailure(req.Context(), ipThrottleKey(req), ipLockout)
+	if err != nil {
+		return err
+	}
+
+	if lockedOut && dbUser != nil {
+		msg := mail.Message{
+			To:      dbUser.Email,
+			Subject: "Your Chirpy account has been locked",
+			Body: fmt.Sprintf("There were too many failed login attempts on your Chirpy account, "+
+				"the last one from %s.\n\nLogins are blocked for %s. "+
+				"If this wasn't you, consider resetting your password.\n",
+				clientIP(req), accountLockout.LockoutFor),
+		}
+		cfg.background.Go(func() {
+			err := cfg.mailer.Send(context.WithoutCancel(req.Context()), msg)
+			if err != nil {
+				slog.Error("Could not send lockout email", "error", err)
+			}
+		})
+	}
+	return nil
+}
+
+func respondWithRetryAfter(w http.ResponseWriter, wait time.Duration) {
+	seconds := int(math.Ceil(wait.Seconds()))
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	fMsg := fmt.Sprintf("Too many failed login attempts, try again in %d seconds", seconds)
+	respondWithError(w, 429, codeRateLimited, fMsg)
+}
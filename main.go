@@ -1,46 +1,226 @@
 package main
 
 import (
+	"cmp"
+	"context"
 	"database/sql"
-
 	"fmt"
+	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
+	"sync"
 	"sync/atomic"
+	"syscall"
+	"time"
 
 	"github.com/joho/godotenv"
 	_ "github.com/lib/pq"
+	"github.com/pauslik/chirpy/internal/auth"
 	"github.com/pauslik/chirpy/internal/database"
+	"github.com/pauslik/chirpy/internal/mail"
+	"github.com/pauslik/chirpy/internal/metrics"
+	"github.com/pauslik/chirpy/internal/oidc"
+	"github.com/pauslik/chirpy/internal/tracing"
+	"github.com/pauslik/chirpy/internal/webhook"
 )
 
 type apiConfig struct {
 	fileserverHits atomic.Int32
 	db             *database.Queries
-	jwt            string
-	polka          string
+	sqlDB          *sql.DB
+	jwt            *auth.Keyring
+	polkaWebhook   *webhook.Verifier
+	webhookWake    chan struct{}
+	webhookSender  *webhook.Sender
+	deliveryWake   chan struct{}
+	adminKey       string
+	baseURL        string
+	mailer         mail.Mailer
+	passwordPolicy *auth.PasswordPolicy
+	tokenPolicy    *auth.TokenPolicy
+	oidcProviders  map[string]*oidc.Provider
+	metrics        *metrics.Metrics
+	metricsToken   string
+	// Workers and fire-and-forget work like emails, waited for on shutdown
+	background sync.WaitGroup
+}
+
+// Queries bound to tx, timed and traced like the ones on cfg.db
+func (cfg *apiConfig) withTx(tx *sql.Tx) *database.Queries {
+	return database.New(tracing.DB(cfg.metrics.DB(tx)))
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		os.Exit(runCommand(os.Args[1:]))
+	}
+
 	apiCfg := apiConfig{}
 
 	// Load environment variables
 	godotenv.Load()
+
+	// JSON logs on stdout, the standard log package included
+	var logLevel slog.Level
+	err := logLevel.UnmarshalText([]byte(cmp.Or(os.Getenv("LOG_LEVEL"), "info")))
+	if err != nil {
+		fmt.Printf("Invalid LOG_LEVEL. %v\n", err)
+		os.Exit(1)
+	}
+	slog.SetDefault(newLogger(os.Stdout, logLevel))
+
+	// Done on SIGINT or SIGTERM, which starts a graceful shutdown. A second
+	// signal kills the process right away.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	context.AfterFunc(ctx, stop)
+
+	serverCfg, err := loadServerConfig()
+	if err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
+
 	dbURL := os.Getenv("DB_URL")
 	jwtSecret := os.Getenv("JWT_SECRET")
-	polkaKey := os.Getenv("POLKA_KEY")
+	adminKey := os.Getenv("ADMIN_API_KEY")
+	baseURL := os.Getenv("BASE_URL")
+	if baseURL == "" {
+		baseURL = "http://localhost:8080"
+	}
+
+	// Traces, sent nowhere unless OTEL_TRACES_EXPORTER is set
+	tracingConfig := tracing.Config{
+		Exporter:    os.Getenv("OTEL_TRACES_EXPORTER"),
+		File:        os.Getenv("OTEL_TRACES_FILE"),
+		ServiceName: "chirpy",
+	}
+	shutdownTracing, err := tracing.Setup(context.Background(), tracingConfig)
+	if err != nil {
+		slog.Error("Could not set up tracing", "error", err)
+		os.Exit(1)
+	}
 
 	// Load the database
 	db, err := sql.Open("postgres", dbURL)
 	if err != nil {
-		fmt.Printf("Could not open a connection to database. %v", err)
+		slog.Error("Could not open a connection to database", "error", err)
+		os.Exit(1)
+	}
+	err = configureDBPool(db)
+	if err != nil {
+		slog.Error(err.Error())
 		os.Exit(1)
 	}
-	dbQueries := database.New(db)
+	// sql.Open doesn't connect, a wrong DB_URL would only show on the first request
+	pingCtx, cancelPing := context.WithTimeout(ctx, 10*time.Second)
+	err = db.PingContext(pingCtx)
+	cancelPing()
+	if err != nil {
+		slog.Error("Could not reach the database", "error", err)
+		os.Exit(1)
+	}
+	// Prometheus metrics, every query is timed and traced
+	apiCfg.metrics = metrics.New()
+	apiCfg.metricsToken = os.Getenv("METRICS_TOKEN")
+	apiCfg.metrics.CounterFunc("chirpy_fileserver_hits_total", "Requests for the app's static files since the last admin reset.", func() float64 {
+		return float64(apiCfg.fileserverHits.Load())
+	})
+	dbQueries := database.New(tracing.DB(apiCfg.metrics.DB(db)))
 
 	// Save to config
 	apiCfg.db = dbQueries
-	apiCfg.jwt = jwtSecret
-	apiCfg.polka = polkaKey
+	apiCfg.sqlDB = db
+	apiCfg.adminKey = adminKey
+	apiCfg.baseURL = baseURL
+
+	// Outgoing mail, printed to stdout when no SMTP server is configured
+	if smtpAddr := os.Getenv("SMTP_ADDR"); smtpAddr != "" {
+		apiCfg.mailer = &mail.SMTPMailer{
+			Addr:     smtpAddr,
+			From:     os.Getenv("SMTP_FROM"),
+			Username: os.Getenv("SMTP_USERNAME"),
+			Password: os.Getenv("SMTP_PASSWORD"),
+		}
+	} else {
+		apiCfg.mailer = &mail.LogMailer{W: os.Stdout}
+	}
+
+	// JWT signing keys, asymmetric keys from JWT_KEYS_DIR or the shared JWT_SECRET
+	if keysDir := os.Getenv("JWT_KEYS_DIR"); keysDir != "" {
+		apiCfg.jwt, err = auth.LoadKeyring(keysDir)
+		if err != nil {
+			slog.Error("Could not load JWT signing keys", "error", err)
+			os.Exit(1)
+		}
+	} else {
+		apiCfg.jwt = auth.NewHMACKeyring(jwtSecret)
+	}
+
+	// Polka webhook signing secrets, the previous one stays valid during a rotation
+	apiCfg.polkaWebhook = &webhook.Verifier{}
+	for _, name := range []string{"POLKA_WEBHOOK_SECRET", "POLKA_WEBHOOK_SECRET_PREVIOUS"} {
+		if secret := os.Getenv(name); secret != "" {
+			apiCfg.polkaWebhook.Secrets = append(apiCfg.polkaWebhook.Secrets, []byte(secret))
+		}
+	}
+
+	// Token lifetimes, leeway and audience
+	apiCfg.tokenPolicy, err = loadTokenPolicy(baseURL)
+	if err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
+
+	// Password policy
+	apiCfg.passwordPolicy = auth.DefaultPasswordPolicy()
+	apiCfg.passwordPolicy.MinLength, err = envInt("PASSWORD_MIN_LENGTH", apiCfg.passwordPolicy.MinLength)
+	if err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
+	if breachDir := os.Getenv("PASSWORD_BREACH_DIR"); breachDir != "" {
+		apiCfg.passwordPolicy.Breached = &auth.HashPrefixDir{Dir: breachDir}
+	}
+
+	// Password hashing parameters, see "chirpy hash-bench"
+	err = loadHashParams()
+	if err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
+
+	// "Sign in with" providers
+	apiCfg.oidcProviders, err = loadOIDCProviders()
+	if err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
+
+	// Background jobs
+	expiryInterval, err := envDuration("SUBSCRIPTION_EXPIRY_INTERVAL", time.Hour)
+	if err != nil || expiryInterval <= 0 {
+		slog.Error("Invalid SUBSCRIPTION_EXPIRY_INTERVAL", "error", err)
+		os.Exit(1)
+	}
+	apiCfg.background.Go(func() { apiCfg.runSubscriptionExpiry(ctx, expiryInterval) })
+	webhookPollInterval, err := envDuration("WEBHOOK_POLL_INTERVAL", 10*time.Second)
+	if err != nil || webhookPollInterval <= 0 {
+		slog.Error("Invalid WEBHOOK_POLL_INTERVAL", "error", err)
+		os.Exit(1)
+	}
+	apiCfg.webhookWake = make(chan struct{}, 1)
+	apiCfg.background.Go(func() { apiCfg.runWebhookWorker(ctx, webhookPollInterval) })
+	// Only for local development, subscribers on localhost or the private network
+	allowPrivate := os.Getenv("WEBHOOK_ALLOW_PRIVATE") == "true"
+	apiCfg.webhookSender = webhook.NewSender("Chirpy", 10*time.Second, allowPrivate)
+	deliveryConcurrency, err := envInt("WEBHOOK_DELIVERY_CONCURRENCY", 8)
+	if err != nil || deliveryConcurrency <= 0 {
+		slog.Error("Invalid WEBHOOK_DELIVERY_CONCURRENCY", "error", err)
+		os.Exit(1)
+	}
+	apiCfg.deliveryWake = make(chan struct{}, 1)
+	apiCfg.background.Go(func() { apiCfg.runDeliveryWorker(ctx, webhookPollInterval, deliveryConcurrency) })
 
 	// HTTP request multiplexer
 	mux := http.NewServeMux()
@@ -52,11 +232,26 @@ func main() {
 	assetsHandler := http.FileServer(http.Dir("./app/assets"))
 	mux.Handle("/app/assets", apiCfg.middlewareMetricsInc(assetsHandler))
 
+	// Prometheus scrape endpoint
+	mux.HandleFunc("GET /metrics", apiCfg.prometheusHandler)
+
 	//ADMIN handlers
 	// Display metrics endpoint
-	mux.HandleFunc("GET /admin/metrics", apiCfg.metricsHandler)
+	mux.HandleFunc("GET /admin/metrics", apiCfg.middlewareAuth(requireAdmin(), apiCfg.metricsHandler))
 	// Reset metrics endpoint
-	mux.HandleFunc("POST /admin/reset", apiCfg.resetHandler)
+	mux.HandleFunc("POST /admin/reset", apiCfg.middlewareAuth(requireAdmin(), apiCfg.resetHandler))
+	// Lift a login lockout
+	mux.HandleFunc("POST /admin/users/{userID}/unlock", apiCfg.middlewareAuth(requireAdmin(), apiCfg.unlockUserHandler))
+	// Change a user's role
+	mux.HandleFunc("PUT /admin/users/{userID}/role", apiCfg.middlewareAuth(requireAdmin(), apiCfg.setUserRoleHandler))
+	// Entitlement grants for support cases
+	mux.HandleFunc("GET /admin/users/{userID}/entitlements", apiCfg.middlewareAuth(requireAdmin(), apiCfg.adminGetEntitlementsHandler))
+	mux.HandleFunc("PUT /admin/users/{userID}/entitlements/{name}", apiCfg.middlewareAuth(requireAdmin(), apiCfg.grantEntitlementHandler))
+	mux.HandleFunc("DELETE /admin/users/{userID}/entitlements/{name}", apiCfg.middlewareAuth(requireAdmin(), apiCfg.revokeEntitlementHandler))
+	// Incoming webhook inbox
+	mux.HandleFunc("GET /admin/webhooks", apiCfg.middlewareAuth(requireAdmin(), apiCfg.getWebhookEventsHandler))
+	mux.HandleFunc("GET /admin/webhooks/{eventID}", apiCfg.middlewareAuth(requireAdmin(), apiCfg.getWebhookEventHandler))
+	mux.HandleFunc("POST /admin/webhooks/{eventID}/replay", apiCfg.middlewareAuth(requireAdmin(), apiCfg.replayWebhookEventHandler))
 
 	// API handlers
 	// Server health check endpoint
@@ -66,27 +261,89 @@ func main() {
 		body := "OK"
 		w.Write([]byte(body))
 	})
+	// Public keys for services verifying Chirpy tokens
+	mux.HandleFunc("GET /.well-known/jwks.json", apiCfg.jwksHandler)
 	// Users
 	mux.HandleFunc("POST /api/users", apiCfg.createUserHandler)
-	mux.HandleFunc("PUT /api/users", apiCfg.changeUserHandler)
+	mux.HandleFunc("PUT /api/users", apiCfg.middlewareAuth(requireLogin(), apiCfg.changeUserHandler))
+	mux.HandleFunc("PATCH /api/users", apiCfg.middlewareAuth(requireLogin(), apiCfg.changeUserHandler))
+	mux.HandleFunc("GET /api/users/me", apiCfg.middlewareAuth(requireScope(auth.ScopeProfileRead), apiCfg.getMeHandler))
+	mux.HandleFunc("GET /api/users/me/subscription", apiCfg.middlewareAuth(requireScope(auth.ScopeProfileRead), apiCfg.getSubscriptionHandler))
+	mux.HandleFunc("GET /api/users/me/entitlements", apiCfg.middlewareAuth(requireScope(auth.ScopeProfileRead), apiCfg.getEntitlementsHandler))
+	mux.HandleFunc("POST /api/users/email/confirm", apiCfg.confirmEmailHandler)
 	mux.HandleFunc("POST /api/login", apiCfg.loginHandler)
+	mux.HandleFunc("POST /api/login/mfa", apiCfg.mfaLoginHandler)
+	mux.HandleFunc("GET /api/auth/{provider}/login", apiCfg.oidcLoginHandler)
+	mux.HandleFunc("GET /api/auth/{provider}/callback", apiCfg.oidcCallbackHandler)
 	mux.HandleFunc("POST /api/refresh", apiCfg.refreshHandler)
 	mux.HandleFunc("POST /api/revoke", apiCfg.revokeHandler)
+	mux.HandleFunc("POST /api/password/forgot", apiCfg.forgotPasswordHandler)
+	mux.HandleFunc("POST /api/password/reset", apiCfg.resetPasswordHandler)
+	// Sessions
+	mux.HandleFunc("GET /api/sessions", apiCfg.middlewareAuth(requireLogin(), apiCfg.getSessionsHandler))
+	mux.HandleFunc("DELETE /api/sessions/{sessionID}", apiCfg.middlewareAuth(requireLogin(), apiCfg.deleteSessionHandler))
+	mux.HandleFunc("POST /api/sessions/revoke-all", apiCfg.middlewareAuth(requireLogin(), apiCfg.revokeAllSessionsHandler))
+	// Personal access tokens
+	mux.HandleFunc("POST /api/tokens", apiCfg.middlewareAuth(requireLogin(), apiCfg.createTokenHandler))
+	mux.HandleFunc("GET /api/tokens", apiCfg.middlewareAuth(requireLogin(), apiCfg.getTokensHandler))
+	mux.HandleFunc("DELETE /api/tokens/{tokenID}", apiCfg.middlewareAuth(requireLogin(), apiCfg.deleteTokenHandler))
+	// Two-factor authentication
+	mux.HandleFunc("POST /api/mfa/totp", apiCfg.middlewareAuth(requireLogin(), apiCfg.enrollTOTPHandler))
+	mux.HandleFunc("GET /api/mfa/totp/qr.png", apiCfg.middlewareAuth(requireLogin(), apiCfg.totpQRHandler))
+	mux.HandleFunc("POST /api/mfa/totp/confirm", apiCfg.middlewareAuth(requireLogin(), apiCfg.confirmTOTPHandler))
+	mux.HandleFunc("DELETE /api/mfa/totp", apiCfg.middlewareAuth(requireLogin(), apiCfg.disableTOTPHandler))
+	// OAuth apps
+	mux.HandleFunc("POST /api/oauth/clients", apiCfg.middlewareAuth(requireLogin(), apiCfg.createOauthClientHandler))
+	mux.HandleFunc("GET /api/oauth/clients", apiCfg.middlewareAuth(requireLogin(), apiCfg.getOauthClientsHandler))
+	mux.HandleFunc("DELETE /api/oauth/clients/{clientID}", apiCfg.middlewareAuth(requireLogin(), apiCfg.deleteOauthClientHandler))
+	mux.HandleFunc("POST /api/oauth/clients/{clientID}/webhooks", apiCfg.middlewareAuth(requireLogin(), apiCfg.createWebhookEndpointHandler))
+	mux.HandleFunc("GET /api/oauth/clients/{clientID}/webhooks", apiCfg.middlewareAuth(requireLogin(), apiCfg.getWebhookEndpointsHandler))
+	mux.HandleFunc("DELETE /api/oauth/clients/{clientID}/webhooks/{webhookID}", apiCfg.middlewareAuth(requireLogin(), apiCfg.deleteWebhookEndpointHandler))
+	mux.HandleFunc("GET /api/oauth/clients/{clientID}/webhooks/{webhookID}/deliveries", apiCfg.middlewareAuth(requireLogin(), apiCfg.getWebhookDeliveriesHandler))
+	mux.HandleFunc("GET /api/oauth/clients/{clientID}/webhooks/{webhookID}/deliveries/{deliveryID}", apiCfg.middlewareAuth(requireLogin(), apiCfg.getWebhookDeliveryHandler))
+	mux.HandleFunc("POST /api/oauth/clients/{clientID}/webhooks/{webhookID}/deliveries/{deliveryID}/redeliver", apiCfg.middlewareAuth(requireLogin(), apiCfg.redeliverWebhookDeliveryHandler))
+	mux.HandleFunc("GET /api/oauth/authorizations", apiCfg.middlewareAuth(requireLogin(), apiCfg.getOauthAuthorizationsHandler))
+	mux.HandleFunc("DELETE /api/oauth/authorizations/{clientID}", apiCfg.middlewareAuth(requireLogin(), apiCfg.revokeOauthAuthorizationHandler))
+	mux.HandleFunc("GET /oauth/authorize", apiCfg.authorizeHandler)
+	mux.HandleFunc("POST /oauth/authorize", apiCfg.authorizeDecisionHandler)
+	mux.HandleFunc("POST /oauth/token", apiCfg.oauthTokenHandler)
+	mux.HandleFunc("POST /oauth/revoke", apiCfg.oauthRevokeHandler)
+	mux.HandleFunc("POST /oauth/introspect", apiCfg.oauthIntrospectHandler)
 	// Chirps
-	mux.HandleFunc("POST /api/chirps", apiCfg.createChirpHandler)
-	mux.HandleFunc("GET /api/chirps", apiCfg.getChirpsHandler)
-	mux.HandleFunc("GET /api/chirps/{chirpID}", apiCfg.getChirpIDHandler)
-	mux.HandleFunc("DELETE /api/chirps/{chirpID}", apiCfg.deleteChirpIDHandler)
+	mux.HandleFunc("POST /api/chirps", apiCfg.middlewareAuth(requireScope(auth.ScopeChirpsWrite), apiCfg.createChirpHandler))
+	mux.HandleFunc("GET /api/chirps", apiCfg.middlewareAuth(optionalAuth(), apiCfg.getChirpsHandler))
+	mux.HandleFunc("GET /api/chirps/{chirpID}", apiCfg.middlewareAuth(optionalAuth(), apiCfg.getChirpIDHandler))
+	mux.HandleFunc("DELETE /api/chirps/{chirpID}", apiCfg.middlewareAuth(requireScope(auth.ScopeChirpsWrite), apiCfg.deleteChirpIDHandler))
 	// Polka
-	mux.HandleFunc("POST /api/polka/webhooks", apiCfg.upgradeRedHandler)
+	mux.HandleFunc("POST /api/polka/webhooks", apiCfg.polkaWebhookHandler)
 
 	// HTTP server
 	server := &http.Server{
-		Handler: mux,
-		Addr:    ":8080",
+		Handler:           tracing.Middleware(middlewareRequestLog(apiCfg.metrics.Middleware(middlewareMaxBody(serverCfg.MaxBodyBytes, mux)))),
+		Addr:              ":8080",
+		ReadTimeout:       serverCfg.ReadTimeout,
+		ReadHeaderTimeout: serverCfg.ReadHeaderTimeout,
+		WriteTimeout:      serverCfg.WriteTimeout,
+		IdleTimeout:       serverCfg.IdleTimeout,
+		// Errors net/http logs itself, like TLS handshake failures
+		ErrorLog: slog.NewLogLogger(slog.Default().Handler(), slog.LevelWarn),
 	}
 
-	// Start the server
-	server.ListenAndServe()
+	// Start the server, until SIGINT or SIGTERM
+	slog.Info("Listening", "addr", server.Addr)
+	err = apiCfg.serve(ctx, server, serverCfg.ShutdownTimeout)
 
+	// Spans of the last requests are flushed even when the shutdown went wrong
+	flushCtx, cancelFlush := context.WithTimeout(context.Background(), 5*time.Second)
+	shutdownErr := shutdownTracing(flushCtx)
+	cancelFlush()
+	if shutdownErr != nil {
+		slog.Error("Could not flush traces", "error", shutdownErr)
+	}
+	db.Close()
+	if err != nil {
+		slog.Error("Server stopped", "error", err)
+		os.Exit(1)
+	}
+	slog.Info("Server stopped")
 }
@@ -1,7 +1,13 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"net/http"
+
+	"github.com/google/uuid"
+	"github.com/pauslik/chirpy/internal/auth"
 )
 
 func (cfg *apiConfig) middlewareMetricsInc(next http.Handler) http.Handler {
@@ -10,3 +16,124 @@ func (cfg *apiConfig) middlewareMetricsInc(next http.Handler) http.Handler {
 		next.ServeHTTP(w, r)
 	})
 }
+
+// Caps every request body at limit bytes, reading past it fails with an
+// *http.MaxBytesError that the responders turn into a 413
+func middlewareMaxBody(limit int64, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		req.Body = http.MaxBytesReader(w, req.Body, limit)
+		next.ServeHTTP(w, req)
+	})
+}
+
+type contextKey int
+
+const (
+	principalKey contextKey = iota
+	requestInfoKey
+)
+
+type authMode int
+
+const (
+	authOptional authMode = iota
+	authRequired
+	authRole
+)
+
+// What a route demands from its caller, declared next to the route in main.go
+type authRule struct {
+	mode authMode
+	// Scope a personal access token needs, empty means the route is for logged in users only
+	scope string
+	// Minimum role for authRole routes
+	role string
+}
+
+// Anonymous callers are let through, bad credentials are still rejected
+func optionalAuth() authRule {
+	return authRule{mode: authOptional}
+}
+
+// A JWT from a login, personal access tokens and third-party apps are refused
+func requireLogin() authRule {
+	return authRule{mode: authRequired}
+}
+
+// A JWT from a login, or a personal access token or app granted scope
+func requireScope(scope string) authRule {
+	return authRule{mode: authRequired, scope: scope}
+}
+
+// A logged in user with at least role
+func requireRole(role string) authRule {
+	return authRule{mode: authRole, role: role}
+}
+
+// An admin user, or the operator with ADMIN_API_KEY
+func requireAdmin() authRule {
+	return requireRole(auth.RoleAdmin)
+}
+
+// Authenticates the caller and stores the principal in the request context.
+// 401 when credentials are missing or invalid, 403 when they don't satisfy the rule.
+func (cfg *apiConfig) middlewareAuth(rule authRule, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		p, err := cfg.authenticate(req)
+		if err != nil {
+			if errors.Is(err, errNoCredentials) && rule.mode == authOptional {
+				next(w, req)
+				return
+			}
+			// Anything but an apiError is a failure to check the credentials, a 500
+			var aErr *apiError
+			if errors.As(err, &aErr) {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="chirpy"`)
+			}
+			respondWithProblem(w, err)
+			return
+		}
+
+		switch rule.mode {
+		case authRequired:
+			if p.Kind == principalAPIKey {
+				respondWithError(w, 403, codeForbidden, "API keys can't act as a user")
+				return
+			}
+			if (p.Kind == principalToken || p.Kind == principalClient) && (rule.scope == "" || !p.hasScope(rule.scope)) {
+				msg := "Scoped tokens can't be used here"
+				if rule.scope != "" {
+					msg = fmt.Sprintf("Token lacks the %s scope", rule.scope)
+				}
+				respondWithError(w, 403, "insufficient_scope", msg)
+				return
+			}
+		case authRole:
+			if !p.hasRole(rule.role) {
+				respondWithError(w, 403, codeForbidden, fmt.Sprintf("Role %s required", rule.role))
+				return
+			}
+		}
+
+		// For the request log line, user principals only
+		if info := requestInfoFrom(req.Context()); info != nil {
+			info.UserID = p.UserID
+		}
+		ctx := context.WithValue(req.Context(), principalKey, p)
+		next(w, req.WithContext(ctx))
+	}
+}
+
+// Principal set by middlewareAuth, nil for anonymous callers of optional routes
+func authPrincipal(req *http.Request) *principal {
+	p, _ := req.Context().Value(principalKey).(*principal)
+	return p
+}
+
+// User ID of the caller on routes that require a user
+func authUserID(req *http.Request) uuid.UUID {
+	if p := authPrincipal(req); p != nil {
+		return p.UserID
+	}
+	return uuid.Nil
+}
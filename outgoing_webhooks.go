@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pauslik/chirpy/internal/database"
+	"github.com/pauslik/chirpy/internal/tracing"
+	"github.com/pauslik/chirpy/internal/webhook"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Webhooks Chirpy sends to apps that subscribed to events. Events go into the
+// webhook_deliveries outbox in the transaction of the change itself, so an
+// event is never sent for a rolled back change nor lost for a committed one.
+
+// Events apps can subscribe to
+const (
+	eventChirpCreated = "chirp.created"
+	eventChirpDeleted = "chirp.deleted"
+	eventUserUpgraded = "user.upgraded"
+)
+
+var webhookEvents = []string{eventChirpCreated, eventChirpDeleted, eventUserUpgraded}
+
+// Delivery statuses
+const (
+	deliveryPending    = "pending"
+	deliveryDelivering = "delivering"
+	deliveryDelivered  = "delivered"
+	deliveryFailed     = "failed"
+	deliveryDead       = "dead"
+)
+
+// Attempts before a delivery is given up, about a day with the backoff
+const deliveryMaxAttempts = 12
+
+type outgoingEvent struct {
+	ID        uuid.UUID `json:"id"`
+	Event     string    `json:"event"`
+	CreatedAt time.Time `json:"created_at"`
+	Data      any       `json:"data"`
+}
+
+type outputChirpDeleted struct {
+	ID     uuid.UUID `json:"id"`
+	UserID uuid.UUID `json:"user_id"`
+}
+
+type outputUserUpgraded struct {
+	UserID uuid.UUID `json:"user_id"`
+}
+
+// Queues the event for every subscribed endpoint, q should be bound to the
+// transaction of the change. Events about a user's account (userID set) only
+// go to apps the user has authorized, public events like chirps to every subscriber.
+func enqueueWebhookEvent(ctx context.Context, q *database.Queries, event string, userID uuid.NullUUID, data any) error {
+	var endpoints []database.WebhookEndpoint
+	var err error
+	if userID.Valid {
+		gwefuep := database.GetWebhookEndpointsForUserEventParams{
+			Event:  event,
+			UserID: userID.UUID,
+		}
+		endpoints, err = q.GetWebhookEndpointsForUserEvent(ctx, gwefuep)
+	} else {
+		endpoints, err = q.GetWebhookEndpointsForEvent(ctx, event)
+	}
+	if err != nil || len(endpoints) == 0 {
+		return err
+	}
+
+	// One event ID for all endpoints, subscribers use it to deduplicate
+	oEvent := outgoingEvent{
+		ID:        uuid.New(),
+		Event:     event,
+		CreatedAt: time.Now().UTC(),
+		Data:      data,
+	}
+	payload, err := json.Marshal(oEvent)
+	if err != nil {
+		return err
+	}
+	for _, endpoint := range endpoints {
+		cwdp := database.CreateWebhookDeliveryParams{
+			EndpointID: endpoint.ID,
+			EventID:    oEvent.ID,
+			Event:      event,
+			Payload:    string(payload),
+			// The delivery continues the trace of the change
+			Traceparent: tracing.Traceparent(ctx),
+		}
+		err = q.CreateWebhookDelivery(ctx, cwdp)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func validWebhookEvent(event string) bool {
+	return slices.Contains(webhookEvents, event)
+}
+
+// Wakes the delivery worker up after a commit that queued deliveries
+func (cfg *apiConfig) wakeDeliveryWorker() {
+	select {
+	case cfg.deliveryWake <- struct{}{}:
+	default:
+	}
+}
+
+// Sends due deliveries until ctx is done, up to concurrency at once and one at
+// a time per endpoint, polling every interval for retries. Deliveries being
+// sent when ctx is done are still finished and recorded.
+func (cfg *apiConfig) runDeliveryWorker(ctx context.Context, interval time.Duration, concurrency int) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	work := context.WithoutCancel(ctx)
+
+	var senders sync.WaitGroup
+	defer senders.Wait()
+	slots := make(chan struct{}, concurrency)
+
+	for {
+		for ctx.Err() == nil {
+			select {
+			case slots <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+
+			// The claim skips endpoints already being sent to, here or elsewhere
+			delivery, err := cfg.db.ClaimWebhookDelivery(work, time.Now().Add(webhookClaimLease))
+			if err != nil {
+				<-slots
+				if !errors.Is(err, sql.ErrNoRows) {
+					slog.Error("Could not claim webhook delivery", "error", err)
+				}
+				break
+			}
+
+			senders.Go(func() {
+				err := cfg.sendDelivery(work, delivery)
+				if err != nil {
+					slog.Error("Could not send webhook delivery", "id", delivery.ID, "error", err)
+				}
+				<-slots
+				// The endpoint may have more deliveries waiting
+				cfg.wakeDeliveryWorker()
+			})
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-cfg.deliveryWake:
+		case <-ticker.C:
+			cfg.db.DeleteOldWebhookDeliveries(ctx)
+		}
+	}
+}
+
+// Sends a claimed delivery and records the attempt
+func (cfg *apiConfig) sendDelivery(ctx context.Context, delivery database.WebhookDelivery) error {
+	ctx, span := tracing.Start(tracing.WithTraceparent(ctx, delivery.Traceparent), "webhook.deliver", trace.SpanKindConsumer,
+		attribute.String("webhook.event", delivery.Event),
+		attribute.String("webhook.delivery_id", delivery.ID.String()),
+		attribute.Int("webhook.attempt", int(delivery.Attempts)),
+	)
+	defer span.End()
+
+	endpoint, err := cfg.db.GetWebhookEndpoint(ctx, delivery.EndpointID)
+	if err != nil {
+		return err
+	}
+
+	started := time.Now()
+	status, sendErr := cfg.webhookSender.Send(ctx, webhook.Delivery{
+		URL:        endpoint.Url,
+		Secret:     []byte(endpoint.Secret),
+		Event:      delivery.Event,
+		DeliveryID: delivery.ID.String(),
+		Body:       []byte(delivery.Payload),
+	})
+
+	cwdap := database.CreateWebhookDeliveryAttemptParams{
+		DeliveryID:  delivery.ID,
+		AttemptedAt: started,
+		DurationMs:  int32(time.Since(started).Milliseconds()),
+	}
+	if status != 0 {
+		cwdap.ResponseStatus = sql.NullInt32{Int32: int32(status), Valid: true}
+	}
+	if sendErr != nil {
+		cwdap.Error = sql.NullString{String: sendErr.Error(), Valid: true}
+	}
+	err = cfg.db.CreateWebhookDeliveryAttempt(ctx, cwdap)
+	if err != nil {
+		return err
+	}
+
+	if sendErr == nil && status >= 200 && status < 300 {
+		return cfg.db.MarkWebhookDeliveryDelivered(ctx, delivery.ID)
+	}
+	fwdp := database.FailWebhookDeliveryParams{
+		ID:            delivery.ID,
+		Status:        deliveryFailed,
+		NextAttemptAt: time.Now().Add(webhookBackoff(delivery.Attempts)),
+	}
+	if delivery.Attempts >= deliveryMaxAttempts {
+		fwdp.Status = deliveryDead
+		slog.Warn("Webhook delivery given up", "id", delivery.ID, "endpoint_id", delivery.EndpointID, "event", delivery.Event, "attempts", delivery.Attempts)
+	}
+	return cfg.db.FailWebhookDelivery(ctx, fwdp)
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/google/uuid"
+	"github.com/pauslik/chirpy/internal/auth"
+	"github.com/pauslik/chirpy/internal/entitlements"
+)
+
+type principalKind int
+
+const (
+	principalUser   principalKind = iota + 1 // logged in with a JWT
+	principalToken                           // personal access token
+	principalAPIKey                          // shared key of a service or the operator
+	principalClient                          // OAuth access token of a third-party app
+)
+
+// API key services
+const serviceAdmin = "admin"
+
+// The authenticated caller of a request, see middlewareAuth
+type principal struct {
+	Kind principalKind
+	// User and token principals
+	UserID uuid.UUID
+	// Role claim of the JWT, personal access tokens and apps always act as RoleUser
+	Role string
+	// Token and client principals, TokenID is the JWT ID for clients
+	TokenID uuid.UUID
+	Scopes  []string
+	// Client principals only
+	ClientID string
+	// API key principals only
+	Service string
+	// Looked up on first use, see callerEntitlements
+	entitlements *entitlements.Set
+}
+
+// Logged in users aren't limited, personal access tokens and apps only get their scopes
+func (p *principal) hasScope(scope string) bool {
+	switch p.Kind {
+	case principalUser:
+		return true
+	case principalToken, principalClient:
+		return auth.HasScope(p.Scopes, scope)
+	}
+	return false
+}
+
+// Logged in users with at least minimum role, the admin API key counts as an admin
+func (p *principal) hasRole(minimum string) bool {
+	switch p.Kind {
+	case principalUser:
+		return auth.RoleAtLeast(p.Role, minimum)
+	case principalToken, principalClient:
+		return auth.RoleAtLeast(auth.RoleUser, minimum)
+	case principalAPIKey:
+		return p.Service == serviceAdmin
+	}
+	return false
+}
+
+// Returned when the request carries no credentials at all
+var errNoCredentials = &apiError{Status: 401, Code: codeUnauthorized, Detail: "No credentials provided"}
+
+// Credentials that are there but no good, the detail is shown to the caller
+func errBadCredentials(detail string, err error) error {
+	return &apiError{Status: 401, Code: codeUnauthorized, Detail: detail, Err: err}
+}
+
+// Resolves the caller from the Authorization header, which carries a JWT,
+// a personal access token (chirpy_pat_...) or an API key. The scheme isn't
+// checked, Polka sends "ApiKey <key>" and everything else "Bearer <token>".
+// Bad credentials are 401 apiErrors, other errors are failures to check them.
+func (cfg *apiConfig) authenticate(req *http.Request) (*principal, error) {
+	if req.Header.Get("Authorization") == "" {
+		return nil, errNoCredentials
+	}
+	token, err := auth.GetBearerToken(req.Header)
+	if err != nil {
+		return nil, errBadCredentials("Malformed Authorization header", err)
+	}
+
+	if service, ok := cfg.apiKeyService(token); ok {
+		return &principal{Kind: principalAPIKey, Service: service}, nil
+	}
+
+	if auth.IsPersonalAccessToken(token) {
+		pat, err := cfg.db.GetPersonalAccessToken(req.Context(), auth.HashToken(token))
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return nil, errBadCredentials("Invalid personal access token", nil)
+			}
+			return nil, fmt.Errorf("Error getting personal access token: %w", err)
+		}
+		// Only informational, a failed update shouldn't fail the request
+		cfg.db.TouchPersonalAccessToken(req.Context(), pat.ID)
+		return &principal{Kind: principalToken, UserID: pat.UserID, Role: auth.RoleUser, TokenID: pat.ID, Scopes: pat.Scopes}, nil
+	}
+
+	access, err := auth.ValidateAccessToken(token, cfg.jwt, cfg.tokenPolicy)
+	if err != nil {
+		return nil, errBadCredentials("Access token is invalid or expired", err)
+	}
+
+	if access.ClientID != "" {
+		revoked, err := cfg.db.IsOauthAccessTokenRevoked(req.Context(), access.ID)
+		if err != nil {
+			return nil, fmt.Errorf("Error checking token revocation: %w", err)
+		}
+		if revoked {
+			return nil, errBadCredentials("Access token has been revoked", nil)
+		}
+		return &principal{Kind: principalClient, UserID: access.UserID, Role: auth.RoleUser, TokenID: access.ID, Scopes: access.Scopes, ClientID: access.ClientID}, nil
+	}
+	return &principal{Kind: principalUser, UserID: access.UserID, Role: access.Role}, nil
+}
+
+func (cfg *apiConfig) apiKeyService(key string) (string, bool) {
+	keys := map[string]string{
+		serviceAdmin: cfg.adminKey,
+	}
+	for service, expected := range keys {
+		// An unset key never matches, not even an empty one
+		if expected != "" && subtle.ConstantTimeCompare([]byte(key), []byte(expected)) == 1 {
+			return service, true
+		}
+	}
+	return "", false
+}
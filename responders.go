@@ -2,7 +2,12 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
 	"net/http"
+	"reflect"
 )
 
 func respondWithText(w http.ResponseWriter, code int, msg string) {
@@ -21,9 +26,180 @@ func respondWithJSON(w http.ResponseWriter, code int, payload interface{}) {
 	w.Header().Set("Content-Type", "application/json")
 	dat, err := json.Marshal(payload)
 	if err != nil {
-		respondWithText(w, 500, "Could not encode the response")
+		respondWithInternalError(w, "Could not encode the response", err)
 		return
 	}
 	w.WriteHeader(code)
 	w.Write(dat)
 }
+
+// Errors are answered with RFC 9457 problem details. The OAuth token endpoints
+// are the exception, their error format is fixed by RFC 6749.
+const problemContentType = "application/problem+json"
+
+// Problem types are URNs of the error code, the code alone is also part of
+// every problem for clients that would rather match on it
+const problemTypePrefix = "urn:chirpy:problem:"
+
+// Error codes shared by many endpoints, endpoints add their own for errors
+// clients are expected to handle specially
+const (
+	codeInvalidJSON      = "invalid_json"
+	codeInvalidID        = "invalid_id"
+	codeValidationFailed = "validation_failed"
+	codeUnauthorized     = "unauthorized"
+	codeForbidden        = "forbidden"
+	codeNotFound         = "not_found"
+	codeConflict         = "conflict"
+	codeRateLimited      = "rate_limited"
+	codeBodyTooLarge     = "body_too_large"
+	codeInternal         = "internal_error"
+	codeUnavailable      = "unavailable"
+)
+
+// An error as the client gets to see it. Detail is sent as is, Err is the
+// underlying cause and only ever logged.
+type apiError struct {
+	Status int
+	Code   string
+	Detail string
+	Fields []fieldError
+	Err    error
+}
+
+func (e *apiError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("%s: %s", e.Detail, e.Err)
+	}
+	return e.Detail
+}
+
+func (e *apiError) Unwrap() error {
+	return e.Err
+}
+
+// What's wrong with one field of the request body
+type fieldError struct {
+	Field  string `json:"field"`
+	Code   string `json:"code"`
+	Detail string `json:"detail"`
+}
+
+type outputProblem struct {
+	Type      string       `json:"type"`
+	Title     string       `json:"title"`
+	Status    int          `json:"status"`
+	Detail    string       `json:"detail,omitempty"`
+	Code      string       `json:"code"`
+	RequestID string       `json:"request_id,omitempty"`
+	Errors    []fieldError `json:"errors,omitempty"`
+}
+
+// Answers err as a problem. Errors other than *apiError are internal errors.
+// Server errors are logged with their cause and the request ID the client gets,
+// so reports from clients can be matched to the log.
+func respondWithProblem(w http.ResponseWriter, err error) {
+	var aErr *apiError
+	if !errors.As(err, &aErr) {
+		aErr = &apiError{Status: 500, Code: codeInternal, Detail: "Internal error", Err: err}
+	}
+	id := w.Header().Get(requestIDHeader)
+	if aErr.Status >= 500 {
+		slog.Error("Server error", "request_id", id, "status", aErr.Status, "code", aErr.Code, "error", aErr.Error())
+	} else if aErr.Err != nil {
+		slog.Info("Request rejected", "request_id", id, "status", aErr.Status, "code", aErr.Code, "error", aErr.Error())
+	}
+
+	oProblem := outputProblem{
+		Type:      problemTypePrefix + aErr.Code,
+		Title:     http.StatusText(aErr.Status),
+		Status:    aErr.Status,
+		Detail:    aErr.Detail,
+		Code:      aErr.Code,
+		RequestID: id,
+		Errors:    aErr.Fields,
+	}
+	dat, err := json.Marshal(oProblem)
+	if err != nil {
+		// Can't happen with the types above
+		respondWithText(w, 500, "Could not encode the error")
+		return
+	}
+	w.Header().Set("Content-Type", problemContentType)
+	w.WriteHeader(aErr.Status)
+	w.Write(dat)
+}
+
+// Problem with a stable code clients can match on, detail is shown to the client
+func respondWithError(w http.ResponseWriter, code int, errCode, detail string) {
+	respondWithProblem(w, &apiError{Status: code, Code: errCode, Detail: detail})
+}
+
+// 500 telling the client what failed but not why, err is only logged
+func respondWithInternalError(w http.ResponseWriter, detail string, err error) {
+	respondWithProblem(w, &apiError{Status: 500, Code: codeInternal, Detail: detail, Err: err})
+}
+
+// 413 for a body over the size limit, 400 when it couldn't be read otherwise
+func respondWithBodyError(w http.ResponseWriter, err error) {
+	var maxErr *http.MaxBytesError
+	if errors.As(err, &maxErr) {
+		respondWithError(w, 413, codeBodyTooLarge, fmt.Sprintf("Request body is larger than %d bytes", maxErr.Limit))
+		return
+	}
+	respondWithProblem(w, &apiError{Status: 400, Code: "invalid_body", Detail: "Could not read the request body", Err: err})
+}
+
+// 400 for a request body that isn't the JSON the endpoint takes
+func respondWithInvalidJSON(w http.ResponseWriter, err error) {
+	var maxErr *http.MaxBytesError
+	if errors.As(err, &maxErr) {
+		respondWithBodyError(w, err)
+		return
+	}
+	detail := fmt.Sprintf("Request body is not valid JSON: %s", err)
+	if errors.Is(err, io.EOF) {
+		detail = "Request body is empty, JSON expected"
+	}
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) && typeErr.Field != "" {
+		// Point at the field, e.g. a number where a string belongs
+		respondWithValidation(w, fieldError{
+			Field:  typeErr.Field,
+			Code:   "invalid_type",
+			Detail: fmt.Sprintf("Must be a %s", jsonTypeName(typeErr.Type.Kind())),
+		})
+		return
+	}
+	respondWithProblem(w, &apiError{Status: 400, Code: codeInvalidJSON, Detail: detail})
+}
+
+// Kinds of Go values in the words of JSON
+func jsonTypeName(kind reflect.Kind) string {
+	switch kind {
+	case reflect.String:
+		return "string"
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Slice, reflect.Array:
+		return "array"
+	case reflect.Map, reflect.Struct:
+		return "object"
+	default:
+		return "number"
+	}
+}
+
+// 400 for a malformed ID in the path or query, name is what it identifies
+func respondWithInvalidID(w http.ResponseWriter, name string) {
+	respondWithError(w, 400, codeInvalidID, fmt.Sprintf("Not valid %s ID", name))
+}
+
+// 400 listing every invalid field of the request body
+func respondWithValidation(w http.ResponseWriter, fields ...fieldError) {
+	detail := "The request has invalid fields"
+	if len(fields) == 1 {
+		detail = fields[0].Detail
+	}
+	respondWithProblem(w, &apiError{Status: 400, Code: codeValidationFailed, Detail: detail, Fields: fields})
+}
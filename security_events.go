@@ -0,0 +1,31 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+
+	"github.com/google/uuid"
+	"github.com/pauslik/chirpy/internal/database"
+)
+
+// Events worth an audit trail, stored in security_events and logged
+const (
+	securityEventRefreshReuse = "refresh_token_reuse"
+)
+
+// Best effort, the request that triggered the event is answered either way
+func (cfg *apiConfig) logSecurityEvent(req *http.Request, userID uuid.UUID, event, details string) {
+	ip := clientIP(req)
+	slog.WarnContext(req.Context(), "Security event", "event", event, "user_id", userID, "ip", ip, "details", details)
+
+	csep := database.CreateSecurityEventParams{
+		UserID:  userID,
+		Event:   event,
+		Ip:      ip,
+		Details: details,
+	}
+	err := cfg.db.CreateSecurityEvent(req.Context(), csep)
+	if err != nil {
+		slog.ErrorContext(req.Context(), "Could not save security event", "event", event, "error", err)
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// Serves until ctx is done, then stops accepting connections and gives
+// in-flight requests and the background work up to timeout to finish. Errors
+// when the server couldn't start or something was cut off.
+func (cfg *apiConfig) serve(ctx context.Context, server *http.Server, timeout time.Duration) error {
+	listenErr := make(chan error, 1)
+	go func() {
+		listenErr <- server.ListenAndServe()
+	}()
+
+	select {
+	case err := <-listenErr:
+		// Never started, e.g. the port is taken
+		return err
+	case <-ctx.Done():
+	}
+	slog.Info("Shutting down", "timeout", timeout)
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	err := server.Shutdown(shutdownCtx)
+	if err != nil {
+		server.Close()
+		return fmt.Errorf("requests still in flight after %s: %w", timeout, err)
+	}
+
+	// The workers stop picking up new work once ctx is done
+	done := make(chan struct{})
+	go func() {
+		cfg.background.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-shutdownCtx.Done():
+		return errors.New("background work still running after " + timeout.String())
+	}
+}
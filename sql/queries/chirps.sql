@@ -29,4 +29,9 @@ FROM chirps
 WHERE id = $1;
 
 -- name: ResetChirps :exec
-DELETE FROM chirps;
\ No newline at end of file
+DELETE FROM chirps;
+
+-- name: CountUserChirpsSince :one
+SELECT COUNT(*)
+FROM chirps
+WHERE user_id = $1 AND created_at > $2;
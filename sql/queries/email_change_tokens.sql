@@ -0,0 +1,16 @@
+-- name: CreateEmailChangeToken :one
+INSERT INTO email_change_tokens (token_hash, created_at, user_id, new_email, expires_at)
+VALUES (
+    $1,
+    NOW(),
+    $2,
+    $3,
+    $4
+)
+RETURNING *;
+
+-- name: ConsumeEmailChangeToken :one
+UPDATE email_change_tokens
+SET used_at = NOW()
+WHERE token_hash = $1 AND used_at IS NULL AND expires_at > NOW()
+RETURNING *;
\ No newline at end of file
@@ -0,0 +1,29 @@
+-- name: GetLoginThrottle :one
+SELECT *
+FROM login_throttles
+WHERE key = $1;
+
+-- name: RecordLoginFailure :one
+INSERT INTO login_throttles (key, failures, last_failure_at)
+VALUES (
+    $1,
+    1,
+    NOW()
+)
+ON CONFLICT (key) DO UPDATE
+SET failures = CASE
+        WHEN login_throttles.last_failure_at < NOW() - INTERVAL '24 hours' THEN 1
+        ELSE login_throttles.failures + 1
+    END,
+    last_failure_at = NOW()
+RETURNING *;
+
+-- name: LockLogin :exec
+UPDATE login_throttles
+SET locked_until = $2
+WHERE key = $1;
+
+-- name: ClearLoginThrottle :exec
+DELETE
+FROM login_throttles
+WHERE key = $1;
\ No newline at end of file
@@ -0,0 +1,27 @@
+-- name: CreateOauthClient :one
+INSERT INTO oauth_clients (id, user_id, name, secret_hash, redirect_uris, scopes, created_at)
+VALUES (
+    gen_random_uuid(),
+    $1,
+    $2,
+    $3,
+    $4,
+    $5,
+    NOW()
+)
+RETURNING *;
+
+-- name: GetOauthClient :one
+SELECT *
+FROM oauth_clients
+WHERE id = $1;
+
+-- name: GetUserOauthClients :many
+SELECT *
+FROM oauth_clients
+WHERE user_id = $1
+ORDER BY created_at DESC;
+
+-- name: DeleteOauthClient :execrows
+DELETE FROM oauth_clients
+WHERE id = $1 AND user_id = $2;
@@ -0,0 +1,98 @@
+-- name: CreateOauthAuthorizationCode :exec
+INSERT INTO oauth_authorization_codes (code_hash, client_id, user_id, redirect_uri, scopes, code_challenge, expires_at)
+VALUES (
+    $1,
+    $2,
+    $3,
+    $4,
+    $5,
+    $6,
+    $7
+);
+
+-- name: ConsumeOauthAuthorizationCode :one
+DELETE FROM oauth_authorization_codes
+WHERE code_hash = $1 AND client_id = $2 AND expires_at > NOW()
+RETURNING *;
+
+-- name: CreateOauthRefreshToken :exec
+INSERT INTO oauth_refresh_tokens (token_hash, client_id, user_id, scopes, created_at, expires_at, access_jti, access_expires_at)
+VALUES (
+    $1,
+    $2,
+    $3,
+    $4,
+    NOW(),
+    $5,
+    $6,
+    $7
+);
+
+-- name: GetOauthRefreshToken :one
+SELECT *
+FROM oauth_refresh_tokens
+WHERE token_hash = $1 AND revoked_at IS NULL AND expires_at > NOW();
+
+-- name: UseOauthRefreshToken :one
+UPDATE oauth_refresh_tokens
+SET revoked_at = NOW()
+WHERE token_hash = $1 AND client_id = $2 AND revoked_at IS NULL AND expires_at > NOW()
+RETURNING *;
+
+-- name: RevokeOauthRefreshToken :execrows
+UPDATE oauth_refresh_tokens
+SET revoked_at = NOW()
+WHERE token_hash = $1 AND client_id = $2 AND revoked_at IS NULL;
+
+-- name: RevokeOauthAccessToken :exec
+INSERT INTO oauth_revoked_access_tokens (jti, expires_at)
+VALUES (
+    $1,
+    $2
+)
+ON CONFLICT (jti) DO NOTHING;
+
+-- name: IsOauthAccessTokenRevoked :one
+SELECT EXISTS (
+    SELECT 1
+    FROM oauth_revoked_access_tokens
+    WHERE jti = $1
+);
+
+-- name: DeleteExpiredOauthRevocations :exec
+-- cutoff leaves room for the leeway tokens are still accepted with after they expire
+DELETE FROM oauth_revoked_access_tokens
+WHERE expires_at < sqlc.arg(cutoff);
+
+-- name: GetUserOauthAuthorizations :many
+SELECT DISTINCT ON (oauth_refresh_tokens.client_id) oauth_refresh_tokens.client_id, oauth_clients.name, oauth_refresh_tokens.scopes, oauth_refresh_tokens.created_at
+FROM oauth_refresh_tokens
+JOIN oauth_clients ON oauth_clients.id = oauth_refresh_tokens.client_id
+WHERE oauth_refresh_tokens.user_id = $1 AND oauth_refresh_tokens.revoked_at IS NULL AND oauth_refresh_tokens.expires_at > NOW()
+ORDER BY oauth_refresh_tokens.client_id, oauth_refresh_tokens.created_at DESC;
+
+-- name: RevokeUserOauthClientAccessTokens :exec
+-- Every access token the app got for the user that may still be in use
+INSERT INTO oauth_revoked_access_tokens (jti, expires_at)
+SELECT access_jti, access_expires_at
+FROM oauth_refresh_tokens
+WHERE user_id = sqlc.arg(user_id) AND client_id = sqlc.arg(client_id) AND access_expires_at > sqlc.arg(cutoff)
+ON CONFLICT (jti) DO NOTHING;
+
+-- name: RevokeUserOauthClientRefreshTokens :execrows
+UPDATE oauth_refresh_tokens
+SET revoked_at = NOW()
+WHERE user_id = $1 AND client_id = $2 AND revoked_at IS NULL;
+
+-- name: RevokeUserOauthAccessTokens :exec
+-- Every access token any app got for the user that may still be in use
+INSERT INTO oauth_revoked_access_tokens (jti, expires_at)
+SELECT access_jti, access_expires_at
+FROM oauth_refresh_tokens
+WHERE user_id = sqlc.arg(user_id) AND access_expires_at > sqlc.arg(cutoff)
+ON CONFLICT (jti) DO NOTHING;
+
+-- name: RevokeUserOauthRefreshTokens :exec
+UPDATE oauth_refresh_tokens
+SET revoked_at = NOW()
+WHERE user_id = $1 AND revoked_at IS NULL;
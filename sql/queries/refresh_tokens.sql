@@ -1,27 +1,59 @@
 -- name: CreateRefreshToken :one
-INSERT INTO refresh_tokens (token, created_at, updated_at, user_id, expires_at)
+INSERT INTO refresh_tokens (token_hash, created_at, updated_at, user_id, expires_at, family_id, session_started_at, last_used_at, user_agent, ip)
 VALUES (
     $1,
     NOW(),
     NOW(),
     $2,
-    $3
+    $3,
+    $4,
+    $5,
+    NOW(),
+    $6,
+    $7
 )
 RETURNING *;
 
 -- name: GetRefreshToken :one
 SELECT *
 FROM refresh_tokens
-WHERE token = $1;
+WHERE token_hash = $1;
 
 -- name: GetUserFromRefreshToken :one
 SELECT users.*
 FROM users
 LEFT JOIN refresh_tokens
 ON users.id = refresh_tokens.user_id
-WHERE token = $1;
+WHERE token_hash = $1;
+
+-- name: GetUserSessions :many
+SELECT *
+FROM refresh_tokens
+WHERE user_id = $1 AND rotated_at IS NULL AND revoked_at IS NULL AND expires_at > NOW()
+ORDER BY last_used_at DESC;
+
+-- name: RevokeUserSession :execrows
+UPDATE refresh_tokens
+SET revoked_at = NOW(), updated_at = NOW()
+WHERE user_id = $1 AND family_id = $2 AND revoked_at IS NULL;
+
+-- name: RotateRefreshToken :one
+UPDATE refresh_tokens
+SET rotated_at = NOW(), updated_at = NOW()
+WHERE token_hash = $1 AND rotated_at IS NULL AND revoked_at IS NULL AND expires_at > NOW()
+RETURNING *;
 
 -- name: RevokeRefreshToken :exec
 UPDATE refresh_tokens
 SET revoked_at = NOW(), updated_at = NOW()
-WHERE token = $1;
\ No newline at end of file
+WHERE token_hash = $1;
+
+-- name: RevokeRefreshTokenFamily :exec
+UPDATE refresh_tokens
+SET revoked_at = NOW(), updated_at = NOW()
+WHERE family_id = $1 AND revoked_at IS NULL;
+
+-- name: RevokeUserRefreshTokens :exec
+UPDATE refresh_tokens
+SET revoked_at = NOW(), updated_at = NOW()
+WHERE user_id = $1 AND revoked_at IS NULL;
\ No newline at end of file
@@ -0,0 +1,10 @@
+-- name: CreateSecurityEvent :exec
+INSERT INTO security_events (id, created_at, user_id, event, ip, details)
+VALUES (
+    gen_random_uuid(),
+    NOW(),
+    $1,
+    $2,
+    $3,
+    $4
+);
\ No newline at end of file
@@ -0,0 +1,45 @@
+-- name: CreateSubscription :one
+INSERT INTO subscriptions (id, user_id, status, current_period_start, current_period_end, created_at, updated_at)
+VALUES (
+    gen_random_uuid(),
+    $1,
+    'active',
+    $2,
+    $3,
+    NOW(),
+    NOW()
+)
+RETURNING *;
+
+-- name: GetCurrentSubscription :one
+SELECT *
+FROM subscriptions
+WHERE user_id = $1
+ORDER BY created_at DESC
+LIMIT 1;
+
+-- name: RenewSubscription :one
+-- The first renewal of a backfilled subscription gives it a real period
+UPDATE subscriptions
+SET status = 'active', current_period_start = $2, current_period_end = $3, source = 'polka', updated_at = NOW()
+WHERE id = $1
+RETURNING *;
+
+-- name: MarkSubscriptionPastDue :one
+UPDATE subscriptions
+SET status = 'past_due', updated_at = NOW()
+WHERE id = $1
+RETURNING *;
+
+-- name: EndSubscription :one
+UPDATE subscriptions
+SET status = $2, ended_at = NOW(), updated_at = NOW()
+WHERE id = $1
+RETURNING *;
+
+-- name: ExpireLapsedSubscriptions :many
+-- Backfilled subscriptions have no real period end, they wait for a renewal
+UPDATE subscriptions
+SET status = 'expired', ended_at = NOW(), updated_at = NOW()
+WHERE status IN ('active', 'past_due') AND current_period_end < NOW() AND source <> 'backfill'
+RETURNING *;
@@ -0,0 +1,30 @@
+-- name: UpsertTotpCredential :one
+INSERT INTO totp_credentials (user_id, secret, created_at)
+VALUES (
+    $1,
+    $2,
+    NOW()
+)
+ON CONFLICT (user_id) DO UPDATE
+SET secret = EXCLUDED.secret, created_at = NOW(), confirmed_at = NULL, last_used_step = 0
+RETURNING *;
+
+-- name: GetTotpCredential :one
+SELECT *
+FROM totp_credentials
+WHERE user_id = $1;
+
+-- name: ConfirmTotpCredential :exec
+UPDATE totp_credentials
+SET confirmed_at = NOW()
+WHERE user_id = $1;
+
+-- name: UseTotpStep :execrows
+UPDATE totp_credentials
+SET last_used_step = $2
+WHERE user_id = $1 AND last_used_step < $2;
+
+-- name: DeleteTotpCredential :exec
+DELETE
+FROM totp_credentials
+WHERE user_id = $1;
\ No newline at end of file
@@ -0,0 +1,31 @@
+-- name: GrantUserEntitlement :one
+-- Replaces an earlier grant of the same entitlement
+INSERT INTO user_entitlements (user_id, name, value, reason, granted_by, expires_at, created_at)
+VALUES (
+    $1,
+    $2,
+    $3,
+    $4,
+    $5,
+    $6,
+    NOW()
+)
+ON CONFLICT (user_id, name) DO UPDATE
+SET value = EXCLUDED.value, reason = EXCLUDED.reason, granted_by = EXCLUDED.granted_by,
+    expires_at = EXCLUDED.expires_at, created_at = EXCLUDED.created_at
+RETURNING *;
+
+-- name: GetUserEntitlements :many
+-- Grants that haven't expired
+SELECT *
+FROM user_entitlements
+WHERE user_id = $1 AND (expires_at IS NULL OR expires_at > NOW())
+ORDER BY name;
+
+-- name: RevokeUserEntitlement :execrows
+DELETE FROM user_entitlements
+WHERE user_id = $1 AND name = $2;
+
+-- name: DeleteExpiredUserEntitlements :exec
+DELETE FROM user_entitlements
+WHERE expires_at < NOW();
@@ -0,0 +1,41 @@
+-- name: CreateUserIdentity :one
+INSERT INTO user_identities (id, user_id, provider, subject, email, created_at, last_login_at)
+VALUES (
+    gen_random_uuid(),
+    $1,
+    $2,
+    $3,
+    $4,
+    NOW(),
+    NOW()
+)
+RETURNING *;
+
+-- name: GetUserIdentity :one
+SELECT *
+FROM user_identities
+WHERE provider = $1 AND subject = $2;
+
+-- name: TouchUserIdentity :exec
+UPDATE user_identities
+SET email = $2, last_login_at = NOW()
+WHERE id = $1;
+
+-- name: CreateOidcLoginState :exec
+INSERT INTO oidc_login_states (state_hash, provider, code_verifier, nonce, expires_at)
+VALUES (
+    $1,
+    $2,
+    $3,
+    $4,
+    $5
+);
+
+-- name: ConsumeOidcLoginState :one
+DELETE FROM oidc_login_states
+WHERE state_hash = $1 AND provider = $2 AND expires_at > NOW()
+RETURNING *;
+
+-- name: DeleteExpiredOidcLoginStates :exec
+DELETE FROM oidc_login_states
+WHERE expires_at <= NOW();
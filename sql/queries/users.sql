@@ -14,17 +14,51 @@ SELECT *
 FROM users
 WHERE email = $1;
 
--- name: UpdateUser :one
-UPDATE users 
-SET email = $2, hashed_password = $3, updated_at = NOW()
+-- name: GetUserByID :one
+SELECT *
+FROM users
+WHERE id = $1;
+
+-- name: UpdateUserEmail :one
+UPDATE users
+SET email = $2, updated_at = NOW()
 WHERE id = $1
 RETURNING *;
 
+-- name: UpdateUserPassword :one
+UPDATE users
+SET hashed_password = $2, updated_at = NOW()
+WHERE id = $1
+RETURNING *;
+
+-- name: RehashUserPassword :exec
+-- Only replaces the hash that was checked, a password changed in the meantime wins
+UPDATE users
+SET hashed_password = sqlc.arg(new_hash)
+WHERE id = sqlc.arg(id) AND hashed_password = sqlc.arg(old_hash);
+
 -- name: UpgradeUserRed :one
 UPDATE users 
 SET is_chirpy_red = TRUE, updated_at = NOW()
 WHERE id = $1
 RETURNING *;
 
+-- name: DowngradeUserRed :one
+UPDATE users
+SET is_chirpy_red = FALSE, updated_at = NOW()
+WHERE id = $1
+RETURNING *;
+
 -- name: ResetUsers :exec
-DELETE FROM users;
\ No newline at end of file
+DELETE FROM users;
+
+-- name: SetUserRole :one
+UPDATE users
+SET role = $2, updated_at = NOW()
+WHERE id = $1
+RETURNING *;
+
+-- name: CountAdmins :one
+SELECT COUNT(*)
+FROM users
+WHERE role = 'admin';
@@ -0,0 +1,83 @@
+-- name: CreateWebhookDelivery :exec
+INSERT INTO webhook_deliveries (id, endpoint_id, event_id, event, payload, traceparent, status, next_attempt_at, created_at)
+VALUES (
+    gen_random_uuid(),
+    $1,
+    $2,
+    $3,
+    $4,
+    $5,
+    'pending',
+    NOW(),
+    NOW()
+);
+
+-- name: ClaimWebhookDelivery :one
+-- Skips endpoints with a delivery out under an unexpired lease, on any
+-- instance, so each endpoint gets one at a time and a slow one can't take
+-- every sender
+UPDATE webhook_deliveries
+SET status = 'delivering', attempts = attempts + 1, next_attempt_at = sqlc.arg(lease_until)
+WHERE id = (
+    SELECT due.id
+    FROM webhook_deliveries due
+    WHERE due.status IN ('pending', 'delivering', 'failed') AND due.next_attempt_at <= NOW()
+        AND NOT EXISTS (
+            SELECT 1
+            FROM webhook_deliveries sending
+            WHERE sending.endpoint_id = due.endpoint_id AND sending.status = 'delivering' AND sending.next_attempt_at > NOW()
+        )
+    ORDER BY due.next_attempt_at
+    LIMIT 1
+    FOR UPDATE SKIP LOCKED
+)
+RETURNING *;
+
+-- name: MarkWebhookDeliveryDelivered :exec
+UPDATE webhook_deliveries
+SET status = 'delivered', delivered_at = NOW()
+WHERE id = $1;
+
+-- name: FailWebhookDelivery :exec
+UPDATE webhook_deliveries
+SET status = $2, next_attempt_at = $3
+WHERE id = $1;
+
+-- name: CreateWebhookDeliveryAttempt :exec
+INSERT INTO webhook_delivery_attempts (id, delivery_id, attempted_at, duration_ms, response_status, error)
+VALUES (
+    gen_random_uuid(),
+    $1,
+    $2,
+    $3,
+    $4,
+    $5
+);
+
+-- name: GetEndpointWebhookDeliveries :many
+SELECT *
+FROM webhook_deliveries
+WHERE endpoint_id = $1
+ORDER BY created_at DESC
+LIMIT $2;
+
+-- name: GetWebhookDelivery :one
+SELECT *
+FROM webhook_deliveries
+WHERE id = $1 AND endpoint_id = $2;
+
+-- name: GetWebhookDeliveryAttempts :many
+SELECT *
+FROM webhook_delivery_attempts
+WHERE delivery_id = $1
+ORDER BY attempted_at;
+
+-- name: RedeliverWebhookDelivery :one
+UPDATE webhook_deliveries
+SET status = 'pending', attempts = 0, next_attempt_at = NOW(), delivered_at = NULL
+WHERE id = $1 AND endpoint_id = $2 AND status <> 'delivering'
+RETURNING *;
+
+-- name: DeleteOldWebhookDeliveries :exec
+DELETE FROM webhook_deliveries
+WHERE status = 'delivered' AND delivered_at < NOW() - INTERVAL '30 days';
@@ -0,0 +1,44 @@
+-- name: CreateWebhookEndpoint :one
+INSERT INTO webhook_endpoints (id, client_id, url, secret, events, created_at)
+VALUES (
+    gen_random_uuid(),
+    $1,
+    $2,
+    $3,
+    $4,
+    NOW()
+)
+RETURNING *;
+
+-- name: GetWebhookEndpoint :one
+SELECT *
+FROM webhook_endpoints
+WHERE id = $1;
+
+-- name: GetClientWebhookEndpoints :many
+SELECT *
+FROM webhook_endpoints
+WHERE client_id = $1
+ORDER BY created_at;
+
+-- name: DeleteWebhookEndpoint :execrows
+DELETE FROM webhook_endpoints
+WHERE id = $1 AND client_id = $2;
+
+-- name: GetWebhookEndpointsForEvent :many
+SELECT *
+FROM webhook_endpoints
+WHERE sqlc.arg(event)::text = ANY(events);
+
+-- name: GetWebhookEndpointsForUserEvent :many
+-- Only apps the user has authorized and not revoked
+SELECT *
+FROM webhook_endpoints
+WHERE sqlc.arg(event)::text = ANY(events) AND EXISTS (
+    SELECT 1
+    FROM oauth_refresh_tokens
+    WHERE oauth_refresh_tokens.client_id = webhook_endpoints.client_id
+        AND oauth_refresh_tokens.user_id = sqlc.arg(user_id)
+        AND revoked_at IS NULL
+        AND expires_at > NOW()
+);
@@ -0,0 +1,78 @@
+-- name: CreateWebhookEvent :execrows
+INSERT INTO webhook_events (id, source, event_id, event, payload, traceparent, subject, status, next_attempt_at, received_at)
+VALUES (
+    gen_random_uuid(),
+    $1,
+    $2,
+    $3,
+    $4,
+    $5,
+    $6,
+    'pending',
+    NOW(),
+    NOW()
+)
+ON CONFLICT (source, event_id) DO NOTHING;
+
+-- name: ClaimWebhookEvent :one
+-- Skips events whose subject has an earlier one that isn't done yet, so a
+-- retried event can't be overtaken by a later one about the same user.
+-- Dead-lettered events don't hold anything up.
+UPDATE webhook_events
+SET status = 'processing', attempts = attempts + 1, next_attempt_at = $1
+WHERE id = (
+    SELECT id
+    FROM webhook_events
+    WHERE status IN ('pending', 'processing', 'failed') AND next_attempt_at <= NOW()
+        AND NOT EXISTS (
+            SELECT 1
+            FROM webhook_events AS earlier
+            WHERE webhook_events.subject <> ''
+                AND earlier.subject = webhook_events.subject
+                AND earlier.status IN ('pending', 'processing', 'failed')
+                AND earlier.received_at < webhook_events.received_at
+        )
+    ORDER BY next_attempt_at
+    LIMIT 1
+    FOR UPDATE SKIP LOCKED
+)
+RETURNING *;
+
+-- name: MarkWebhookEventProcessed :exec
+UPDATE webhook_events
+SET status = 'processed', last_error = NULL, processed_at = NOW()
+WHERE id = $1;
+
+-- name: FailWebhookEvent :exec
+UPDATE webhook_events
+SET status = $2, last_error = $3, next_attempt_at = $4
+WHERE id = $1;
+
+-- name: GetWebhookEvent :one
+SELECT *
+FROM webhook_events
+WHERE id = $1;
+
+-- name: ListWebhookEvents :many
+SELECT *
+FROM webhook_events
+ORDER BY received_at DESC
+LIMIT $1;
+
+-- name: ListWebhookEventsByStatus :many
+SELECT *
+FROM webhook_events
+WHERE status = $1
+ORDER BY received_at DESC
+LIMIT $2;
+
+-- name: ReplayWebhookEvent :one
+-- Only events that weren't applied, processed ones would be applied twice
+UPDATE webhook_events
+SET status = 'pending', attempts = 0, last_error = NULL, next_attempt_at = NOW()
+WHERE id = $1 AND status NOT IN ('processing', 'processed')
+RETURNING *;
+
+-- name: DeleteOldWebhookEvents :exec
+DELETE FROM webhook_events
+WHERE status = 'processed' AND processed_at < NOW() - INTERVAL '30 days';
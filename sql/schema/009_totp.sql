@@ -0,0 +1,22 @@
+-- +goose Up
+CREATE TABLE totp_credentials (
+    user_id uuid PRIMARY KEY,
+    secret TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    confirmed_at TIMESTAMP DEFAULT NULL,
+    last_used_step BIGINT NOT NULL DEFAULT 0,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE TABLE recovery_codes (
+    id uuid PRIMARY KEY,
+    user_id uuid NOT NULL,
+    code_hash TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    used_at TIMESTAMP DEFAULT NULL,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+-- +goose Down
+DROP TABLE recovery_codes;
+DROP TABLE totp_credentials;
\ No newline at end of file
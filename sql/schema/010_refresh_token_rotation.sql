@@ -0,0 +1,41 @@
+-- +goose Up
+ALTER TABLE refresh_tokens
+RENAME COLUMN token TO token_hash;
+
+-- Existing tokens keep working, they are looked up by their SHA-256 from now on
+UPDATE refresh_tokens
+SET token_hash = encode(sha256(token_hash::bytea), 'hex');
+
+ALTER TABLE refresh_tokens
+ADD COLUMN family_id uuid NOT NULL DEFAULT gen_random_uuid(),
+ADD COLUMN rotated_at TIMESTAMP DEFAULT NULL;
+
+ALTER TABLE refresh_tokens
+ALTER COLUMN family_id DROP DEFAULT;
+
+CREATE INDEX refresh_tokens_family_id_idx ON refresh_tokens (family_id);
+
+CREATE TABLE security_events (
+    id uuid PRIMARY KEY,
+    created_at TIMESTAMP NOT NULL,
+    user_id uuid NOT NULL,
+    event TEXT NOT NULL,
+    ip TEXT NOT NULL,
+    details TEXT NOT NULL,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+-- +goose Down
+DROP TABLE security_events;
+
+DROP INDEX refresh_tokens_family_id_idx;
+
+-- Hashed tokens can't be turned back into usable ones
+DELETE FROM refresh_tokens;
+
+ALTER TABLE refresh_tokens
+DROP COLUMN rotated_at,
+DROP COLUMN family_id;
+
+ALTER TABLE refresh_tokens
+RENAME COLUMN token_hash TO token;
\ No newline at end of file
@@ -0,0 +1,24 @@
+-- +goose Up
+ALTER TABLE refresh_tokens
+ADD COLUMN session_started_at TIMESTAMP,
+ADD COLUMN last_used_at TIMESTAMP,
+ADD COLUMN user_agent TEXT NOT NULL DEFAULT '',
+ADD COLUMN ip TEXT NOT NULL DEFAULT '';
+
+UPDATE refresh_tokens
+SET session_started_at = created_at, last_used_at = created_at;
+
+ALTER TABLE refresh_tokens
+ALTER COLUMN session_started_at SET NOT NULL,
+ALTER COLUMN last_used_at SET NOT NULL;
+
+CREATE INDEX refresh_tokens_user_id_idx ON refresh_tokens (user_id);
+
+-- +goose Down
+DROP INDEX refresh_tokens_user_id_idx;
+
+ALTER TABLE refresh_tokens
+DROP COLUMN ip,
+DROP COLUMN user_agent,
+DROP COLUMN last_used_at,
+DROP COLUMN session_started_at;
\ No newline at end of file
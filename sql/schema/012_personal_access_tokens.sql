@@ -0,0 +1,16 @@
+-- +goose Up
+CREATE TABLE personal_access_tokens (
+    id uuid PRIMARY KEY,
+    user_id uuid NOT NULL,
+    name TEXT NOT NULL,
+    token_hash TEXT UNIQUE NOT NULL,
+    scopes TEXT[] NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    last_used_at TIMESTAMP DEFAULT NULL,
+    expires_at TIMESTAMP DEFAULT NULL,
+    revoked_at TIMESTAMP DEFAULT NULL,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+-- +goose Down
+DROP TABLE personal_access_tokens;
\ No newline at end of file
@@ -0,0 +1,45 @@
+-- +goose Up
+CREATE TABLE oauth_clients (
+    id UUID PRIMARY KEY,
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    name TEXT NOT NULL,
+    secret_hash TEXT,
+    redirect_uris TEXT[] NOT NULL,
+    scopes TEXT[] NOT NULL,
+    created_at TIMESTAMP NOT NULL
+);
+
+CREATE TABLE oauth_authorization_codes (
+    code_hash TEXT PRIMARY KEY,
+    client_id UUID NOT NULL REFERENCES oauth_clients(id) ON DELETE CASCADE,
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    redirect_uri TEXT NOT NULL,
+    scopes TEXT[] NOT NULL,
+    code_challenge TEXT NOT NULL,
+    expires_at TIMESTAMP NOT NULL
+);
+
+CREATE TABLE oauth_refresh_tokens (
+    token_hash TEXT PRIMARY KEY,
+    client_id UUID NOT NULL REFERENCES oauth_clients(id) ON DELETE CASCADE,
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    scopes TEXT[] NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    revoked_at TIMESTAMP,
+    -- The access token issued along with it, revoked with the app's access
+    access_jti UUID NOT NULL,
+    access_expires_at TIMESTAMP NOT NULL
+);
+
+-- Access tokens are JWTs, revoking one lists its ID here until it would have expired anyway
+CREATE TABLE oauth_revoked_access_tokens (
+    jti UUID PRIMARY KEY,
+    expires_at TIMESTAMP NOT NULL
+);
+
+-- +goose Down
+DROP TABLE oauth_revoked_access_tokens;
+DROP TABLE oauth_refresh_tokens;
+DROP TABLE oauth_authorization_codes;
+DROP TABLE oauth_clients;
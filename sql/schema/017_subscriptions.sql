@@ -0,0 +1,26 @@
+-- +goose Up
+CREATE TABLE subscriptions (
+    id UUID PRIMARY KEY,
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    status TEXT NOT NULL CHECK (status IN ('active', 'past_due', 'canceled', 'refunded', 'expired')),
+    current_period_start TIMESTAMP NOT NULL,
+    current_period_end TIMESTAMP NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    updated_at TIMESTAMP NOT NULL,
+    ended_at TIMESTAMP,
+    -- 'backfill' for members from before subscriptions were tracked: their paid
+    -- period isn't known, so they don't expire until Polka renews them
+    source TEXT NOT NULL DEFAULT 'polka' CHECK (source IN ('polka', 'backfill'))
+);
+
+CREATE INDEX subscriptions_user_id_idx ON subscriptions (user_id, created_at);
+
+-- Chirpy Red members from before subscriptions were tracked get a placeholder
+-- period from now, their next renewal replaces it
+INSERT INTO subscriptions (id, user_id, status, current_period_start, current_period_end, created_at, updated_at, source)
+SELECT gen_random_uuid(), id, 'active', NOW(), NOW() + INTERVAL '1 month', NOW(), NOW(), 'backfill'
+FROM users
+WHERE is_chirpy_red;
+
+-- +goose Down
+DROP TABLE subscriptions;
@@ -0,0 +1,42 @@
+-- +goose Up
+CREATE TABLE webhook_events (
+    id UUID PRIMARY KEY,
+    source TEXT NOT NULL,
+    event_id TEXT NOT NULL,
+    event TEXT NOT NULL,
+    payload TEXT NOT NULL,
+    status TEXT NOT NULL CHECK (status IN ('pending', 'processing', 'processed', 'failed', 'dead')),
+    attempts INTEGER NOT NULL DEFAULT 0,
+    last_error TEXT,
+    -- Next retry, or when a claimed event may be picked up again if its worker died
+    next_attempt_at TIMESTAMP NOT NULL,
+    received_at TIMESTAMP NOT NULL,
+    processed_at TIMESTAMP,
+    UNIQUE (source, event_id)
+);
+
+CREATE INDEX webhook_events_due_idx ON webhook_events (next_attempt_at)
+WHERE status IN ('pending', 'processing', 'failed');
+
+-- Processed event IDs keep deduplicating replays
+INSERT INTO webhook_events (id, source, event_id, event, payload, status, next_attempt_at, received_at, processed_at)
+SELECT gen_random_uuid(), source, event_id, event, '', 'processed', processed_at, processed_at, processed_at
+FROM processed_webhook_events;
+
+DROP TABLE processed_webhook_events;
+
+-- +goose Down
+CREATE TABLE processed_webhook_events (
+    source TEXT NOT NULL,
+    event_id TEXT NOT NULL,
+    event TEXT NOT NULL,
+    processed_at TIMESTAMP NOT NULL,
+    PRIMARY KEY (source, event_id)
+);
+
+INSERT INTO processed_webhook_events (source, event_id, event, processed_at)
+SELECT source, event_id, event, processed_at
+FROM webhook_events
+WHERE status = 'processed';
+
+DROP TABLE webhook_events;
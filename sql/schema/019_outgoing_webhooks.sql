@@ -0,0 +1,43 @@
+-- +goose Up
+CREATE TABLE webhook_endpoints (
+    id UUID PRIMARY KEY,
+    client_id UUID NOT NULL REFERENCES oauth_clients(id) ON DELETE CASCADE,
+    url TEXT NOT NULL,
+    -- Kept in plain text, every delivery is signed with it
+    secret TEXT NOT NULL,
+    events TEXT[] NOT NULL,
+    created_at TIMESTAMP NOT NULL
+);
+
+-- The outbox, one row per event and subscribed endpoint, written in the
+-- transaction of the change that caused the event
+CREATE TABLE webhook_deliveries (
+    id UUID PRIMARY KEY,
+    endpoint_id UUID NOT NULL REFERENCES webhook_endpoints(id) ON DELETE CASCADE,
+    event_id UUID NOT NULL,
+    event TEXT NOT NULL,
+    payload TEXT NOT NULL,
+    status TEXT NOT NULL CHECK (status IN ('pending', 'delivering', 'delivered', 'failed', 'dead')),
+    attempts INTEGER NOT NULL DEFAULT 0,
+    next_attempt_at TIMESTAMP NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    delivered_at TIMESTAMP
+);
+
+CREATE INDEX webhook_deliveries_due_idx ON webhook_deliveries (next_attempt_at)
+WHERE status IN ('pending', 'delivering', 'failed');
+CREATE INDEX webhook_deliveries_endpoint_idx ON webhook_deliveries (endpoint_id, created_at);
+
+CREATE TABLE webhook_delivery_attempts (
+    id UUID PRIMARY KEY,
+    delivery_id UUID NOT NULL REFERENCES webhook_deliveries(id) ON DELETE CASCADE,
+    attempted_at TIMESTAMP NOT NULL,
+    duration_ms INTEGER NOT NULL,
+    response_status INTEGER,
+    error TEXT
+);
+
+-- +goose Down
+DROP TABLE webhook_delivery_attempts;
+DROP TABLE webhook_deliveries;
+DROP TABLE webhook_endpoints;
@@ -0,0 +1,15 @@
+-- +goose Up
+-- Overrides of a user's plan, granted by admins for support cases
+CREATE TABLE user_entitlements (
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    name TEXT NOT NULL,
+    value TEXT NOT NULL,
+    reason TEXT NOT NULL,
+    granted_by UUID REFERENCES users(id) ON DELETE SET NULL,
+    expires_at TIMESTAMP,
+    created_at TIMESTAMP NOT NULL,
+    PRIMARY KEY (user_id, name)
+);
+
+-- +goose Down
+DROP TABLE user_entitlements;
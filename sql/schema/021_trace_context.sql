@@ -0,0 +1,9 @@
+-- +goose Up
+-- W3C traceparent of the request that queued the work, so the worker
+-- continues its trace. Empty when it wasn't traced.
+ALTER TABLE webhook_events ADD COLUMN traceparent TEXT NOT NULL DEFAULT '';
+ALTER TABLE webhook_deliveries ADD COLUMN traceparent TEXT NOT NULL DEFAULT '';
+
+-- +goose Down
+ALTER TABLE webhook_deliveries DROP COLUMN traceparent;
+ALTER TABLE webhook_events DROP COLUMN traceparent;
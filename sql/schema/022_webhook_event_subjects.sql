@@ -0,0 +1,16 @@
+-- +goose Up
+-- Who the event is about, e.g. the Chirpy user of a Polka event. Events with
+-- the same subject are processed in the order they came in. Empty for none.
+ALTER TABLE webhook_events ADD COLUMN subject TEXT NOT NULL DEFAULT '';
+
+-- Only events still waiting to be processed need it
+UPDATE webhook_events
+SET subject = COALESCE(payload::jsonb -> 'data' ->> 'user_id', '')
+WHERE source = 'polka' AND status IN ('pending', 'processing', 'failed');
+
+CREATE INDEX webhook_events_subject_idx ON webhook_events (subject, received_at)
+WHERE status IN ('pending', 'processing', 'failed');
+
+-- +goose Down
+DROP INDEX webhook_events_subject_idx;
+ALTER TABLE webhook_events DROP COLUMN subject;
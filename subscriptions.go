@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// Subscription statuses, active and past_due subscriptions keep Chirpy Red
+const (
+	subscriptionActive   = "active"
+	subscriptionPastDue  = "past_due"
+	subscriptionCanceled = "canceled"
+	subscriptionRefunded = "refunded"
+	subscriptionExpired  = "expired"
+)
+
+// Made by the migration for members from before subscriptions were tracked,
+// their period end is a placeholder until the first renewal
+const subscriptionSourceBackfill = "backfill"
+
+func subscriptionLive(status string) bool {
+	return status == subscriptionActive || status == subscriptionPastDue
+}
+
+// Ends subscriptions whose paid period is over without a renewal and takes
+// Chirpy Red away from their users. Returns how many expired.
+func (cfg *apiConfig) expireSubscriptions(ctx context.Context) (int, error) {
+	tx, err := cfg.sqlDB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	qtx := cfg.withTx(tx)
+
+	expired, err := qtx.ExpireLapsedSubscriptions(ctx)
+	if err != nil {
+		return 0, err
+	}
+	for _, subscription := range expired {
+		_, err = qtx.DowngradeUserRed(ctx, subscription.UserID)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(expired), tx.Commit()
+}
+
+// Runs expireSubscriptions every interval until ctx is done
+func (cfg *apiConfig) runSubscriptionExpiry(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		n, err := cfg.expireSubscriptions(ctx)
+		if err != nil {
+			slog.Error("Could not expire subscriptions", "error", err)
+		} else if n > 0 {
+			slog.Info("Expired Chirpy Red subscriptions", "count", n)
+		}
+		// Expired grants are already ignored, this only keeps the table small
+		cfg.db.DeleteExpiredUserEntitlements(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pauslik/chirpy/internal/database"
+	"github.com/pauslik/chirpy/internal/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Incoming webhooks are stored in webhook_events before they're acknowledged
+// and processed here, so a database blip only delays an event instead of
+// failing the delivery
+
+// Webhook event statuses
+const (
+	webhookPending    = "pending"
+	webhookProcessing = "processing"
+	webhookProcessed  = "processed"
+	webhookFailed     = "failed"
+	webhookDead       = "dead"
+)
+
+const (
+	// Attempts before an event is dead-lettered and waits for an admin replay
+	webhookMaxAttempts = 8
+	// First retry delay, doubled on every further attempt
+	webhookRetryDelay = 30 * time.Second
+	// A claimed event is picked up again after this if its worker died
+	webhookClaimLease = 5 * time.Minute
+)
+
+// Errors retrying won't fix, the event is dead-lettered right away
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e *permanentError) Unwrap() error {
+	return e.err
+}
+
+// Delay before the next attempt when attempts have failed
+func webhookBackoff(attempts int32) time.Duration {
+	delay := webhookRetryDelay
+	for i := int32(1); i < attempts && delay < 6*time.Hour; i++ {
+		delay *= 2
+	}
+	return delay
+}
+
+// Wakes the worker up for a new or replayed event, without waiting for the next poll
+func (cfg *apiConfig) wakeWebhookWorker() {
+	select {
+	case cfg.webhookWake <- struct{}{}:
+	default:
+	}
+}
+
+// Processes due events until ctx is done, polling every interval for retries.
+// An event being processed when ctx is done is still finished.
+func (cfg *apiConfig) runWebhookWorker(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	work := context.WithoutCancel(ctx)
+	for {
+		for ctx.Err() == nil {
+			processed, err := cfg.processNextWebhookEvent(work)
+			if err != nil {
+				slog.Error("Could not process webhook event", "error", err)
+			}
+			if !processed {
+				break
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-cfg.webhookWake:
+		case <-ticker.C:
+			// Processed events only need to outlive the sender's retries
+			cfg.db.DeleteOldWebhookEvents(ctx)
+		}
+	}
+}
+
+// Claims and processes one due event, reports false when there was none
+func (cfg *apiConfig) processNextWebhookEvent(ctx context.Context) (bool, error) {
+	event, err := cfg.db.ClaimWebhookEvent(ctx, time.Now().Add(webhookClaimLease))
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	ctx, span := tracing.Start(tracing.WithTraceparent(ctx, event.Traceparent), "webhook.process", trace.SpanKindConsumer,
+		attribute.String("webhook.source", event.Source),
+		attribute.String("webhook.event", event.Event),
+		attribute.Int("webhook.attempt", int(event.Attempts)),
+	)
+	err = cfg.applyWebhookEvent(ctx, event)
+	tracing.End(span, err)
+	if err == nil {
+		return true, nil
+	}
+
+	fwep := database.FailWebhookEventParams{
+		ID:            event.ID,
+		Status:        webhookFailed,
+		LastError:     sql.NullString{String: err.Error(), Valid: true},
+		NextAttemptAt: time.Now().Add(webhookBackoff(event.Attempts)),
+	}
+	var permanent *permanentError
+	if errors.As(err, &permanent) || event.Attempts >= webhookMaxAttempts {
+		fwep.Status = webhookDead
+		slog.Warn("Webhook event dead-lettered", "id", event.ID, "source", event.Source, "event_id", event.EventID, "attempts", event.Attempts, "error", err)
+	}
+	failErr := cfg.db.FailWebhookEvent(ctx, fwep)
+	if failErr != nil {
+		// The claim lease runs out and the event is retried anyway
+		return true, failErr
+	}
+	return true, nil
+}
+
+// Applies the event and marks it processed in one transaction
+func (cfg *apiConfig) applyWebhookEvent(ctx context.Context, event database.WebhookEvent) error {
+	if event.Source != webhookSourcePolka {
+		return &permanentError{fmt.Errorf("unknown source %q", event.Source)}
+	}
+	iEvent := inputPolkaEvent{}
+	err := json.Unmarshal([]byte(event.Payload), &iEvent)
+	if err != nil {
+		return &permanentError{fmt.Errorf("invalid payload: %w", err)}
+	}
+
+	tx, err := cfg.sqlDB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	qtx := cfg.withTx(tx)
+
+	if polkaSubscriptionEvent(iEvent.Event) {
+		userID, err := uuid.Parse(iEvent.Data.UserID)
+		if err != nil {
+			return &permanentError{fmt.Errorf("invalid user ID: %w", err)}
+		}
+		err = applyPolkaEvent(ctx, qtx, userID, iEvent)
+		if errors.Is(err, sql.ErrNoRows) {
+			return &permanentError{fmt.Errorf("user %s not found", userID)}
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	err = qtx.MarkWebhookEventProcessed(ctx, event.ID)
+	if err != nil {
+		return err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+	// The event may have queued outgoing webhooks
+	cfg.wakeDeliveryWorker()
+	return nil
+}